@@ -41,15 +41,60 @@ type Args struct {
 	AutoDiscovery          *bool   `long:"auto-discovery" description:"automatically scrape all database for given server" env:"OG_EXPORTER_AUTO_DISCOVERY"`
 	ExcludeDatabase        *string `long:"exclude-database" description:"excluded databases when enabling auto-discovery" default:"template0,template1" env:"OG_EXPORTER_EXCLUDE_DATABASE"`
 	IncludeDatabase        *string
+	Databases              *string
+	AutoDiscoverSchemas    *bool
+	IncludeSchemas         *string
+	ExcludeSchemas         *string
 	ExporterNamespace      *string `long:"namespace" description:"prefix of built-in metrics, (og) by default" env:"OG_EXPORTER_NAMESPACE"`
+	StrictNamespace        *bool
+	FingerprintJoin        *string
+	SocketFingerprint      *bool
+	DatabaseSizePretty     *bool
+	StatStatementsTopN     *int
+	LatencyLabel           *bool
+	ExposeQuerySQL         *bool
+	MaxConcurrentServers   *int
+	ReplicaURLs            *[]string
+	UserLabel              *bool
+	DedupMetrics           *bool
+	SystemLabels           *bool
+	TLSCertExpiry          *bool
+	TargetError            *bool
+	KeepAlive              *time.Duration
+	PlanDiagnostics        *bool
+	DeltaOnly              *bool
+	StrictColumns          *bool
+	TargetLabelFromDSN     *bool
+	BreakerThreshold       *int
+	BreakerCooldown        *time.Duration
+	ClusterName            *string
+	ClusterNames           *[]string
+	ReadOnlySQL            *bool
+	ReadOnlySession        *bool
+	StaleFactor            *float64
+	ScrapeMemoryBudget     *int64
 	FailFast               *bool   `long:"fail-fast" description:"fail fast instead of waiting during start-up" env:"OG_EXPORTER_FAIL_FAST"`
 	ListenAddress          *string `long:"listen-address" description:"prometheus web server listen address" default:":8080" env:"OG_EXPORTER_LISTEN_ADDRESS"`
 	MetricPath             *string `long:"telemetry-path" description:"URL path under which to expose metrics." default:"/metrics" env:"OG_EXPORTER_TELEMETRY_PATH"`
 	DryRun                 *bool   `long:"dry-run" description:"dry run and print raw configs"`
+	CollectOnce            *bool   `long:"once" description:"scrape targets once, print metrics and exit"`
 	ExplainOnly            *bool   `long:"explain" description:"explain server planned queries"`
 	Parallel               *int    `long:"parallel" description:"Specify the parallelism. \nthe degree of parallelism is now useful query database thread "`
 	DisableSettingsMetrics *bool
+	TextSettingsAsInfo     *bool
 	TimeToString           *bool
+	CompatibilityLabel     *bool
+	NodeLabel              *bool
+	RoleQuery              *string
+	UpQuery                *string
+	MaxLabelLength         *int
+	MaxRows                *int
+	StatementTimeout       *bool
+	ReconnectSQLStates     *string
+	ErrorLogInterval       *time.Duration
+	SessionSetup           *[]string
+	ChecksumSettings       *string
+	ScrapeJitter           *time.Duration
 	IsMemPprof             *bool
 	Pprof                  *bool
 }
@@ -134,14 +179,42 @@ func initArgs(args *Args) {
 		Default("template0,template1").
 		Envar("OG_EXPORTER_EXCLUDE_DATABASES").
 		String()
+	args.AutoDiscoverSchemas = kingpin.Flag("auto-discover-schemas", "Whether to discover the schemas of every database for perSchema queries.").
+		Default("false").
+		Envar("OG_EXPORTER_AUTO_DISCOVER_SCHEMAS").
+		Bool()
+	args.IncludeSchemas = kingpin.Flag("include-schemas", "A list of schemas to add when autoDiscoverSchemas is enabled").
+		Default("").
+		Envar("OG_EXPORTER_INCLUDE_SCHEMAS").
+		String()
+	args.ExcludeSchemas = kingpin.Flag("exclude-schemas", "A list of schemas to remove when autoDiscoverSchemas is enabled").
+		Default("").
+		Envar("OG_EXPORTER_EXCLUDE_SCHEMAS").
+		String()
+	args.Databases = kingpin.Flag("databases", "A list of databases to scrape without querying pg_database, separated by comma(,).").
+		Default("").
+		Envar("OG_EXPORTER_DATABASES").
+		String()
 	args.ExporterNamespace = kingpin.Flag("namespace", "prefix of built-in metrics, (og) by default").
 		Default("pg").
 		Envar("OG_EXPORTER_NAMESPACE").
 		String()
-	// args.FailFast = kingpin.Flag("fail-fast", "fail fast instead of waiting during start-up").
-	// 	Default("false").
-	// 	Envar("OG_EXPORTER_FAIL_FAST").
-	// 	Bool()
+	args.StrictNamespace = kingpin.Flag("strict-namespace", "reject namespace with characters not allowed in metric name instead of replacing them").
+		Default("false").
+		Envar("OG_EXPORTER_STRICT_NAMESPACE").
+		Bool()
+	args.FingerprintJoin = kingpin.Flag("fingerprint-join", "join all hosts of multi-host dsn with it as server label, like h1:5432,h2:5433. empty keeps the first host only").
+		Default("").
+		Envar("OG_EXPORTER_FINGERPRINT_JOIN").
+		String()
+	args.SocketFingerprint = kingpin.Flag("socket-fingerprint", "keep unix socket directory in server label, like localhost:5432(socket:/tmp), distinct from tcp localhost").
+		Default("false").
+		Envar("OG_EXPORTER_SOCKET_FINGERPRINT").
+		Bool()
+	args.FailFast = kingpin.Flag("fail-fast", "fail fast instead of waiting during start-up").
+		Default("false").
+		Envar("OG_EXPORTER_FAIL_FAST").
+		Bool()
 	args.ListenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").
 		Default(":9187").
 		Envar("OG_EXPORTER_WEB_LISTEN_ADDRESS").
@@ -155,14 +228,163 @@ func initArgs(args *Args) {
 		Default("false").
 		Envar("OG_EXPORTER_TIME_TO_STRING").
 		Bool()
+	args.CompatibilityLabel = kingpin.Flag("compatibility-label", "add database datcompatibility mode as label.").
+		Default("false").
+		Envar("OG_EXPORTER_COMPATIBILITY_LABEL").
+		Bool()
+	args.NodeLabel = kingpin.Flag("node-label", "add local node_name/node_type as label on distributed deployment, enable pgxc_node metrics.").
+		Default("false").
+		Envar("OG_EXPORTER_NODE_LABEL").
+		Bool()
+	args.RoleQuery = kingpin.Flag("role-query", "sql to determine primary/standby role instead of pg_is_in_recovery(), return boolean or role string").
+		Default("").
+		Envar("OG_EXPORTER_ROLE_QUERY").
+		String()
+	args.UpQuery = kingpin.Flag("up-query", "sql which must succeed for target to be up besides ping, like a write to a heartbeat table").
+		Default("").
+		Envar("OG_EXPORTER_UP_QUERY").
+		String()
+	args.ScrapeJitter = kingpin.Flag("scrape-jitter", "random delay up to it before scrape each dsn, spread load of many exporters. 0 disable").
+		Default("0s").
+		Envar("OG_EXPORTER_SCRAPE_JITTER").
+		Duration()
+	args.MaxLabelLength = kingpin.Flag("max-label-length", "truncate label value longer than it, 0 means unlimited").
+		Default("256").
+		Envar("OG_EXPORTER_MAX_LABEL_LENGTH").
+		Int()
+	args.MaxRows = kingpin.Flag("max-rows", "stop scanning query result after it, 0 means unlimited. query maxRows overrides it").
+		Default("0").
+		Envar("OG_EXPORTER_MAX_ROWS").
+		Int()
+	args.StatementTimeout = kingpin.Flag("statement-timeout", "set statement_timeout of query transaction to query timeout, database aborts runaway query itself").
+		Default("false").
+		Envar("OG_EXPORTER_STATEMENT_TIMEOUT").
+		Bool()
+	args.ReconnectSQLStates = kingpin.Flag("reconnect-sqlstates", "comma separated SQLSTATE of query error which close connection and reconnect, like 57P01 after failover").
+		Default("57P01,57P02,57P03").
+		Envar("OG_EXPORTER_RECONNECT_SQLSTATES").
+		String()
+	args.ErrorLogInterval = kingpin.Flag("error-log-interval", "log errors of same query at most once in interval, others are summarized. 0 log every time").
+		Default("5m").
+		Envar("OG_EXPORTER_ERROR_LOG_INTERVAL").
+		Duration()
+	args.DatabaseSizePretty = kingpin.Flag("database-size-pretty", "emit pg_database_size_info with human-readable database size as pretty label").
+		Default("false").
+		Envar("OG_EXPORTER_DATABASE_SIZE_PRETTY").
+		Bool()
+	args.LatencyLabel = kingpin.Flag("latency-label", "add bucketed query latency as scrape_latency_ms label to first metric of each query").
+		Default("false").
+		Envar("OG_EXPORTER_LATENCY_LABEL").
+		Bool()
+	args.StatStatementsTopN = kingpin.Flag("stat-statements-top", "collect top n statements by total time from pg_stat_statements extension. 0 for disable").
+		Default("0").
+		Envar("OG_EXPORTER_STAT_STATEMENTS_TOP").
+		Int()
+	args.ExposeQuerySQL = kingpin.Flag("expose-query-sql", "emit exporter_query_info with sql of each executed query as label, for auditing").
+		Default("false").
+		Envar("OG_EXPORTER_EXPOSE_QUERY_SQL").
+		Bool()
+	args.MaxConcurrentServers = kingpin.Flag("max-concurrent-servers", "max number of dsn scraped at once, avoid connection storm with many targets. 0 for unlimited").
+		Default("0").
+		Envar("OG_EXPORTER_MAX_CONCURRENT_SERVERS").
+		Int()
+	args.ReplicaURLs = kingpin.Flag("replica-url", "standby replica of target as host:port=url, queries marked preferReplica run on it. can be repeated").
+		Envar("OG_EXPORTER_REPLICA_URL").
+		Strings()
+	args.UserLabel = kingpin.Flag("user-label", "add user of target url as db_user label of up and scrape metrics, attribute them to monitoring role").
+		Default("false").
+		Envar("OG_EXPORTER_USER_LABEL").
+		Bool()
+	args.StaleFactor = kingpin.Flag("cache-stale-factor", "serve cached metrics while query fails, until cache is these times of ttl old, then stop emitting them. 0 for never").
+		Default("0").
+		Envar("OG_EXPORTER_CACHE_STALE_FACTOR").
+		Float64()
+	args.ReadOnlySQL = kingpin.Flag("read-only-sql", "refuse to start if sql of any query does not start with SELECT, WITH, SHOW, TABLE or VALUES or has more than one statement. not enough alone, use with --read-only-session").
+		Default("false").
+		Envar("OG_EXPORTER_READ_ONLY_SQL").
+		Bool()
+	args.ReadOnlySession = kingpin.Flag("read-only-session", "make transactions of connections read only, database rejects writes of queries").
+		Default("false").
+		Envar("OG_EXPORTER_READ_ONLY_SESSION").
+		Bool()
+	args.ClusterName = kingpin.Flag("cluster-name", "add cluster label with it to metrics of targets, unless mapped by --target-cluster-name").
+		Default("").
+		Envar("OG_EXPORTER_CLUSTER_NAME").
+		String()
+	args.ClusterNames = kingpin.Flag("target-cluster-name", "cluster label of target as host:port=name. targets not mapped get --cluster-name or empty cluster label. can be repeated").
+		Envar("OG_EXPORTER_TARGET_CLUSTER_NAME").
+		Strings()
+	args.BreakerThreshold = kingpin.Flag("circuit-breaker-failures", "skip connecting to target after so many consecutive failures, up is 0 meanwhile. 0 disable").
+		Default("0").
+		Envar("OG_EXPORTER_CIRCUIT_BREAKER_FAILURES").
+		Int()
+	args.BreakerCooldown = kingpin.Flag("circuit-breaker-cooldown", "how long connecting is skipped once circuit breaker opens").
+		Default("1m").
+		Envar("OG_EXPORTER_CIRCUIT_BREAKER_COOLDOWN").
+		Duration()
+	args.TargetLabelFromDSN = kingpin.Flag("target-label-from-dsn", "use host:port exactly as written in dsn as server label instead of fingerprint").
+		Default("false").
+		Envar("OG_EXPORTER_TARGET_LABEL_FROM_DSN").
+		Bool()
+	args.StrictColumns = kingpin.Flag("strict-columns", "fail query whose result has duplicate column names instead of renaming them to name_2, name_3").
+		Default("false").
+		Envar("OG_EXPORTER_STRICT_COLUMNS").
+		Bool()
+	args.DeltaOnly = kingpin.Flag("experimental-delta-only", "EXPERIMENTAL: emit query metrics only when changed since last scrape. prometheus marks the others stale, only for downstreams keeping last sample").
+		Default("false").
+		Envar("OG_EXPORTER_EXPERIMENTAL_DELTA_ONLY").
+		Bool()
+	args.PlanDiagnostics = kingpin.Flag("query-plan-diagnostics", "explain queries at most once in 10 minutes, emit estimated cost as exporter_query_plan_cost").
+		Default("false").
+		Envar("OG_EXPORTER_QUERY_PLAN_DIAGNOSTICS").
+		Bool()
+	args.KeepAlive = kingpin.Flag("keepalive-interval", "ping every server in interval between scrapes, keep connections warm and detect failover early. 0 disables").
+		Default("0s").
+		Envar("OG_EXPORTER_KEEPALIVE_INTERVAL").
+		Duration()
+	args.TargetError = kingpin.Flag("target-error", "emit target_error with error of last failed connect as label while target is down").
+		Default("false").
+		Envar("OG_EXPORTER_TARGET_ERROR").
+		Bool()
+	args.SystemLabels = kingpin.Flag("system-labels", "add data_directory and system_identifier of instance as label, correlate with host metrics").
+		Default("false").
+		Envar("OG_EXPORTER_SYSTEM_LABELS").
+		Bool()
+	args.TLSCertExpiry = kingpin.Flag("tls-cert-expiry", "emit expiry of the certificate target presented when the driver connected with TLS").
+		Default("false").
+		Envar("OG_EXPORTER_TLS_CERT_EXPIRY").
+		Bool()
+	args.DedupMetrics = kingpin.Flag("dedup-metrics", "drop metrics repeating name and labels in a scrape and keep the last, instead of failing the whole scrape. Rows of one query repeating labels always keep the last, this also covers label-less rows and repeats across queries. Holds the whole scrape in memory before sending anything").
+		Default("false").
+		Envar("OG_EXPORTER_DEDUP_METRICS").
+		Bool()
+	args.ScrapeMemoryBudget = kingpin.Flag("scrape-memory-budget", "abort scrape of a server once values scanned exceed about these bytes. 0 for unlimited").
+		Default("0").
+		Envar("OG_EXPORTER_SCRAPE_MEMORY_BUDGET").
+		Int64()
+	args.ChecksumSettings = kingpin.Flag("config-checksum-settings", "comma separated settings hashed into config_checksum metric, configuration drift shows as changed checksum").
+		Default("").
+		Envar("OG_EXPORTER_CONFIG_CHECKSUM_SETTINGS").
+		String()
+	args.SessionSetup = kingpin.Flag("session-setup", "sql run on connection before query metrics, like SET search_path. can be repeated").
+		Envar("OG_EXPORTER_SESSION_SETUP").
+		Strings()
 	args.DryRun = kingpin.Flag("dry-run", "dry run and print default configs and user config").
 		Bool()
 
+	args.CollectOnce = kingpin.Flag("once", "scrape each target once, print metrics to stdout and exit").
+		Bool()
+
 	args.DisableSettingsMetrics = kingpin.Flag("disable-settings-metrics",
 		"Do not include pg_settings metrics.").
 		Default("false").
 		Envar("OG_EXPORTER_DISABLE_SETTINGS_METRICS").
 		Bool()
+	args.TextSettingsAsInfo = kingpin.Flag("text-settings-as-info",
+		"Emit textual pg_settings as info metrics with value in setting label.").
+		Default("false").
+		Envar("OG_EXPORTER_TEXT_SETTINGS_AS_INFO").
+		Bool()
 
 	args.ExplainOnly = kingpin.Flag("explain", "explain server planned queries").
 		Bool()
@@ -183,14 +405,57 @@ func newOgExporter(args *Args) (*exporter.Exporter, error) {
 		exporter.WithConfig(*args.ConfigPath),
 		exporter.WithConstLabels(*args.ConstLabels),
 		exporter.WithCacheDisabled(*args.DisableCache),
-		// exporter.WithFailFast(*args.FailFast),
+		exporter.WithFailFast(*args.FailFast),
 		exporter.WithNamespace(*args.ExporterNamespace),
+		exporter.WithStrictNamespace(*args.StrictNamespace),
+		exporter.WithFingerprintJoin(*args.FingerprintJoin),
+		exporter.WithSocketFingerprint(*args.SocketFingerprint),
+		exporter.WithDatabaseSizePretty(*args.DatabaseSizePretty),
+		exporter.WithStatStatementsTopN(*args.StatStatementsTopN),
+		exporter.WithLatencyLabel(*args.LatencyLabel),
+		exporter.WithExposeQuerySQL(*args.ExposeQuerySQL),
+		exporter.WithMaxConcurrentServers(*args.MaxConcurrentServers),
+		exporter.WithReplicaDSNs(*args.ReplicaURLs),
+		exporter.WithUserLabel(*args.UserLabel),
+		exporter.WithDedupMetrics(*args.DedupMetrics),
+		exporter.WithSystemLabels(*args.SystemLabels),
+		exporter.WithTLSCertExpiry(*args.TLSCertExpiry),
+		exporter.WithTargetError(*args.TargetError),
+		exporter.WithKeepAlive(*args.KeepAlive),
+		exporter.WithQueryPlanDiagnostics(*args.PlanDiagnostics),
+		exporter.WithDeltaOnly(*args.DeltaOnly),
+		exporter.WithStrictColumns(*args.StrictColumns),
+		exporter.WithTargetLabelFromDSN(*args.TargetLabelFromDSN),
+		exporter.WithCircuitBreaker(*args.BreakerThreshold, *args.BreakerCooldown),
+		exporter.WithClusterName(*args.ClusterName),
+		exporter.WithClusterNames(*args.ClusterNames),
+		exporter.WithReadOnlySQL(*args.ReadOnlySQL),
+		exporter.WithReadOnlySession(*args.ReadOnlySession),
+		exporter.WithStaleFactor(*args.StaleFactor),
+		exporter.WithScrapeMemoryBudget(*args.ScrapeMemoryBudget),
 		exporter.WithAutoDiscovery(*args.AutoDiscovery),
 		exporter.WithExcludeDatabases(*args.ExcludeDatabase),
 		exporter.WithIncludeDatabases(*args.IncludeDatabase),
+		exporter.WithAutoDiscoverSchemas(*args.AutoDiscoverSchemas),
+		exporter.WithIncludeSchemas(*args.IncludeSchemas),
+		exporter.WithExcludeSchemas(*args.ExcludeSchemas),
+		exporter.WithDatabases(strings.Split(*args.Databases, ",")),
 		exporter.WithDisableSettingsMetrics(*args.DisableSettingsMetrics),
+		exporter.WithTextSettingsAsInfo(*args.TextSettingsAsInfo),
 		exporter.WithTimeToString(*args.TimeToString),
 		exporter.WithParallel(*args.Parallel),
+		exporter.WithCompatibilityLabel(*args.CompatibilityLabel),
+		exporter.WithNodeLabel(*args.NodeLabel),
+		exporter.WithRoleQuery(*args.RoleQuery),
+		exporter.WithUpQuery(*args.UpQuery),
+		exporter.WithMaxLabelLength(*args.MaxLabelLength),
+		exporter.WithMaxRows(*args.MaxRows),
+		exporter.WithStatementTimeout(*args.StatementTimeout),
+		exporter.WithReconnectSQLStates(strings.Split(*args.ReconnectSQLStates, ",")),
+		exporter.WithErrorLogInterval(*args.ErrorLogInterval),
+		exporter.WithConfigChecksum(strings.Split(*args.ChecksumSettings, ",")),
+		exporter.WithSessionSetup(*args.SessionSetup),
+		exporter.WithScrapeJitter(*args.ScrapeJitter),
 		// exporter.WithTags(*args.ServerTags),
 	)
 	return ex, err
@@ -250,6 +515,15 @@ func runApp(args *Args) {
 		fmt.Println(queryList)
 		return
 	}
+	if *args.CollectOnce {
+		defer ogExporter.Close()
+		text, err := ogExporter.CollectOnceToText()
+		if err != nil {
+			log.Errorf("collect once: %s", err)
+		}
+		fmt.Print(text)
+		return
+	}
 	prometheus.MustRegister(ogExporter)
 	defer ogExporter.Close()
 
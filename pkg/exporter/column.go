@@ -3,8 +3,11 @@
 package exporter
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"reflect"
+	"strings"
 )
 
 const (
@@ -15,8 +18,29 @@ const (
 	HISTOGRAM    = "HISTOGRAM"
 	MappedMETRIC = "MAPPEDMETRIC"
 	DURATION     = "DURATION"
+	LSN          = "LSN"         // Use this column as a gauge, value is a hex LSN / xlog position like 0/331980B8
+	INFO         = "INFO"        // Use this column as label of an info metric, value is always 1
+	JSONLabels   = "JSON_LABELS" // Use declared keys of this flat JSON object column as labels
 )
 
+// label value normalization of Column.Normalize
+const (
+	NormalizeNone  = "none"
+	NormalizeLower = "lower"
+	NormalizeUpper = "upper"
+	NormalizeTrim  = "trim"
+)
+
+var columnNormalize = map[string]bool{
+	NormalizeNone:  true,
+	NormalizeLower: true,
+	NormalizeUpper: true,
+	NormalizeTrim:  true,
+}
+
+// infoCardinalityLimit warn if distinct values of an INFO column grow beyond it
+const infoCardinalityLimit = 100
+
 var ColumnUsage = map[string]bool{
 	DISCARD:      true,
 	LABEL:        true,
@@ -25,6 +49,9 @@ var ColumnUsage = map[string]bool{
 	HISTOGRAM:    true,
 	MappedMETRIC: true,
 	DURATION:     true,
+	LSN:          true,
+	INFO:         true,
+	JSONLabels:   true,
 }
 
 type Column struct {
@@ -35,10 +62,89 @@ type Column struct {
 	Desc           string               `yaml:"description,omitempty"`
 	Usage          string               `yaml:"usage,omitempty"`
 	Rename         string               `yaml:"rename,omitempty"`
+	NullLabelValue string               `yaml:"nullLabelValue,omitempty"` // label value of NULL, default empty
+	InfoLabel      string               `yaml:"infoLabel,omitempty"`      // label name of INFO column value, default column name
+	Keys           []string             `yaml:"keys,omitempty"`           // keys of JSON_LABELS column taken as labels, in order
+	Normalize      string               `yaml:"normalize,omitempty"`      // none, lower, upper or trim label value, default none
+	Counts         string               `yaml:"counts,omitempty"`         // DISCARD column of bucket counts array, HISTOGRAM column holds bounds array
+	Sum            string               `yaml:"sum,omitempty"`            // DISCARD column of sum of observations for HISTOGRAM, 0 if not set
+	PrometheusName string               `yaml:"-"`                        // sanitized Name used in prometheus metric/label name
 	PrometheusDesc *prometheus.Desc     `yaml:"-"`
 	PrometheusType prometheus.ValueType `yaml:"-"`
 }
 
+func (c *Column) promName() string {
+	if c.PrometheusName != "" {
+		return c.PrometheusName
+	}
+	return c.Name
+}
+
+// infoLabel label name carrying value of INFO column
+func (c *Column) infoLabel() string {
+	if c.InfoLabel != "" {
+		return c.InfoLabel
+	}
+	return c.promName()
+}
+
+// normalize apply Normalize to label value
+func (c *Column) normalize(v string) string {
+	switch c.Normalize {
+	case NormalizeLower:
+		return strings.ToLower(v)
+	case NormalizeUpper:
+		return strings.ToUpper(v)
+	case NormalizeTrim:
+		return strings.TrimSpace(v)
+	}
+	return v
+}
+
 func (c *Column) String() string {
 	return fmt.Sprintf("%-8s %-30s %s", c.Usage, c.Name, c.Desc)
 }
+
+// numericDBTypes database type names treated as metric value
+var numericDBTypes = map[string]bool{
+	"INT": true, "INT2": true, "INT4": true, "INT8": true, "INTEGER": true, "SMALLINT": true, "BIGINT": true, "TINYINT": true,
+	"OID": true, "XID": true, "NUMERIC": true, "DECIMAL": true, "FLOAT4": true, "FLOAT8": true, "REAL": true,
+	"DOUBLE PRECISION": true, "BOOL": true, "BOOLEAN": true,
+}
+
+// InferColumns propose column definition from query result, numeric column as GAUGE and others as LABEL.
+// Used to bootstrap metric definition of wide query
+func InferColumns(rows *sql.Rows) ([]*Column, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]*Column, 0, len(columnTypes))
+	for _, ct := range columnTypes {
+		usage := LABEL
+		if isNumericColumn(ct) {
+			usage = GAUGE
+		}
+		columns = append(columns, &Column{Name: ct.Name(), Usage: usage})
+	}
+	return columns, nil
+}
+
+// isNumericColumn check database type name first, fallback to scan type
+func isNumericColumn(ct *sql.ColumnType) bool {
+	if dbType := strings.ToUpper(ct.DatabaseTypeName()); dbType != "" {
+		return numericDBTypes[dbType]
+	}
+	scanType := ct.ScanType()
+	if scanType == nil {
+		return false
+	}
+	switch scanType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		return true
+	default:
+		return false
+	}
+}
@@ -2,6 +2,8 @@
 
 package exporter
 
+import "fmt"
+
 // var (
 // 	ogVersionName = "OG_VERSION"
 // )
@@ -40,9 +42,20 @@ WHERE database IS NOT NULL GROUP BY database, mode) cnt USING (database, mode);`
 				Name: "pg_stat_replication",
 				SQL: `SELECT *,
   (case pg_is_in_recovery() when 't' then null else pg_current_xlog_location() end) AS pg_current_xlog_location,
-  (case pg_is_in_recovery() when 't' then null else pg_xlog_location_diff(pg_current_xlog_location(), receiver_replay_location)::float end) AS pg_xlog_location_diff
+  (case pg_is_in_recovery() when 't' then null else pg_xlog_location_diff(pg_current_xlog_location(), receiver_replay_location)::float end) AS pg_xlog_location_diff,
+  (case pg_is_in_recovery() when 't' then null else pg_xlog_location_diff(pg_current_xlog_location(), receiver_replay_location)::float end) AS replication_lag_bytes
 FROM pg_stat_replication`,
-				Version: ">=1.0.0",
+				// unparsed version is tried with xlog naming first, openGauss fork never falls through to wal naming
+				Version: ">=0.0.0",
+			},
+			{
+				// backend without openGauss version, use wal naming of PostgreSQL 10+ once xlog naming failed
+				Name: "pg_stat_replication",
+				SQL: `SELECT *,
+  (case pg_is_in_recovery() when 't' then null else pg_current_wal_lsn() end) AS pg_current_wal_lsn,
+  (case pg_is_in_recovery() when 't' then null else pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn)::float end) AS replication_lag_bytes
+FROM pg_stat_replication`,
+				Version: "=0.0.0",
 			},
 		},
 		Metrics: []*Column{
@@ -90,6 +103,7 @@ FROM pg_stat_replication`,
 			{Name: "pg_current_wal_lsn_bytes", Usage: GAUGE, Desc: "WAL position in bytes"},
 			{Name: "pg_xlog_location_diff", Usage: GAUGE, Desc: "Lag in bytes between primary and slave"},
 			{Name: "pg_wal_lsn_diff", Usage: GAUGE, Desc: "Lag in bytes between primary and slave"},
+			{Name: "replication_lag_bytes", Usage: GAUGE, Desc: "Replay lag of standby in bytes, null on standby"},
 			{Name: "confirmed_flush_lsn", Usage: DISCARD, Desc: "LSN position a consumer of a slot has confirmed flushing the data received"},
 			{Name: "write_lag", Usage: DISCARD, Desc: "Time elapsed between flushing recent WAL locally and receiving notification that this standby server has written it (but not yet flushed it or applied it). This can be used to gauge the delay that synchronous_commit level remote_write incurred while committing if this server was configured as a synchronous standby."},
 			{Name: "flush_lag", Usage: DISCARD, Desc: "Time elapsed between flushing recent WAL locally and receiving notification that this standby server has written and flushed it (but not yet applied it). This can be used to gauge the delay that synchronous_commit level remote_flush incurred while committing if this server was configured as a synchronous standby."},
@@ -149,6 +163,23 @@ FROM (SELECT d.oid AS database, d.datname, a.state
 		},
 		Public: true,
 	}
+	// pgDatabasePretty pgDatabase with human-readable size as info metric
+	pgDatabasePretty = &QueryInstance{
+		Name: "pg_database",
+		Desc: "OpenGauss Database size",
+		Queries: []*Query{
+			{
+				SQL:     `SELECT pg_database.datname, pg_database_size(pg_database.datname) as size_bytes, pg_size_pretty(pg_database_size(pg_database.datname)) as size_info FROM pg_database where datname NOT IN ('template0','template1')`,
+				Version: ">=0.0.0",
+			},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL, Desc: "Name of this database"},
+			{Name: "size_bytes", Usage: GAUGE, Desc: "Disk space used by the database"},
+			{Name: "size_info", Usage: INFO, InfoLabel: "pretty", Desc: "Disk space used by the database in human-readable format"},
+		},
+		Public: true,
+	}
 	pgStatBgWriter = &QueryInstance{
 		Name: "pg_stat_bgwriter",
 		Desc: "OpenGauss background writer metrics",
@@ -235,6 +266,59 @@ FROM pg_stat_bgwriter`,
 			{Name: "confl_deadlock", Usage: COUNTER, Desc: "Number of queries in this database that have been canceled due to deadlocks"},
 		},
 	}
+	pgReplicationSlots = &QueryInstance{
+		Name: "pg_replication_slots",
+		Desc: "OpenGauss replication slots, physical and logical",
+		Queries: []*Query{
+			{
+				SQL: `SELECT slot_name, coalesce(plugin, '') AS plugin, slot_type, coalesce(database, '') AS database, active,
+  restart_lsn, confirmed_flush,
+  (case pg_is_in_recovery() when 't' then null else pg_xlog_location_diff(pg_current_xlog_location(), restart_lsn)::float end) AS retained_bytes
+FROM pg_replication_slots`,
+				Version: ">=2.0.0",
+			},
+			{
+				SQL: `SELECT slot_name, coalesce(plugin, '') AS plugin, slot_type, coalesce(database, '') AS database, active,
+  restart_lsn,
+  (case pg_is_in_recovery() when 't' then null else pg_xlog_location_diff(pg_current_xlog_location(), restart_lsn)::float end) AS retained_bytes
+FROM pg_replication_slots`,
+				Version: ">=0.0.0 <2.0.0",
+			},
+		},
+		Metrics: []*Column{
+			{Name: "slot_name", Usage: LABEL, Desc: "A unique, cluster-wide identifier for the replication slot"},
+			{Name: "plugin", Usage: LABEL, Desc: "The output plugin of logical slot, empty for physical slots"},
+			{Name: "slot_type", Usage: LABEL, Desc: "The slot type - physical or logical"},
+			{Name: "database", Usage: LABEL, Desc: "The database this slot is associated with, empty for physical slots"},
+			{Name: "active", Usage: GAUGE, Desc: "1 if this slot is currently actively being used"},
+			{Name: "restart_lsn", Usage: LSN, Desc: "The address (LSN) of oldest WAL which still might be required by the consumer of this slot"},
+			{Name: "confirmed_flush", Usage: LSN, Desc: "The address (LSN) up to which the logical slot's consumer has confirmed receiving data"},
+			{Name: "retained_bytes", Usage: GAUGE, Desc: "Size of WAL retained by this slot in bytes, null on standby"},
+		},
+		Public: true,
+	}
+	pgPgxcNode = &QueryInstance{
+		Name: "pg_pgxc_node",
+		Desc: "openGauss distributed cluster nodes",
+		Queries: []*Query{
+			{
+				SQL: `SELECT node_name AS name, node_type::text AS type, node_host AS host, node_port::text AS port,
+  nodeis_primary::int AS is_primary, nodeis_preferred::int AS is_preferred
+FROM pgxc_node`,
+				Version: ">=0.0.0",
+			},
+		},
+		Metrics: []*Column{
+			{Name: "name", Usage: LABEL, Desc: "Node name"},
+			{Name: "type", Usage: LABEL, Desc: "Node type, C coordinator D datanode"},
+			{Name: "host", Usage: LABEL, Desc: "Node host"},
+			{Name: "port", Usage: LABEL, Desc: "Node port"},
+			{Name: "is_primary", Usage: GAUGE, Desc: "1 if this node is the primary node"},
+			{Name: "is_preferred", Usage: GAUGE, Desc: "1 if this node is the preferred node"},
+		},
+		Public:      true,
+		Distributed: true,
+	}
 	pgActiveSlowsql = &QueryInstance{
 		Name: "pg_active_slowsql",
 		Desc: "openGauss active slow query",
@@ -266,6 +350,82 @@ FROM pg_stat_bgwriter`,
 )
 
 var (
+	pgLongRunningQuery = &QueryInstance{
+		Name: "pg_long_running_query",
+		Desc: "OpenGauss active queries running longer than 5 minutes",
+		Queries: []*Query{
+			{
+				SQL: `SELECT datname, usename, count(*) AS count,
+       max(extract(epoch from now() - query_start)) AS max_duration
+FROM pg_stat_activity
+WHERE state = 'active' AND pid <> pg_backend_pid() AND query_start < now() - interval '5 minutes'
+GROUP BY datname, usename`,
+				Version: ">=1.0.0",
+			},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL, Desc: "Name of this database"},
+			{Name: "usename", Usage: LABEL, Desc: "Name of the user running the query"},
+			{Name: "count", Usage: GAUGE, Desc: "number of queries running longer than 5 minutes"},
+			{Name: "max_duration", Usage: GAUGE, Desc: "max duration in seconds among long running queries"},
+		},
+		Requires: []string{"pg_stat_activity"},
+		Public:   true,
+	}
+	pgSessionMemory = &QueryInstance{
+		Name: "pg_session_memory",
+		Desc: "OpenGauss session memory by context, top 20",
+		Queries: []*Query{
+			{
+				SQL: `SELECT contextname, sum(totalsize) AS total_bytes, sum(usedsize) AS used_bytes
+FROM gs_session_memory_detail
+GROUP BY contextname
+ORDER BY total_bytes DESC
+LIMIT 20`,
+				Version: ">=1.0.0",
+			},
+		},
+		Metrics: []*Column{
+			{Name: "contextname", Usage: LABEL, Desc: "Name of memory context"},
+			{Name: "total_bytes", Usage: GAUGE, Desc: "memory allocated by sessions in this context"},
+			{Name: "used_bytes", Usage: GAUGE, Desc: "memory used by sessions in this context"},
+		},
+		Requires: []string{"gs_session_memory_detail"},
+		Public:   true,
+	}
+	pgWaitEvent = &QueryInstance{
+		Name: "pg_wait_event",
+		Desc: "OpenGauss threads waiting group by wait event, top 50",
+		Queries: []*Query{
+			{
+				SQL: `SELECT wait_status AS wait_event_type, coalesce(wait_event, 'none') AS wait_event, count(*) AS count
+FROM pg_thread_wait_status
+WHERE wait_status <> 'none'
+GROUP BY wait_status, wait_event
+ORDER BY count DESC
+LIMIT 50`,
+				Version: ">=2.0.0",
+				MaxRows: 50,
+			},
+			{
+				SQL: `SELECT wait_status AS wait_event_type, 'none' AS wait_event, count(*) AS count
+FROM pg_thread_wait_status
+WHERE wait_status <> 'none'
+GROUP BY wait_status
+ORDER BY count DESC
+LIMIT 50`,
+				Version: ">=1.0.0 <2.0.0",
+				MaxRows: 50,
+			},
+		},
+		Metrics: []*Column{
+			{Name: "wait_event_type", Usage: LABEL, Desc: "Wait status of thread, e.g. acquire lock, wait io"},
+			{Name: "wait_event", Usage: LABEL, Desc: "Wait event of thread, none before openGauss 2.0"},
+			{Name: "count", Usage: GAUGE, Desc: "number of threads waiting on this event"},
+		},
+		Requires: []string{"pg_thread_wait_status"},
+		Public:   true,
+	}
 	defaultMonList = map[string]*QueryInstance{
 		"pg_lock":                    pgLock,
 		"pg_stat_replication":        pgStatReplication,
@@ -274,5 +434,38 @@ var (
 		"pg_stat_bgwriter":           pgStatBgWriter,
 		"pg_stat_database":           pgStatDatabase,
 		"pg_stat_database_conflicts": pgStatDatabaseConflicts,
+		"pg_replication_slots":       pgReplicationSlots,
+		"pg_pgxc_node":               pgPgxcNode,
+		"pg_long_running_query":      pgLongRunningQuery,
+		"pg_session_memory":          pgSessionMemory,
+		"pg_wait_event":              pgWaitEvent,
 	}
 )
+
+// newPgStatStatements top n statements by total_time from pg_stat_statements, queryid as label.
+// Only registered when enabled by option, disabled on targets without the extension
+func newPgStatStatements(topN int) *QueryInstance {
+	return &QueryInstance{
+		Name: "pg_stat_statements",
+		Desc: fmt.Sprintf("OpenGauss top %d statements by total time", topN),
+		Queries: []*Query{
+			{
+				SQL: fmt.Sprintf(`SELECT d.datname, s.queryid::text AS queryid, s.calls, s.total_time, s.rows
+FROM pg_stat_statements s JOIN pg_database d ON d.oid = s.dbid
+ORDER BY s.total_time DESC
+LIMIT %d`, topN),
+				Version: ">=0.0.0",
+				MaxRows: topN,
+			},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL, Desc: "Name of database the statement executed in"},
+			{Name: "queryid", Usage: LABEL, Desc: "Hash code of the normalized statement"},
+			{Name: "calls", Usage: COUNTER, Desc: "Number of times the statement executed"},
+			{Name: "total_time", Usage: COUNTER, Desc: "Total milliseconds spent in the statement"},
+			{Name: "rows", Usage: COUNTER, Desc: "Total number of rows retrieved or affected by the statement"},
+		},
+		Extension: "pg_stat_statements",
+		Public:    true,
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright © 2020 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DerivedMetric gauge computed from metrics collected in the same scrape, e.g. cache hit ratio with
+// expr pg_stat_database_blks_hit / (pg_stat_database_blks_hit + pg_stat_database_blks_read).
+// Metrics referenced are joined on label names they share, metric without labels is used as scalar
+type DerivedMetric struct {
+	Name string    `yaml:"name"`           // metric name, prefixed with query name
+	Expr string    `yaml:"expr"`           // arithmetic over metric names and numbers, + - * / and parentheses
+	Desc string    `yaml:"desc,omitempty"` // help of derived metric
+	expr *exprNode // parsed Expr
+}
+
+// check validate name and parse expression of derived metric
+func (d *DerivedMetric) check(queryName string) error {
+	if d.Name == "" || sanitizeName(d.Name) != d.Name {
+		return fmt.Errorf("query %s derived metric %q is not a valid prometheus name", queryName, d.Name)
+	}
+	expr, err := parseExpr(d.Expr)
+	if err != nil {
+		return fmt.Errorf("query %s derived metric %s expr %q: %s", queryName, d.Name, d.Expr, err)
+	}
+	d.expr = expr
+	return nil
+}
+
+// exprNode node of derived metric expression, leaf is metric name or number
+type exprNode struct {
+	op          byte // + - * /, 0 for leaf
+	left, right *exprNode
+	name        string // metric name of leaf, empty for number
+	value       float64
+}
+
+// names metric names referenced in expression, in order of appearance
+func (n *exprNode) names() []string {
+	var names []string
+	var walk func(n *exprNode)
+	walk = func(n *exprNode) {
+		if n.op != 0 {
+			walk(n.left)
+			walk(n.right)
+			return
+		}
+		if n.name != "" && !Contains(names, n.name) {
+			names = append(names, n.name)
+		}
+	}
+	walk(n)
+	return names
+}
+
+// eval compute expression, false if any referenced metric has no value
+func (n *exprNode) eval(lookup func(name string) (float64, bool)) (float64, bool) {
+	if n.op == 0 {
+		if n.name == "" {
+			return n.value, true
+		}
+		return lookup(n.name)
+	}
+	l, ok := n.left.eval(lookup)
+	if !ok {
+		return 0, false
+	}
+	r, ok := n.right.eval(lookup)
+	if !ok {
+		return 0, false
+	}
+	switch n.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	default:
+		return l / r, true
+	}
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseExpr parse arithmetic expression with usual precedence, unary minus is supported
+func parseExpr(s string) (*exprNode, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) parseSum() (*exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == "+" || op == "-"; op = p.peek() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{op: op[0], left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseProduct() (*exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == "*" || op == "/"; op = p.peek() {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{op: op[0], left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	if p.peek() != "-" {
+		return p.parsePrimary()
+	}
+	p.pos++
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &exprNode{op: '-', left: &exprNode{}, right: operand}, nil
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	token := p.peek()
+	p.pos++
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "(":
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return node, nil
+	case exprNameRep.MatchString(token):
+		return &exprNode{name: token}, nil
+	default:
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected %q", token)
+		}
+		return &exprNode{value: value}, nil
+	}
+}
+
+var (
+	exprNameRep  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	exprTokenRep = regexp.MustCompile(`^\s*([a-zA-Z_:][a-zA-Z0-9_:]*|[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?|[-+*/()])`)
+)
+
+func tokenizeExpr(s string) ([]string, error) {
+	var tokens []string
+	for rest := strings.TrimSpace(s); rest != ""; rest = strings.TrimSpace(rest) {
+		m := exprTokenRep.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("invalid character at %q", rest)
+		}
+		tokens = append(tokens, m[1])
+		rest = rest[len(m[0]):]
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	return tokens, nil
+}
+
+type sample struct {
+	labels map[string]string
+	value  float64
+}
+
+// sampleSet values of metrics emitted in one scrape, keyed by metric name then labels. const labels are left out
+type sampleSet struct {
+	constLabels prometheus.Labels
+	names       map[string]string // emitted name -> name referenced in expressions, they differ when renamed
+	samples     map[string]map[string]sample
+}
+
+// newSampleSet record metrics emitted under names, only they are referenced by expressions
+func newSampleSet(constLabels prometheus.Labels, names map[string]string) *sampleSet {
+	return &sampleSet{constLabels: constLabels, names: names, samples: map[string]map[string]sample{}}
+}
+
+var fqNameRep = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// add record gauge, counter and untyped metric, other types can not be referenced
+func (ss *sampleSet) add(m prometheus.Metric) {
+	match := fqNameRep.FindStringSubmatch(m.Desc().String())
+	if match == nil {
+		return
+	}
+	name, ok := ss.names[match[1]]
+	if !ok {
+		return
+	}
+	pb := &dto.Metric{}
+	if err := m.Write(pb); err != nil {
+		return
+	}
+	var value float64
+	switch {
+	case pb.Gauge != nil:
+		value = pb.Gauge.GetValue()
+	case pb.Counter != nil:
+		value = pb.Counter.GetValue()
+	case pb.Untyped != nil:
+		value = pb.Untyped.GetValue()
+	default:
+		return
+	}
+	labels := map[string]string{}
+	for _, pair := range pb.Label {
+		if _, ok := ss.constLabels[pair.GetName()]; !ok {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+	}
+	series := ss.samples[name]
+	if series == nil {
+		series = map[string]sample{}
+		ss.samples[name] = series
+	}
+	series[labelsKey(labels)] = sample{labels: labels, value: value}
+}
+
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "\xff" + labels[k] + "\xff")
+	}
+	return b.String()
+}
+
+// derive evaluate derived metric once for every label set of referenced metrics, joined on label names all of
+// them share. Label set matching more than one series of a metric is ambiguous and skipped
+func (ss *sampleSet) derive(name string, d *DerivedMetric) []prometheus.Metric {
+	names := d.expr.names()
+	var shared map[string]bool
+	for _, metricName := range names {
+		for _, s := range ss.samples[metricName] {
+			if len(s.labels) == 0 {
+				continue
+			}
+			if shared == nil {
+				shared = make(map[string]bool, len(s.labels))
+				for k := range s.labels {
+					shared[k] = true
+				}
+				continue
+			}
+			for k := range shared {
+				if _, ok := s.labels[k]; !ok {
+					delete(shared, k)
+				}
+			}
+		}
+	}
+	// joined series of metric by shared labels, nil for ambiguous
+	joined := make(map[string]map[string]*sample, len(names))
+	labelSets := map[string]map[string]string{}
+	for _, metricName := range names {
+		series := map[string]*sample{}
+		for _, s := range ss.samples[metricName] {
+			if len(s.labels) == 0 {
+				continue
+			}
+			labels := make(map[string]string, len(shared))
+			for k := range shared {
+				labels[k] = s.labels[k]
+			}
+			key := labelsKey(labels)
+			if _, ok := series[key]; ok {
+				series[key] = nil
+				continue
+			}
+			s := s
+			series[key] = &s
+			labelSets[key] = labels
+		}
+		joined[metricName] = series
+	}
+	if len(labelSets) == 0 {
+		labelSets[""] = map[string]string{}
+	}
+	keys := make([]string, 0, len(labelSets))
+	for key := range labelSets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	help := d.Desc
+	if help == "" {
+		help = "derived from " + d.Expr
+	}
+	var metrics []prometheus.Metric
+	for _, key := range keys {
+		value, ok := d.expr.eval(func(metricName string) (float64, bool) {
+			if s, ok := joined[metricName][key]; ok {
+				if s == nil {
+					return 0, false
+				}
+				return s.value, true
+			}
+			series := ss.samples[metricName]
+			if s, ok := series[""]; ok && len(series) == 1 {
+				return s.value, true
+			}
+			return 0, false
+		})
+		if !ok {
+			continue
+		}
+		labels := labelSets[key]
+		labelNames := make([]string, 0, len(labels))
+		for k := range labels {
+			labelNames = append(labelNames, k)
+		}
+		sort.Strings(labelNames)
+		labelValues := make([]string, len(labelNames))
+		for i, k := range labelNames {
+			labelValues[i] = labels[k]
+		}
+		desc := prometheus.NewDesc(name, help, labelNames, ss.constLabels)
+		metrics = append(metrics, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...))
+	}
+	return metrics
+}
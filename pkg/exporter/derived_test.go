@@ -0,0 +1,95 @@
+// Copyright © 2020 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseExpr(t *testing.T) {
+	values := map[string]float64{"a": 6, "b": 2, "c": 1}
+	lookup := func(name string) (float64, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+	tests := []struct {
+		expr    string
+		want    float64
+		ok      bool
+		wantErr bool
+	}{
+		{expr: "a / b", want: 3, ok: true},
+		{expr: "a - b * c + 1", want: 5, ok: true},
+		{expr: "(a - b) * -c", want: -4, ok: true},
+		{expr: "a / (b + c) * 1.5e0", want: 3, ok: true},
+		{expr: "a + missing", ok: false},
+		{expr: "", wantErr: true},
+		{expr: "a +", wantErr: true},
+		{expr: "(a + b", wantErr: true},
+		{expr: "a b", wantErr: true},
+		{expr: "a % b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			node, err := parseExpr(tt.expr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			got, ok := node.eval(lookup)
+			assert.Equal(t, tt.ok, ok)
+			if ok {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDerivedMetric_check(t *testing.T) {
+	assert.NoError(t, (&DerivedMetric{Name: "ratio", Expr: "a / b"}).check("q"))
+	assert.Error(t, (&DerivedMetric{Name: "hit ratio", Expr: "a / b"}).check("q"))
+	assert.Error(t, (&DerivedMetric{Name: "ratio", Expr: "a /"}).check("q"))
+}
+
+func Test_sampleSet_derive(t *testing.T) {
+	constLabels := prometheus.Labels{serverLabelName: "localhost:5432"}
+	gauge := func(name string, labels prometheus.Labels, value float64) prometheus.Metric {
+		var names, values []string
+		for k, v := range labels {
+			names, values = append(names, k), append(values, v)
+		}
+		desc := prometheus.NewDesc(name, name, names, constLabels)
+		return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, values...)
+	}
+	// hit is renamed, referenced by its original name
+	ss := newSampleSet(constLabels, map[string]string{"renamed_hit": "pg_hit", "pg_read": "pg_read"})
+	ss.add(gauge("renamed_hit", prometheus.Labels{"datname": "postgres", "mode": "a"}, 30))
+	ss.add(gauge("renamed_hit", prometheus.Labels{"datname": "omm", "mode": "a"}, 1))
+	ss.add(gauge("renamed_hit", prometheus.Labels{"datname": "omm", "mode": "b"}, 2))
+	ss.add(gauge("pg_read", prometheus.Labels{"datname": "postgres"}, 10))
+	ss.add(gauge("pg_read", prometheus.Labels{"datname": "omm"}, 10))
+	ss.add(gauge("pg_other", prometheus.Labels{"datname": "postgres"}, 10))
+	assert.Len(t, ss.samples, 2)
+
+	d := &DerivedMetric{Name: "ratio", Expr: "pg_hit / (pg_hit + pg_read)"}
+	assert.NoError(t, d.check("pg"))
+	metrics := ss.derive("pg_ratio", d)
+	// joined on datname, omm matches two hit series and is skipped
+	if assert.Len(t, metrics, 1) {
+		var pb dto.Metric
+		assert.NoError(t, metrics[0].Write(&pb))
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		assert.Equal(t, map[string]string{serverLabelName: "localhost:5432", "datname": "postgres"}, labels)
+		assert.Equal(t, 0.75, pb.GetGauge().GetValue())
+	}
+}
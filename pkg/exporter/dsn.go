@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"gitee.com/opengauss/openGauss-connector-go-pq"
 	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -31,8 +32,15 @@ func genDSNString(connStringSettings map[string]string) string {
 	return strings.Join(kvs, " ")
 }
 
+// keywordPasswordRep password value of keyword/value dsn, plain or single quoted
+var keywordPasswordRep = regexp.MustCompile(`(^|\s)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+
 // ShadowDSN will hide password part of dsn
 func ShadowDSN(dsn string) string {
+	if !strings.Contains(dsn, "://") {
+		// keyword/value dsn, keep it as is except password
+		return keywordPasswordRep.ReplaceAllString(dsn, "${1}${2}******")
+	}
 	pDSN, err := url.Parse(dsn)
 	if err != nil {
 		return ""
@@ -45,23 +53,102 @@ func ShadowDSN(dsn string) string {
 }
 
 func parseFingerprint(url string) (string, error) {
+	return parseFingerprintJoin(url, "", false)
+}
+
+// parseFingerprintJoin fingerprint of multi-host dsn, all hosts joined with sep like h1:5432,h2:5433.
+// Empty sep keeps the first host only. With socket, unix socket directory is kept in fingerprint
+func parseFingerprintJoin(url, sep string, socket bool) (string, error) {
 	config, err := pq.ParseConfig(url)
 	if err != nil {
 		return "", err
 	}
+	fingerprint := hostFingerprint(config.Host, config.Port, socket)
+	if sep == "" {
+		return fingerprint, nil
+	}
+	fingerprints := []string{fingerprint}
+	for _, fallback := range config.Fallbacks {
+		// with sslmode prefer, every host has a TLS and a plain fallback
+		if f := hostFingerprint(fallback.Host, fallback.Port, socket); !Contains(fingerprints, f) {
+			fingerprints = append(fingerprints, f)
+		}
+	}
+	return strings.Join(fingerprints, sep), nil
+}
+
+// hostFingerprint host:port of target. Unix socket directory maps to localhost,
+// with socket it is kept like localhost:5432(socket:/tmp), distinct from TCP localhost
+func hostFingerprint(host string, port uint16, socket bool) string {
 	var (
-		fingerprint         string
 		fingerprintHostName string
 		fingerprintPort     string
 	)
-	fingerprintHostName = config.Host
-	fingerprintPort = strconv.Itoa(int(config.Port))
+	fingerprintHostName = host
+	fingerprintPort = strconv.Itoa(int(port))
 	if strings.HasPrefix(fingerprintHostName, "/") {
 		fingerprintHostName = DSNLocalhost
 	}
 	if fingerprintPort == "" {
 		fingerprintPort = DSNDefaultPort
 	}
-	fingerprint = fmt.Sprintf("%s:%s", fingerprintHostName, fingerprintPort)
-	return fingerprint, nil
+	if socket && strings.HasPrefix(host, "/") {
+		return fmt.Sprintf("%s:%s(socket:%s)", fingerprintHostName, fingerprintPort, host)
+	}
+	return fmt.Sprintf("%s:%s", fingerprintHostName, fingerprintPort)
+}
+
+// keywordHostRep host or port value of keyword/value dsn, plain or single quoted
+var keywordHostRep = regexp.MustCompile(`(?:^|\s)(host|port)\s*=\s*('(?:[^'\\]|\\.)*'|\S*)`)
+
+// parseDSNTarget first host:port of dsn exactly as written, without resolving or normalizing
+// like fingerprint does: case and unix socket directory are kept. Missing port is the default one
+func parseDSNTarget(dsn string) (string, error) {
+	var host, port string
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		host = strings.Split(u.Host, ",")[0]
+		if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+			host, port = host[:i], host[i+1:]
+		}
+		if host == "" {
+			host = strings.Split(u.Query().Get(DSNHost), ",")[0]
+		}
+		if port == "" {
+			port = strings.Split(u.Query().Get(DSNPort), ",")[0]
+		}
+	} else {
+		for _, m := range keywordHostRep.FindAllStringSubmatch(dsn, -1) {
+			value := strings.Split(strings.Trim(m[2], "'"), ",")[0]
+			if m[1] == DSNHost {
+				host = value
+			} else {
+				port = value
+			}
+		}
+	}
+	if host == "" {
+		host = DSNLocalhost
+	}
+	if port == "" {
+		port = DSNDefaultPort
+	}
+	return fmt.Sprintf("%s:%s", host, port), nil
+}
+
+// parseTargetKey identify the scrape target of dsn, fingerprint with database.
+// Same host:port with different dbname are different targets
+func parseTargetKey(dsn, sep string, socket bool) (string, error) {
+	fingerprint, err := parseFingerprintJoin(dsn, sep, socket)
+	if err != nil {
+		return "", err
+	}
+	dsnSetting, err := pq.ParseURLToMap(dsn)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", fingerprint, dsnSetting[DSNDatabase]), nil
 }
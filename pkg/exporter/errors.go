@@ -2,6 +2,26 @@
 
 package exporter
 
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	pq "gitee.com/opengauss/openGauss-connector-go-pq"
+)
+
+var (
+	// ErrTimeout query did not finish in its timeout, or was canceled
+	ErrTimeout = errors.New("timeout")
+	// ErrConnection target can not be connected, or connection broke during query
+	ErrConnection = errors.New("connection error")
+	// ErrSQL database failed the query, e.g. syntax error or missing relation
+	ErrSQL = errors.New("sql error")
+)
+
 type ErrorConnectToServer struct {
 	Msg string
 }
@@ -10,3 +30,56 @@ type ErrorConnectToServer struct {
 func (e *ErrorConnectToServer) Error() string {
 	return e.Msg
 }
+
+// Is ErrorConnectToServer matches ErrConnection
+func (e *ErrorConnectToServer) Is(target error) bool {
+	return target == ErrConnection
+}
+
+// QueryError failure of query, matches its Kind (ErrTimeout, ErrConnection or ErrSQL)
+// and the driver error with errors.Is / errors.As
+type QueryError struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+func newQueryError(kind, err error, format string, a ...interface{}) *QueryError {
+	return &QueryError{Kind: kind, Msg: fmt.Sprintf(format, a...), Err: err}
+}
+
+// Error returns error
+func (e *QueryError) Error() string {
+	return e.Msg
+}
+
+// Unwrap returns driver error
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Is QueryError matches its Kind
+func (e *QueryError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// queryErrorKind classify driver error as ErrTimeout, ErrConnection or ErrSQL
+func queryErrorKind(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ErrTimeout
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return ErrConnection
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		code := string(pqErr.Code)
+		switch {
+		case code == "57014": // query_canceled, statement timeout or cancel request
+			return ErrTimeout
+		case strings.HasPrefix(code, "08") || strings.HasPrefix(code, "57P"): // connection exception, operator intervention
+			return ErrConnection
+		}
+	}
+	return ErrSQL
+}
@@ -3,7 +3,15 @@
 package exporter
 
 import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
 	"testing"
+
+	pq "gitee.com/opengauss/openGauss-connector-go-pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestErrorConnectToServer_Error(t *testing.T) {
@@ -32,3 +40,62 @@ func TestErrorConnectToServer_Error(t *testing.T) {
 		})
 	}
 }
+
+func TestErrorConnectToServer_Is(t *testing.T) {
+	err := fmt.Errorf("scrape: %w", &ErrorConnectToServer{Msg: "not connect database"})
+	assert.True(t, errors.Is(err, ErrConnection))
+	assert.False(t, errors.Is(err, ErrSQL))
+	assert.True(t, errors.Is((&Server{}).CheckConn(), ErrConnection))
+}
+
+func Test_queryErrorKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: ErrTimeout},
+		{name: "canceled", err: &pq.Error{Code: "57014", Message: "canceling statement due to user request"}, want: ErrTimeout},
+		{name: "badConn", err: driver.ErrBadConn, want: ErrConnection},
+		{name: "adminShutdown", err: &pq.Error{Code: "57P01"}, want: ErrConnection},
+		{name: "connectionFailure", err: &pq.Error{Code: "08006"}, want: ErrConnection},
+		{name: "undefinedTable", err: &pq.Error{Code: "42P01"}, want: ErrSQL},
+		{name: "other", err: errors.New("boom"), want: ErrSQL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, queryErrorKind(tt.err))
+		})
+	}
+}
+
+func TestServer_doCollectMetric_typedErrors(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name:    "pg_lock",
+		Queries: []*Query{{SQL: `SELECT count FROM pg_locks`}},
+		Metrics: []*Column{{Name: "count", Usage: GAUGE}},
+	}
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+
+	mock.ExpectQuery("SELECT count").WillReturnError(context.DeadlineExceeded)
+	_, _, err := s.doCollectMetric(q, conn)
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.False(t, errors.Is(err, ErrSQL))
+	assert.Contains(t, err.Error(), "query err timeout")
+
+	mock.ExpectQuery("SELECT count").WillReturnError(&pq.Error{Code: "42P01", Message: `relation "pg_locks" does not exist`})
+	_, _, err = s.doCollectMetric(q, conn)
+	assert.True(t, errors.Is(err, ErrSQL))
+	var queryErr *QueryError
+	var pqErr *pq.Error
+	if assert.True(t, errors.As(err, &queryErr)) {
+		assert.Equal(t, ErrSQL, queryErr.Kind)
+	}
+	if assert.True(t, errors.As(err, &pqErr)) {
+		assert.Equal(t, "42P01", string(pqErr.Code))
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -3,7 +3,14 @@
 package exporter
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+	"opengauss_exporter/pkg/version"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -13,13 +20,56 @@ type Exporter struct {
 	disableCache           bool // always execute query when been scrapped
 	failFast               bool // fail fast instead fof waiting during start-up ?
 	disableSettingsMetrics bool
+	textSettingsAsInfo     bool
+	checksumSettings       []string
+	scrapeJitter           time.Duration
+	fingerprintJoin        string
+	socketFingerprint      bool
 	timeToString           bool
+	compatibilityLabel     bool
+	nodeLabel              bool
+	roleQuery              string
+	upQuery                string
+	maxLabelLength         int
+	maxRows                int
+	statementTimeout       bool
+	reconnectSQLStates     []string
+	errorLogInterval       time.Duration
+	sessionSetup           []string
 	parallel               int
 	namespace              string
+	strictNamespace        bool
+	databaseSizePretty     bool
+	statStatementsTopN     int
+	latencyLabel           bool
+	exposeQuerySQL         bool
+	userLabel              bool
+	dedupMetrics           bool
+	systemLabels           bool
+	tlsCertExpiry          bool
+	staleFactor            float64
+	targetError            bool
+	keepAlive              time.Duration
+	planDiagnostics        bool
+	strictColumns          bool
+	targetLabelFromDSN     bool
+	breakerThreshold       int
+	breakerCooldown        time.Duration
+	scrapeMemoryBudget     int64
+	maxConcurrent          int               // max Servers scraped at once, 0 means unlimited
+	replicaDSNs            map[string]string // primary fingerprint -> dsn of its standby replica
+	clusterName            string            // cluster label of targets not in clusterNames, empty for none
+	clusterNames           map[string]string // target fingerprint -> cluster label
+	readOnlySQL            bool
+	readOnlySession        bool
+	deltaOnly              bool
+	metricRenamer          func(string) string
+	dialer                 DialFunc
 	configPath             string // config file path /directory
 	dsn                    []string
 	tags                   []string
 	servers                []*Servers
+	globalGroups           [][]*Servers // Servers of the same instance, one elected per scrape runs clusterGlobal queries
 	collStatus             map[string]bool
 	constantLabels         prometheus.Labels // 用户定义标签
 
@@ -28,10 +78,16 @@ type Exporter struct {
 
 	lock sync.RWMutex // export lock
 
+	collectors    []prometheus.Collector // custom collectors mixed into exporter metrics
+	collectorsMtx sync.Mutex             // guard collectors, independent of export lock
+
 	scrapeBegin time.Time // server level scrape begin
 	scrapeDone  time.Time // server last scrape done
 	exportInit  time.Time // server init timestamp
 
+	scrapeCtx    context.Context    // done once exporter is closed, scrapes stop waiting on jitter
+	scrapeCancel context.CancelFunc // cancel scrapeCtx
+
 	configFileError  *prometheus.GaugeVec // 读取配置文件失败采集
 	exporterUp       prometheus.Gauge     // exporter level: always set ot 1
 	exporterUptime   prometheus.Gauge     // exporter level: primary target server uptime (exporter itself)
@@ -43,9 +99,14 @@ type Exporter struct {
 
 // NewExporter New Exporter
 func NewExporter(opts ...Opt) (e *Exporter, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	e = &Exporter{
-		parallel:   1,
-		exportInit: time.Now(),
+		parallel:           1,
+		maxLabelLength:     defaultMaxLabelLength,
+		reconnectSQLStates: defaultReconnectSQLStates,
+		exportInit:         time.Now(),
+		scrapeCtx:          ctx,
+		scrapeCancel:       cancel,
 		metricMap: metricMap{
 			allMetricMap: defaultMonList, // default metric
 			priMetricMap: map[string]*QueryInstance{},
@@ -54,14 +115,23 @@ func NewExporter(opts ...Opt) (e *Exporter, err error) {
 	for _, opt := range opts {
 		opt(e)
 	}
+	if err := e.checkNamespace(); err != nil {
+		return nil, err
+	}
 
 	e.initDefaultMetric()
 
 	if err := e.loadConfig(); err != nil {
 		return nil, err
 	}
+	if err := e.checkReadOnlySQL(); err != nil {
+		return nil, err
+	}
 	e.setupInternalMetrics()
-	e.setupServers()
+	if err := e.setupServers(); err != nil {
+		e.Close()
+		return nil, err
+	}
 
 	if e.parallel == 0 {
 		e.parallel = 1
@@ -69,13 +139,59 @@ func NewExporter(opts ...Opt) (e *Exporter, err error) {
 	return e, nil
 }
 
+// checkNamespace replace characters not allowed in metric name, or reject it with strictNamespace
+func (e *Exporter) checkNamespace() error {
+	if e.namespace == "" {
+		return nil
+	}
+	namespace := sanitizeName(e.namespace)
+	if namespace == e.namespace {
+		return nil
+	}
+	if e.strictNamespace {
+		return fmt.Errorf("namespace %q is not a valid prometheus metric name prefix", e.namespace)
+	}
+	log.Warnf("namespace %q is not a valid prometheus metric name prefix, renamed to %s", e.namespace, namespace)
+	e.namespace = namespace
+	return nil
+}
+
 // initDefaultMetric init default metric
 func (e *Exporter) initDefaultMetric() {
+	if e.databaseSizePretty {
+		e.replaceDefaultMetric(pgDatabasePretty)
+	}
+	if e.statStatementsTopN > 0 {
+		e.replaceDefaultMetric(newPgStatStatements(e.statStatementsTopN))
+	}
 	for _, q := range e.allMetricMap {
 		_ = q.Check()
 	}
 }
 
+// checkReadOnlySQL reject queries with write or DDL statement if read only sql required
+func (e *Exporter) checkReadOnlySQL() error {
+	if !e.readOnlySQL {
+		return nil
+	}
+	for _, q := range e.allMetricMap {
+		if err := q.checkReadOnly(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceDefaultMetric replace default query instance of same name, defaultMonList itself is kept as is
+func (e *Exporter) replaceDefaultMetric(q *QueryInstance) {
+	metrics := make(map[string]*QueryInstance, len(e.allMetricMap))
+	for name, query := range e.allMetricMap {
+		metrics[name] = query
+	}
+	metrics[q.Name] = q
+	e.allMetricMap = metrics
+}
+
 // loadConfig Load the configuration file, the same indicator in the configuration file overwrites the default configuration
 // 加载配置文件,配置文件里相同指标覆盖默认配置
 func (e *Exporter) loadConfig() error {
@@ -99,7 +215,7 @@ func (e *Exporter) loadConfig() error {
 			e.allMetricMap[name] = query
 		}
 		// 如果是通用指标不判断私有
-		if query.Public {
+		if query.Public || query.ClusterGlobal {
 			continue
 		}
 		for defName, defQuery := range e.priMetricMap {
@@ -116,24 +232,104 @@ func (e *Exporter) loadConfig() error {
 	return nil
 }
 
-func (e *Exporter) setupServers() {
+// serversOpts options of every Servers
+func (e *Exporter) serversOpts() []ServersOpt {
+	return []ServersOpt{
+		ServersWithScrapeJitter(e.scrapeJitter),
+		ServersWithCircuitBreaker(e.breakerThreshold, e.breakerCooldown),
+		ServersWithFingerprintJoin(e.fingerprintJoin),
+		ServersWithSocketFingerprint(e.socketFingerprint),
+	}
+}
+
+// setupServers create servers of every dsn. With failFast, connect them and return error if any target is down
+func (e *Exporter) setupServers() error {
+	if e.deltaOnly {
+		log.Warn("experimental delta only mode, unchanged query metrics are left out of scrapes and prometheus marks them stale")
+	}
+	sessionSetup := e.sessionSetup
+	if e.readOnlySession {
+		sessionSetup = append([]string{readOnlySessionSQL}, e.sessionSetup...)
+	}
+	opts := []ServerOpt{
+		ServerWithLabels(e.constantLabels),
+		ServerWithNamespace(e.namespace),
+		ServerWithDisableSettingsMetrics(e.disableSettingsMetrics),
+		ServerWithTextSettingsAsInfo(e.textSettingsAsInfo),
+		ServerWithConfigChecksum(e.checksumSettings),
+		ServerWithDisableCache(e.disableCache),
+		ServerWithTimeToString(e.timeToString),
+		ServerWithParallel(e.parallel),
+		ServerWithCompatibilityLabel(e.compatibilityLabel),
+		ServerWithNodeLabel(e.nodeLabel),
+		ServerWithRoleQuery(e.roleQuery),
+		ServerWithFingerprintJoin(e.fingerprintJoin),
+		ServerWithSocketFingerprint(e.socketFingerprint),
+		ServerWithUpQuery(e.upQuery),
+		ServerWithMaxLabelLength(e.maxLabelLength),
+		ServerWithMaxRows(e.maxRows),
+		ServerWithStatementTimeout(e.statementTimeout),
+		ServerWithReconnectSQLStates(e.reconnectSQLStates),
+		ServerWithErrorLogInterval(e.errorLogInterval),
+		ServerWithLatencyLabel(e.latencyLabel),
+		ServerWithExposeQuerySQL(e.exposeQuerySQL),
+		ServerWithUserLabel(e.userLabel),
+		ServerWithDedupMetrics(e.dedupMetrics),
+		ServerWithSystemLabels(e.systemLabels),
+		ServerWithTLSCertExpiry(e.tlsCertExpiry),
+		ServerWithStaleFactor(e.staleFactor),
+		ServerWithTargetError(e.targetError),
+		ServerWithKeepAlive(e.keepAlive),
+		ServerWithQueryPlanDiagnostics(e.planDiagnostics),
+		ServerWithDeltaOnly(e.deltaOnly),
+		ServerWithStrictColumns(e.strictColumns),
+		ServerWithTargetLabelFromDSN(e.targetLabelFromDSN),
+		ServerWithScrapeMemoryBudget(e.scrapeMemoryBudget),
+		ServerWithMetricRenamer(e.metricRenamer),
+		ServerWithDialer(e.dialer),
+		ServerWithSessionSetup(sessionSetup),
+	}
+	targets, clusters := map[string]string{}, map[string]int{}
+	e.globalGroups = nil
 	for i := range e.dsn {
 		dsn := e.dsn[i]
-		s, err := NewServers(dsn,
-			e.autoDiscoverOption,
-			e.metricMap,
-			ServerWithLabels(e.constantLabels),
-			ServerWithNamespace(e.namespace),
-			ServerWithDisableSettingsMetrics(e.disableSettingsMetrics),
-			ServerWithDisableCache(e.disableCache),
-			ServerWithTimeToString(e.timeToString),
-			ServerWithParallel(e.parallel),
-		)
+		if key, err := parseTargetKey(dsn, e.fingerprintJoin, e.socketFingerprint); err == nil {
+			if first, ok := targets[key]; ok {
+				log.Warnf("Duplicate DSN (%s) dropped, same target %s as (%s)", ShadowDSN(dsn), key, ShadowDSN(first))
+				continue
+			}
+			targets[key] = dsn
+		}
+		serverOpts := opts
+		if e.clusterName != "" || len(e.clusterNames) > 0 {
+			// every target carries cluster label once configured, empty for unmapped ones without default
+			serverOpts = append(opts[:len(opts):len(opts)], ServerWithLabels(prometheus.Labels{clusterLabelName: e.clusterOf(dsn)}))
+		}
+		s, err := NewServers(dsn, e.autoDiscoverOption, e.metricMap, e.serversOpts(), serverOpts...)
 		if err != nil {
+			if e.failFast {
+				return err
+			}
 			continue
 		}
+		s.replica = e.newReplicaServers(dsn, serverOpts)
+		// group dsn of the same instance, first configured one runs clusterGlobal queries until elected otherwise
+		fingerprint, err := parseFingerprintJoin(dsn, e.fingerprintJoin, e.socketFingerprint)
+		if i, ok := clusters[fingerprint]; ok && err == nil {
+			e.globalGroups[i] = append(e.globalGroups[i], s)
+		} else {
+			s.globalOwner = true
+			clusters[fingerprint] = len(e.globalGroups)
+			e.globalGroups = append(e.globalGroups, []*Servers{s})
+		}
 		e.servers = append(e.servers, s)
+		if e.failFast {
+			if err = s.connect(); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
 
 // Describe implement prometheus.Collector
@@ -166,6 +362,25 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	e.scrape(ch)
 	e.collectServerMetrics()
 	e.collectInternalMetrics(ch)
+	e.collectCollectors(ch)
+}
+
+// RegisterCollector mix custom collector into exporter, collected after sql metrics
+func (e *Exporter) RegisterCollector(c prometheus.Collector) {
+	e.collectorsMtx.Lock()
+	defer e.collectorsMtx.Unlock()
+	e.collectors = append(e.collectors, c)
+}
+
+// collectCollectors run custom collectors without holding any exporter lock,
+// so that they may call back into exporter
+func (e *Exporter) collectCollectors(ch chan<- prometheus.Metric) {
+	e.collectorsMtx.Lock()
+	collectors := append([]prometheus.Collector{}, e.collectors...)
+	e.collectorsMtx.Unlock()
+	for _, c := range collectors {
+		c.Collect(ch)
+	}
 }
 
 func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
@@ -173,16 +388,15 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
 	defer e.lock.Unlock()
 	// 设置采集开始时间
 	e.scrapeBegin = time.Now()
-	wg := sync.WaitGroup{}
 	// 根据dsn并发采集.
-	for i := range e.servers {
-		wg.Add(1)
-		go func(servers *Servers) {
-			defer wg.Done()
-			servers.ScrapeDSN(ch)
-		}(e.servers[i])
+	ctx := e.scrapeCtx
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	wg.Wait()
+	e.electGlobalOwners()
+	e.forEachServers(func(servers *Servers) {
+		servers.ScrapeDSN(ctx, ch)
+	})
 	// 设置结束开始时间
 	e.scrapeDone = time.Now()
 	// 最后采集时间
@@ -195,6 +409,88 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
 	e.exporterUp.Set(1)
 }
 
+// electGlobalOwners pick the dsn running clusterGlobal queries of each instance in this scrape: the first up
+// primary, else the first up one, else the first configured. Up state is the one left by last scrape
+func (e *Exporter) electGlobalOwners() {
+	for _, group := range e.globalGroups {
+		var owner *Servers
+		for _, s := range group {
+			up, primary := s.upState()
+			if up && primary {
+				owner = s
+				break
+			}
+			if up && owner == nil {
+				owner = s
+			}
+		}
+		if owner == nil {
+			owner = group[0]
+		}
+		for _, s := range group {
+			s.globalOwner = s == owner
+		}
+	}
+}
+
+// clusterOf cluster label of dsn, mapped by fingerprint or the default one
+func (e *Exporter) clusterOf(dsn string) string {
+	if fingerprint, err := parseFingerprintJoin(dsn, e.fingerprintJoin, e.socketFingerprint); err == nil {
+		if cluster, ok := e.clusterNames[fingerprint]; ok {
+			return cluster
+		}
+	}
+	return e.clusterName
+}
+
+// newReplicaServers servers of standby replica configured for dsn, nil if not configured.
+// Replica only runs PreferReplica queries of its primary, it is not a scrape target itself
+func (e *Exporter) newReplicaServers(dsn string, opts []ServerOpt) *Servers {
+	if len(e.replicaDSNs) == 0 {
+		return nil
+	}
+	fingerprint, err := parseFingerprintJoin(dsn, e.fingerprintJoin, e.socketFingerprint)
+	if err != nil {
+		return nil
+	}
+	replicaDSN, ok := e.replicaDSNs[fingerprint]
+	if !ok {
+		return nil
+	}
+	replica, err := NewServers(replicaDSN, autoDiscoverOption{}, metricMap{}, []ServersOpt{
+		ServersWithFingerprintJoin(e.fingerprintJoin),
+		ServersWithSocketFingerprint(e.socketFingerprint),
+	}, opts...)
+	if err != nil {
+		log.Errorf("replica of %s (%s) dropped: %s", fingerprint, ShadowDSN(replicaDSN), err)
+		return nil
+	}
+	return replica
+}
+
+// forEachServers run fn on every Servers concurrently, at most maxConcurrent at once if set
+func (e *Exporter) forEachServers(fn func(servers *Servers)) {
+	var limit *rateLimit
+	if e.maxConcurrent > 0 {
+		limit = newRateLimit(e.maxConcurrent)
+	}
+	wg := sync.WaitGroup{}
+	for i := range e.servers {
+		if limit != nil {
+			limit.getToken()
+		}
+		wg.Add(1)
+		go func(servers *Servers) {
+			defer wg.Done()
+			if limit != nil {
+				defer limit.putToken()
+			}
+			fn(servers)
+		}(e.servers[i])
+	}
+	wg.Wait()
+}
+
 func (e *Exporter) collectServerMetrics() {
 	for _, server := range e.servers {
 		for _, s := range server.servers {
@@ -211,9 +507,185 @@ func (e *Exporter) collectInternalMetrics(ch chan<- prometheus.Metric) {
 	ch <- e.scrapeTotalCount
 	ch <- e.scrapeErrorCount
 	ch <- e.scrapeDuration
+	ch <- e.buildInfoMetric()
+	e.collectTargetInfo(ch)
+	e.collectServersUp(ch)
+}
+
+// fqName full name of exporter internal metric, rewritten by metricRenamer
+func (e *Exporter) fqName(subsystem, name string) string {
+	return renameMetric(e.metricRenamer, prometheus.BuildFQName(e.namespace, subsystem, name))
+}
+
+// buildInfoMetric version of exporter, set by ldflags on build, always be 1
+func (e *Exporter) buildInfoMetric() prometheus.Metric {
+	desc := prometheus.NewDesc(e.fqName("exporter", "build_info"),
+		"build information of exporter, always be 1", []string{"version", "revision", "goversion"}, e.constantLabels)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1,
+		version.GetVersion(), version.GetGitCommit(), runtime.Version())
+}
+
+// collectTargetInfo emit one series per configured target and discovered database, never expose dsn
+func (e *Exporter) collectTargetInfo(ch chan<- prometheus.Metric) {
+	desc := prometheus.NewDesc(e.fqName("exporter", "target_info"),
+		"configured target of exporter, always be 1", []string{serverLabelName, "datname"}, e.constantLabels)
+	seen := map[[2]string]bool{}
+	for _, servers := range e.servers {
+		for _, target := range servers.targets() {
+			if seen[target] {
+				continue
+			}
+			seen[target] = true
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, target[0], target[1])
+		}
+	}
+}
+
+// collectServersUp count configured and discovered servers and how many of them are up,
+// tell a few databases down from a total outage
+func (e *Exporter) collectServersUp(ch chan<- prometheus.Metric) {
+	var up, total int
+	for _, servers := range e.servers {
+		u, t := servers.upCount()
+		up, total = up+u, total+t
+	}
+	ch <- prometheus.MustNewConstMetric(prometheus.NewDesc(e.fqName("exporter", "servers_up"),
+		"number of configured and discovered servers which are up", nil, e.constantLabels), prometheus.GaugeValue, float64(up))
+	ch <- prometheus.MustNewConstMetric(prometheus.NewDesc(e.fqName("exporter", "servers_total"),
+		"number of configured and discovered servers", nil, e.constantLabels), prometheus.GaugeValue, float64(total))
+}
+
+// UpdateCredentials set new password of target with fingerprint (host:port), reconnect on next scrape
+func (e *Exporter) UpdateCredentials(fingerprint, password string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var found bool
+	for _, servers := range e.servers {
+		if f, err := parseFingerprintJoin(servers.dsn, e.fingerprintJoin, e.socketFingerprint); err != nil || f != fingerprint {
+			continue
+		}
+		found = true
+		if err := servers.updateCredentials(password); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("target %s not found", fingerprint)
+	}
+	return nil
+}
+
+// CheckAll connect every configured target and read its base info without scraping, usable as readiness gate.
+// The error lists all failed targets, targets not checked before ctx is done fail with ctx error
+func (e *Exporter) CheckAll(ctx context.Context) error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	type result struct {
+		idx int
+		err error
+	}
+	results := make(chan result, len(e.servers))
+	for i, servers := range e.servers {
+		go func(i int, servers *Servers) {
+			results <- result{idx: i, err: servers.check()}
+		}(i, servers)
+	}
+	errs := make([]error, len(e.servers))
+	checked := make([]bool, len(e.servers))
+	for range e.servers {
+		select {
+		case r := <-results:
+			errs[r.idx], checked[r.idx] = r.err, true
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	var failed []string
+	for i, servers := range e.servers {
+		err := errs[i]
+		if !checked[i] {
+			err = ctx.Err()
+		}
+		if err == nil {
+			continue
+		}
+		target, parseErr := parseFingerprintJoin(servers.dsn, e.fingerprintJoin, e.socketFingerprint)
+		if parseErr != nil {
+			target = ShadowDSN(servers.dsn)
+		}
+		failed = append(failed, fmt.Sprintf("%s: %s", target, err))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d targets failed: %s", len(failed), len(e.servers), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// FlushCache drop cached metrics of all servers, next scrape query database again
+func (e *Exporter) FlushCache() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, servers := range e.servers {
+		servers.flushCache()
+	}
+}
+
+// SetCacheDisabled toggle cache of all servers at runtime
+func (e *Exporter) SetCacheDisabled(b bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.disableCache = b
+	for _, servers := range e.servers {
+		servers.setCacheDisabled(b)
+	}
+}
+
+// CacheSnapshot returns metric cache snapshot of all servers, keyed by fingerprint/database
+func (e *Exporter) CacheSnapshot() map[string]map[string]CacheEntryInfo {
+	snapshot := map[string]map[string]CacheEntryInfo{}
+	for _, servers := range e.servers {
+		for target, entries := range servers.cacheSnapshot() {
+			snapshot[target] = entries
+		}
+	}
+	return snapshot
+}
+
+// onceCollector wraps Exporter as an unchecked collector, so that registering it
+// into a registry does not trigger an extra scrape through Describe
+type onceCollector struct {
+	e *Exporter
+}
+
+func (c onceCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c onceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.e.Collect(ch)
+}
+
+// CollectOnceToText scrape every target exactly once and render the result in prometheus text format.
+// Metrics gathered before an error are still rendered, the error is returned alongside.
+func (e *Exporter) CollectOnceToText() (string, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(onceCollector{e: e}); err != nil {
+		return "", err
+	}
+	mfs, gatherErr := registry.Gather()
+	buf := new(bytes.Buffer)
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(buf, mf); err != nil {
+			return buf.String(), err
+		}
+	}
+	return buf.String(), gatherErr
 }
 
 func (e *Exporter) Close() {
+	if e.scrapeCancel != nil {
+		e.scrapeCancel()
+	}
 	for _, s := range e.servers {
 		s.Close()
 	}
@@ -4,6 +4,7 @@ package exporter
 
 import (
 	"strings"
+	"time"
 )
 
 // Opt ExporterOpt configures Exporter
@@ -44,6 +45,13 @@ func WithDisableSettingsMetrics(b bool) Opt {
 	}
 }
 
+// WithTextSettingsAsInfo emit textual pg_settings as info metric with value in setting label
+func WithTextSettingsAsInfo(b bool) Opt {
+	return func(e *Exporter) {
+		e.textSettingsAsInfo = b
+	}
+}
+
 // WithFailFast marks exporter fail instead of waiting during start-up
 func WithFailFast(failFast bool) Opt {
 	return func(e *Exporter) {
@@ -77,6 +85,297 @@ func WithParallel(i int) Opt {
 	}
 }
 
+// WithCompatibilityLabel add database datcompatibility(A/B/C/PG) as label to all server metrics
+func WithCompatibilityLabel(b bool) Opt {
+	return func(e *Exporter) {
+		e.compatibilityLabel = b
+	}
+}
+
+// WithRoleQuery override pg_is_in_recovery() to determine primary/standby role
+func WithRoleQuery(sql string) Opt {
+	return func(e *Exporter) {
+		e.roleQuery = sql
+	}
+}
+
+// WithMaxLabelLength truncate label value longer than n, 0 means unlimited
+func WithMaxLabelLength(n int) Opt {
+	return func(e *Exporter) {
+		e.maxLabelLength = n
+	}
+}
+
+// WithSessionSetup sql statements run on connection before query metrics
+func WithSessionSetup(sqls []string) Opt {
+	return func(e *Exporter) {
+		e.sessionSetup = sqls
+	}
+}
+
+// WithScrapeJitter delay each dsn scrape with a random duration up to maxDelay
+func WithScrapeJitter(maxDelay time.Duration) Opt {
+	return func(e *Exporter) {
+		e.scrapeJitter = maxDelay
+	}
+}
+
+// WithNodeLabel add local node_name/node_type as label on distributed deployment, enable pgxc_node metrics
+func WithNodeLabel(b bool) Opt {
+	return func(e *Exporter) {
+		e.nodeLabel = b
+	}
+}
+
+// WithMaxRows default row limit of every query, rows beyond it are dropped with a non-fatal error. 0 means unlimited
+func WithMaxRows(n int) Opt {
+	return func(e *Exporter) {
+		e.maxRows = n
+	}
+}
+
+// WithStatementTimeout set statement_timeout of query transaction to query timeout, database aborts runaway query itself
+func WithStatementTimeout(b bool) Opt {
+	return func(e *Exporter) {
+		e.statementTimeout = b
+	}
+}
+
+// WithReconnectSQLStates SQLSTATE of query error which close connection and reconnect on next scrape
+func WithReconnectSQLStates(codes []string) Opt {
+	return func(e *Exporter) {
+		e.reconnectSQLStates = codes
+	}
+}
+
+// WithConfigChecksum emit config_checksum of these settings, fleet configuration drift shows as changed checksum
+func WithConfigChecksum(settings []string) Opt {
+	return func(e *Exporter) {
+		e.checksumSettings = nil
+		for _, name := range settings {
+			if name = strings.TrimSpace(name); name != "" {
+				e.checksumSettings = append(e.checksumSettings, name)
+			}
+		}
+	}
+}
+
+// WithErrorLogInterval log errors of same query at most once in interval, 0 log every time
+func WithErrorLogInterval(interval time.Duration) Opt {
+	return func(e *Exporter) {
+		e.errorLogInterval = interval
+	}
+}
+
+// WithStrictNamespace reject invalid namespace instead of sanitize it
+func WithStrictNamespace(b bool) Opt {
+	return func(e *Exporter) {
+		e.strictNamespace = b
+	}
+}
+
+// WithDatabaseSizePretty add pg_database_size_info metric with human-readable size as pretty label
+func WithDatabaseSizePretty(b bool) Opt {
+	return func(e *Exporter) {
+		e.databaseSizePretty = b
+	}
+}
+
+// WithUpQuery sql which must succeed for target to be up, besides ping
+func WithUpQuery(sql string) Opt {
+	return func(e *Exporter) {
+		e.upQuery = sql
+	}
+}
+
+// WithFingerprintJoin join all hosts of multi-host dsn with sep as fingerprint, empty keeps the first host only
+func WithFingerprintJoin(sep string) Opt {
+	return func(e *Exporter) {
+		e.fingerprintJoin = sep
+	}
+}
+
+// WithLatencyLabel add bucketed query latency as scrape_latency_ms label to first metric of each query instance
+func WithLatencyLabel(b bool) Opt {
+	return func(e *Exporter) {
+		e.latencyLabel = b
+	}
+}
+
+// WithMetricRenamer rewrite names of emitted metrics, e.g. map them to schema of community postgres_exporter.
+// Renamed name which is not a valid metric name is ignored
+func WithMetricRenamer(renamer func(name string) string) Opt {
+	return func(e *Exporter) {
+		e.metricRenamer = renamer
+	}
+}
+
+// WithSocketFingerprint keep unix socket directory in fingerprint, so socket and TCP localhost targets differ
+func WithSocketFingerprint(b bool) Opt {
+	return func(e *Exporter) {
+		e.socketFingerprint = b
+	}
+}
+
+// WithStatStatementsTopN collect top n statements by total time from pg_stat_statements, 0 for disable
+func WithStatStatementsTopN(n int) Opt {
+	return func(e *Exporter) {
+		e.statStatementsTopN = n
+	}
+}
+
+// WithExposeQuerySQL emit exporter_query_info with sql of each executed query as label, off by default for its size
+func WithExposeQuerySQL(b bool) Opt {
+	return func(e *Exporter) {
+		e.exposeQuerySQL = b
+	}
+}
+
+// WithMaxConcurrentServers scrape at most n dsn at once, avoid connection storm with many targets. 0 means unlimited
+func WithMaxConcurrentServers(n int) Opt {
+	return func(e *Exporter) {
+		e.maxConcurrent = n
+	}
+}
+
+// WithReplicaDSNs standby replica of targets as "primary host:port=replica dsn", PreferReplica queries run on it
+func WithReplicaDSNs(pairs []string) Opt {
+	return func(e *Exporter) {
+		e.replicaDSNs = parsePairs(pairs, "host:port=dsn")
+	}
+}
+
+// WithDedupMetrics drop repeated metrics with same name and labels in a scrape, keep the last.
+// Rows of one query repeating a label set always keep the last, this also covers rows without label
+// and metrics repeated by different queries, at the cost of holding the whole scrape in memory
+func WithDedupMetrics(b bool) Opt {
+	return func(e *Exporter) {
+		e.dedupMetrics = b
+	}
+}
+
+// WithSystemLabels add data_directory and system_identifier of instance as label
+func WithSystemLabels(b bool) Opt {
+	return func(e *Exporter) {
+		e.systemLabels = b
+	}
+}
+
+// WithTLSCertExpiry emit expiry of certificate the target presented on TLS connection
+func WithTLSCertExpiry(b bool) Opt {
+	return func(e *Exporter) {
+		e.tlsCertExpiry = b
+	}
+}
+
+// WithStaleFactor serve cache on failed refresh until it is factor times ttl old, 0 disables
+func WithStaleFactor(factor float64) Opt {
+	return func(e *Exporter) {
+		e.staleFactor = factor
+	}
+}
+
+// WithTargetError emit target_error with connection error of down targets
+func WithTargetError(b bool) Opt {
+	return func(e *Exporter) {
+		e.targetError = b
+	}
+}
+
+// WithKeepAlive ping every server in interval between scrapes, 0 disables
+func WithKeepAlive(interval time.Duration) Opt {
+	return func(e *Exporter) {
+		e.keepAlive = interval
+	}
+}
+
+// WithQueryPlanDiagnostics emit estimated cost of query plans, queries are explained at most once in 10 minutes
+func WithQueryPlanDiagnostics(b bool) Opt {
+	return func(e *Exporter) {
+		e.planDiagnostics = b
+	}
+}
+
+// WithStrictColumns fail query whose result has duplicate column names, default renames later duplicates to name_2, name_3
+func WithStrictColumns(b bool) Opt {
+	return func(e *Exporter) {
+		e.strictColumns = b
+	}
+}
+
+// WithTargetLabelFromDSN server label is host:port as written in dsn, e.g. original hostname or socket directory
+func WithTargetLabelFromDSN(b bool) Opt {
+	return func(e *Exporter) {
+		e.targetLabelFromDSN = b
+	}
+}
+
+// WithCircuitBreaker skip connecting to target for cooldown after threshold consecutive failures, up is 0 meanwhile.
+// 0 threshold disables it
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Opt {
+	return func(e *Exporter) {
+		e.breakerThreshold, e.breakerCooldown = threshold, cooldown
+	}
+}
+
+// WithClusterName add cluster label to metrics of all targets, unless mapped by WithClusterNames
+func WithClusterName(name string) Opt {
+	return func(e *Exporter) {
+		e.clusterName = name
+	}
+}
+
+// WithClusterNames cluster label of targets as "host:port=cluster name", overrides WithClusterName
+func WithClusterNames(pairs []string) Opt {
+	return func(e *Exporter) {
+		e.clusterNames = parsePairs(pairs, "host:port=name")
+	}
+}
+
+// WithReadOnlySQL reject queries whose sql does not start with SELECT, WITH, SHOW, TABLE or VALUES, or has more
+// than one statement. Functions with side effects and data modifying WITH pass it, use WithReadOnlySession as well
+func WithReadOnlySQL(b bool) Opt {
+	return func(e *Exporter) {
+		e.readOnlySQL = b
+	}
+}
+
+// WithReadOnlySession make transactions of every connection read only before query metrics
+func WithReadOnlySession(b bool) Opt {
+	return func(e *Exporter) {
+		e.readOnlySession = b
+	}
+}
+
+// WithDeltaOnly experimental, emit query metric only when its sample changed since last scrape.
+// Prometheus marks series missing from a scrape stale, only for downstreams keeping the last sample
+func WithDeltaOnly(b bool) Opt {
+	return func(e *Exporter) {
+		e.deltaOnly = b
+	}
+}
+
+// WithUserLabel add user of dsn as db_user label, attribute metrics to monitoring role
+func WithUserLabel(b bool) Opt {
+	return func(e *Exporter) {
+		e.userLabel = b
+	}
+}
+
+// WithScrapeMemoryBudget abort scrape of a server once values scanned exceed about bytes, 0 means unlimited
+func WithScrapeMemoryBudget(bytes int64) Opt {
+	return func(e *Exporter) {
+		e.scrapeMemoryBudget = bytes
+	}
+}
+
+// WithDialer connect all targets through dialer, e.g. ssh tunnel or socks5 proxy of a bastion
+func WithDialer(dialer DialFunc) Opt {
+	return func(e *Exporter) {
+		e.dialer = dialer
+	}
+}
+
 // WithAutoDiscovery configures exporter with excluded database
 func WithAutoDiscovery(flag bool) Opt {
 	return func(e *Exporter) {
@@ -104,10 +403,53 @@ func WithIncludeDatabases(includeStr string) Opt {
 	}
 }
 
+// WithAutoDiscoverSchemas configures exporter to discover schemas bound into perSchema queries
+func WithAutoDiscoverSchemas(flag bool) Opt {
+	return func(e *Exporter) {
+		e.autoDiscoverSchemas = flag
+	}
+}
+
+// WithExcludeSchemas configures exporter with excluded schema
+func WithExcludeSchemas(excludeStr string) Opt {
+	return func(e *Exporter) {
+		if excludeStr == "" {
+			return
+		}
+		e.excludedSchemas = strings.Split(excludeStr, ",")
+	}
+}
+
+// WithIncludeSchemas configures exporter with included schema
+func WithIncludeSchemas(includeStr string) Opt {
+	return func(e *Exporter) {
+		if includeStr == "" {
+			return
+		}
+		e.includeSchemas = strings.Split(includeStr, ",")
+	}
+}
+
+// WithDatabases scrape given databases on every server without querying pg_database
+func WithDatabases(databases []string) Opt {
+	return func(e *Exporter) {
+		e.databases = nil
+		for _, dbName := range databases {
+			if dbName = strings.TrimSpace(dbName); dbName != "" {
+				e.databases = append(e.databases, dbName)
+			}
+		}
+	}
+}
+
 type autoDiscoverOption struct {
-	autoDiscovery     bool     // discovery other database on primary server
-	excludedDatabases []string // excluded database for auto discovery
-	includeDatabases  []string // include database for auto discovery
+	autoDiscovery       bool     // discovery other database on primary server
+	excludedDatabases   []string // excluded database for auto discovery
+	includeDatabases    []string // include database for auto discovery
+	databases           []string // scrape these databases without query pg_database
+	autoDiscoverSchemas bool     // discovery schemas of every database for perSchema queries
+	excludedSchemas     []string // excluded schema for auto discovery
+	includeSchemas      []string // include schema for auto discovery
 }
 
 type metricMap struct {
@@ -3,9 +3,13 @@
 package exporter
 
 import (
+	"context"
+	"errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestExporter_Opt(t *testing.T) {
@@ -31,6 +35,10 @@ func TestExporter_Opt(t *testing.T) {
 		WithDisableSettingsMetrics(false)(exporter)
 		assert.Equal(t, false, exporter.disableSettingsMetrics)
 	})
+	t.Run("WithTextSettingsAsInfo", func(t *testing.T) {
+		WithTextSettingsAsInfo(true)(exporter)
+		assert.Equal(t, true, exporter.textSettingsAsInfo)
+	})
 	t.Run("WithFailFast", func(t *testing.T) {
 		WithFailFast(false)(exporter)
 		assert.Equal(t, false, exporter.failFast)
@@ -52,10 +60,187 @@ func TestExporter_Opt(t *testing.T) {
 		WithParallel(5)(exporter)
 		assert.Equal(t, 5, exporter.parallel)
 	})
+	t.Run("WithCompatibilityLabel", func(t *testing.T) {
+		WithCompatibilityLabel(true)(exporter)
+		assert.Equal(t, true, exporter.compatibilityLabel)
+	})
+	t.Run("WithRoleQuery", func(t *testing.T) {
+		WithRoleQuery("select 'primary'")(exporter)
+		assert.Equal(t, "select 'primary'", exporter.roleQuery)
+	})
+	t.Run("WithMaxLabelLength", func(t *testing.T) {
+		WithMaxLabelLength(100)(exporter)
+		assert.Equal(t, 100, exporter.maxLabelLength)
+	})
+	t.Run("WithSessionSetup", func(t *testing.T) {
+		WithSessionSetup([]string{"SET search_path TO dbe_perf"})(exporter)
+		assert.Equal(t, []string{"SET search_path TO dbe_perf"}, exporter.sessionSetup)
+	})
+	t.Run("WithScrapeJitter", func(t *testing.T) {
+		WithScrapeJitter(time.Second)(exporter)
+		assert.Equal(t, time.Second, exporter.scrapeJitter)
+	})
+	t.Run("WithNodeLabel", func(t *testing.T) {
+		WithNodeLabel(true)(exporter)
+		assert.Equal(t, true, exporter.nodeLabel)
+	})
+	t.Run("WithMaxRows", func(t *testing.T) {
+		WithMaxRows(1000)(exporter)
+		assert.Equal(t, 1000, exporter.maxRows)
+	})
+	t.Run("WithStatementTimeout", func(t *testing.T) {
+		WithStatementTimeout(true)(exporter)
+		assert.Equal(t, true, exporter.statementTimeout)
+	})
+	t.Run("WithReconnectSQLStates", func(t *testing.T) {
+		WithReconnectSQLStates([]string{"57P01"})(exporter)
+		assert.Equal(t, []string{"57P01"}, exporter.reconnectSQLStates)
+	})
+	t.Run("WithErrorLogInterval", func(t *testing.T) {
+		WithErrorLogInterval(time.Minute)(exporter)
+		assert.Equal(t, time.Minute, exporter.errorLogInterval)
+	})
+	t.Run("WithStrictNamespace", func(t *testing.T) {
+		WithStrictNamespace(true)(exporter)
+		assert.Equal(t, true, exporter.strictNamespace)
+	})
+	t.Run("WithDatabaseSizePretty", func(t *testing.T) {
+		WithDatabaseSizePretty(true)(exporter)
+		assert.Equal(t, true, exporter.databaseSizePretty)
+	})
+	t.Run("WithUpQuery", func(t *testing.T) {
+		WithUpQuery("select 1")(exporter)
+		assert.Equal(t, "select 1", exporter.upQuery)
+	})
+	t.Run("WithFingerprintJoin", func(t *testing.T) {
+		WithFingerprintJoin(",")(exporter)
+		assert.Equal(t, ",", exporter.fingerprintJoin)
+	})
+	t.Run("WithLatencyLabel", func(t *testing.T) {
+		WithLatencyLabel(true)(exporter)
+		assert.Equal(t, true, exporter.latencyLabel)
+	})
+	t.Run("WithMetricRenamer", func(t *testing.T) {
+		WithMetricRenamer(func(name string) string { return "og_" + name })(exporter)
+		assert.Equal(t, "og_a1_exporter_up", exporter.fqName("exporter", "up"))
+	})
+	t.Run("WithSocketFingerprint", func(t *testing.T) {
+		WithSocketFingerprint(true)(exporter)
+		assert.Equal(t, true, exporter.socketFingerprint)
+	})
+	t.Run("WithStatStatementsTopN", func(t *testing.T) {
+		WithStatStatementsTopN(10)(exporter)
+		assert.Equal(t, 10, exporter.statStatementsTopN)
+	})
+	t.Run("WithExposeQuerySQL", func(t *testing.T) {
+		WithExposeQuerySQL(true)(exporter)
+		assert.Equal(t, true, exporter.exposeQuerySQL)
+	})
+	t.Run("WithMaxConcurrentServers", func(t *testing.T) {
+		WithMaxConcurrentServers(4)(exporter)
+		assert.Equal(t, 4, exporter.maxConcurrent)
+	})
+	t.Run("WithReplicaDSNs", func(t *testing.T) {
+		WithReplicaDSNs([]string{"10.0.0.1:5432=host=10.0.0.2 port=5432", "malformed"})(exporter)
+		assert.Equal(t, map[string]string{"10.0.0.1:5432": "host=10.0.0.2 port=5432"}, exporter.replicaDSNs)
+	})
+	t.Run("WithDedupMetrics", func(t *testing.T) {
+		WithDedupMetrics(true)(exporter)
+		assert.Equal(t, true, exporter.dedupMetrics)
+	})
+	t.Run("WithSystemLabels", func(t *testing.T) {
+		WithSystemLabels(true)(exporter)
+		assert.Equal(t, true, exporter.systemLabels)
+	})
+	t.Run("WithStaleFactor", func(t *testing.T) {
+		WithStaleFactor(3)(exporter)
+		assert.Equal(t, float64(3), exporter.staleFactor)
+	})
+	t.Run("WithTargetError", func(t *testing.T) {
+		WithTargetError(true)(exporter)
+		assert.Equal(t, true, exporter.targetError)
+	})
+	t.Run("WithKeepAlive", func(t *testing.T) {
+		WithKeepAlive(30 * time.Second)(exporter)
+		assert.Equal(t, 30*time.Second, exporter.keepAlive)
+	})
+	t.Run("WithQueryPlanDiagnostics", func(t *testing.T) {
+		WithQueryPlanDiagnostics(true)(exporter)
+		assert.Equal(t, true, exporter.planDiagnostics)
+	})
+	t.Run("WithStrictColumns", func(t *testing.T) {
+		WithStrictColumns(true)(exporter)
+		assert.Equal(t, true, exporter.strictColumns)
+	})
+	t.Run("WithTargetLabelFromDSN", func(t *testing.T) {
+		WithTargetLabelFromDSN(true)(exporter)
+		assert.Equal(t, true, exporter.targetLabelFromDSN)
+	})
+	t.Run("WithCircuitBreaker", func(t *testing.T) {
+		WithCircuitBreaker(3, time.Minute)(exporter)
+		assert.Equal(t, 3, exporter.breakerThreshold)
+		assert.Equal(t, time.Minute, exporter.breakerCooldown)
+	})
+	t.Run("WithClusterName", func(t *testing.T) {
+		WithClusterName("orders")(exporter)
+		assert.Equal(t, "orders", exporter.clusterName)
+	})
+	t.Run("WithClusterNames", func(t *testing.T) {
+		WithClusterNames([]string{"10.0.0.1:5432=orders", "malformed"})(exporter)
+		assert.Equal(t, map[string]string{"10.0.0.1:5432": "orders"}, exporter.clusterNames)
+	})
+	t.Run("WithReadOnlySQL", func(t *testing.T) {
+		WithReadOnlySQL(true)(exporter)
+		assert.Equal(t, true, exporter.readOnlySQL)
+	})
+	t.Run("WithReadOnlySession", func(t *testing.T) {
+		WithReadOnlySession(true)(exporter)
+		assert.Equal(t, true, exporter.readOnlySession)
+	})
+	t.Run("WithConfigChecksum", func(t *testing.T) {
+		WithConfigChecksum([]string{"shared_buffers", " wal_level", ""})(exporter)
+		assert.Equal(t, []string{"shared_buffers", "wal_level"}, exporter.checksumSettings)
+	})
+	t.Run("WithDeltaOnly", func(t *testing.T) {
+		WithDeltaOnly(true)(exporter)
+		assert.Equal(t, true, exporter.deltaOnly)
+	})
+	t.Run("WithUserLabel", func(t *testing.T) {
+		WithUserLabel(true)(exporter)
+		assert.Equal(t, true, exporter.userLabel)
+	})
+	t.Run("WithScrapeMemoryBudget", func(t *testing.T) {
+		WithScrapeMemoryBudget(1 << 20)(exporter)
+		assert.Equal(t, int64(1<<20), exporter.scrapeMemoryBudget)
+	})
+	t.Run("WithDialer", func(t *testing.T) {
+		WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		})(exporter)
+		assert.NotNil(t, exporter.dialer)
+	})
+	t.Run("WithAutoDiscoverSchemas", func(t *testing.T) {
+		WithAutoDiscoverSchemas(true)(exporter)
+		assert.Equal(t, true, exporter.autoDiscoverSchemas)
+	})
+	t.Run("WithIncludeSchemas", func(t *testing.T) {
+		WithIncludeSchemas("")(exporter)
+		assert.Nil(t, exporter.includeSchemas)
+		WithIncludeSchemas("s1,s2")(exporter)
+		assert.Equal(t, []string{"s1", "s2"}, exporter.includeSchemas)
+	})
+	t.Run("WithExcludeSchemas", func(t *testing.T) {
+		WithExcludeSchemas("s1")(exporter)
+		assert.Equal(t, []string{"s1"}, exporter.excludedSchemas)
+	})
 	t.Run("WithAutoDiscovery", func(t *testing.T) {
 		WithAutoDiscovery(false)(exporter)
 		assert.Equal(t, false, exporter.autoDiscovery)
 	})
+	t.Run("WithDatabases", func(t *testing.T) {
+		WithDatabases([]string{"a1", " a2", ""})(exporter)
+		assert.Equal(t, []string{"a1", "a2"}, exporter.databases)
+	})
 	t.Run("WithExcludeDatabases", func(t *testing.T) {
 		WithExcludeDatabases("a1,a2")(exporter)
 		assert.Equal(t, []string{"a1", "a2"}, exporter.excludedDatabases)
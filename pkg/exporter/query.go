@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"github.com/blang/semver"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
 	"gopkg.in/yaml.v2"
+	"regexp"
+	"sort"
 	"strings"
 	// "html/template"
 	"text/template"
@@ -18,6 +21,9 @@ const (
 	statusEnable   = "enable"
 	statusDisable  = "disable"
 	defaultVersion = ">=0.0.0"
+	// columns of keyValue query, whatever the result names them
+	keyValueName  = "name"
+	keyValueValue = "value"
 )
 
 var queryTemplate, _ = template.New("Query").Parse(`
@@ -49,22 +55,45 @@ func CheckStatus(s string) (string, error) {
 
 // QueryInstance hold the information of how to fetch metric and parse them
 type QueryInstance struct {
-	Name        string             `yaml:"name,omitempty"`    // actual query name, used as metric prefix
-	Desc        string             `yaml:"desc,omitempty"`    // description of this metric query
-	Queries     []*Query           `yaml:"query,omitempty"`   // 采集SQL
-	Metrics     []*Column          `yaml:"metrics,omitempty"` // metric definition list
-	Status      string             `yaml:"status,omitempty"`  // enable/disable status. For the entire collection of indicators 针对整个采集指标
-	EnableCache string             `yaml:"enableCache,omitempty"`
-	TTL         float64            `yaml:"ttl,omitempty"`      // caching ttl in seconds
-	Priority    int                `yaml:"priority,omitempty"` // 权重,暂时不用
-	Timeout     float64            `yaml:"timeout,omitempty"`  // query execution timeout in seconds
-	Path        string             `yaml:"-"`                  // where am I from ?
-	Columns     map[string]*Column `yaml:"-"`                  // column map
-	ColumnNames []string           `yaml:"-"`                  // column names in origin orders
-	LabelNames  []string           `yaml:"-"`                  // column (name) that used as label, sequences matters
-	MetricNames []string           `yaml:"-"`                  // column (name) that used as metric
-	Public      bool               `yaml:"public,omitempty"`   // autoDiscover下公用指标,只采集一次
-	dbNameLabel string
+	Name            string              `yaml:"name,omitempty"`    // actual query name, used as metric prefix
+	Desc            string              `yaml:"desc,omitempty"`    // description of this metric query
+	Queries         []*Query            `yaml:"query,omitempty"`   // 采集SQL
+	Metrics         []*Column           `yaml:"metrics,omitempty"` // metric definition list
+	Status          string              `yaml:"status,omitempty"`  // enable/disable status. For the entire collection of indicators 针对整个采集指标
+	EnableCache     string              `yaml:"enableCache,omitempty"`
+	TTL             float64             `yaml:"ttl,omitempty"`             // caching ttl in seconds
+	Priority        int                 `yaml:"priority,omitempty"`        // 权重,dispatch order, smaller first, 0 (unset) last
+	Timeout         float64             `yaml:"timeout,omitempty"`         // query execution timeout in seconds
+	TotalTimeout    float64             `yaml:"totalTimeout,omitempty"`    // bound of whole collection in seconds, fallbacks and row processing included
+	Path            string              `yaml:"-"`                         // where am I from ?
+	Columns         map[string]*Column  `yaml:"-"`                         // column map
+	ColumnNames     []string            `yaml:"-"`                         // column names in origin orders
+	LabelNames      []string            `yaml:"-"`                         // column (name) that used as label, sequences matters
+	MetricNames     []string            `yaml:"-"`                         // column (name) that used as metric
+	Public          bool                `yaml:"public,omitempty"`          // autoDiscover下公用指标,只采集一次
+	PerDatabase     bool                `yaml:"perDatabase,omitempty"`     // collect on every discovered database, even if public
+	PerSchema       bool                `yaml:"perSchema,omitempty"`       // run once for every discovered schema, bound to {{schema}} of sql
+	ClusterGlobal   bool                `yaml:"clusterGlobal,omitempty"`   // shared catalog, run once per cluster on an up dsn of it, primary preferred
+	Strict          bool                `yaml:"strict,omitempty"`          // reject invalid prometheus column names instead of sanitize them
+	Distributed     bool                `yaml:"distributed,omitempty"`     // only collect on distributed deployment, need node label enabled
+	Requires        []string            `yaml:"requires,omitempty"`        // relations need SELECT privilege, query is disabled if not readable
+	Extension       string              `yaml:"extension,omitempty"`       // extension must be installed, query is disabled otherwise
+	Completions     map[string][]string `yaml:"completions,omitempty"`     // expected values of label, absent combinations are emitted as 0
+	PivotColumns    []string            `yaml:"pivotColumns,omitempty"`    // fold these columns into one metric, column name as label value
+	PivotName       string              `yaml:"pivotName,omitempty"`       // metric name of folded columns
+	PivotLabel      string              `yaml:"pivotLabel,omitempty"`      // label name of folded columns, default state
+	SearchPath      string              `yaml:"searchPath,omitempty"`      // search_path set in transaction before query, e.g. monitor, public
+	TimestampColumn string              `yaml:"timestampColumn,omitempty"` // DISCARD column of time type, used as sample timestamp
+	FamilyColumn    string              `yaml:"familyColumn,omitempty"`    // DISCARD column whose value selects metric family of row
+	KeyValue        bool                `yaml:"keyValue,omitempty"`        // result is (name, value) rows, each row a metric named after name
+	DerivedMetrics  []*DerivedMetric    `yaml:"derivedMetrics,omitempty"`  // gauges computed from metrics collected in the same scrape
+	PreferReplica   bool                `yaml:"preferReplica,omitempty"`   // run on standby replica of target if configured, offload heavy query from primary
+	dbNameLabel     string
+	promLabels      []string // sanitized LabelNames used as prometheus label names
+	pivotLabels     []string // promLabels with PivotLabel, label names of folded metric
+	pivotSet        map[string]bool
+	jsonLabels      []string // JSON_LABELS columns, keys of their value are expanded into labels
+	keyColumns      []string // columns besides labels that tell rows apart, JSON_LABELS and FamilyColumn
 }
 
 type Query struct {
@@ -78,13 +107,24 @@ type Query struct {
 	TTL          float64      `yaml:"ttl,omitempty"`     // caching ttl in seconds
 	Status       string       `yaml:"status,omitempty"`  // enable/disable status. 状态是否开启,针对特定版本.
 	EnableCache  string       `yaml:"enableCache,omitempty"`
-	DbRole       string       `yaml:"dbRole"` // only primary database collector. default false
+	DbRole       string       `yaml:"dbRole"`                // only primary database collector. default false
+	MaxRows      int          `yaml:"maxRows,omitempty"`     // stop scanning after max rows, 0 use server default
+	MinInterval  float64      `yaml:"minInterval,omitempty"` // query database at most once in seconds, last metrics are emitted in between
+	Params       []QueryParam `yaml:"params,omitempty"`      // values bound to $1, $2 ... of sql, e.g. args of set-returning function
 }
 
+// QueryParam scalar value bound to sql placeholder, yaml null is bound as NULL
+type QueryParam = interface{}
+
 // TimeoutDuration Get timeout settings
 func (q *Query) TimeoutDuration() time.Duration {
 	return time.Duration(float64(time.Second) * q.Timeout)
 }
+
+// MinIntervalDuration Get min interval settings
+func (q *Query) MinIntervalDuration() time.Duration {
+	return time.Duration(float64(time.Second) * q.MinInterval)
+}
 func (q *Query) IsPrimary() bool {
 	if q.DbRole == "" {
 		return true
@@ -120,6 +160,11 @@ func (q *QueryInstance) TimeoutDuration() time.Duration {
 	return time.Duration(float64(time.Second) * q.Timeout)
 }
 
+// TotalTimeoutDuration bound of whole collection, 0 for none
+func (q *QueryInstance) TotalTimeoutDuration() time.Duration {
+	return time.Duration(float64(time.Second) * q.TotalTimeout)
+}
+
 func (q *QueryInstance) ToYaml() string {
 	buf, err := yaml.Marshal(q)
 	if err != nil {
@@ -136,6 +181,9 @@ func (q *QueryInstance) Check() error {
 	if q.Timeout < 0 {
 		q.Timeout = 0
 	}
+	if q.TotalTimeout < 0 {
+		q.TotalTimeout = 0
+	}
 	if q.TTL == 0 {
 		q.TTL = 60
 	}
@@ -144,6 +192,18 @@ func (q *QueryInstance) Check() error {
 	} else {
 		q.Status = status
 	}
+	if q.ClusterGlobal && (q.PerDatabase || q.PerSchema) {
+		return fmt.Errorf("query %s clusterGlobal can not be collected per database or schema", q.Name)
+	}
+	if q.KeyValue {
+		if len(q.PivotColumns) > 0 || (q.FamilyColumn != "" && q.FamilyColumn != keyValueName) {
+			return fmt.Errorf("query %s keyValue can not be used with pivot or family columns", q.Name)
+		}
+		if len(q.Metrics) == 0 {
+			q.Metrics = []*Column{{Name: keyValueName, Usage: DISCARD}, {Name: keyValueValue, Usage: GAUGE}}
+		}
+		q.FamilyColumn = keyValueName
+	}
 	// parse query column info
 	columns := make(map[string]*Column, len(q.Metrics))
 	for _, query := range q.Queries {
@@ -158,6 +218,12 @@ func (q *QueryInstance) Check() error {
 			query.Version = defaultVersion
 		}
 		query.versionRange = semver.MustParseRange(query.Version)
+		if err := checkParams(query.Params); err != nil {
+			return fmt.Errorf("query %s params: %s", q.Name, err)
+		}
+		if q.PerSchema && !strings.Contains(query.SQL, schemaPlaceholder) {
+			return fmt.Errorf("perSchema query %s sql has no %s placeholder", q.Name, schemaPlaceholder)
+		}
 		if status, err := CheckStatus(query.Status); err != nil {
 			return err
 		} else {
@@ -169,21 +235,35 @@ func (q *QueryInstance) Check() error {
 		query.Name = q.Name
 	}
 
-	var allColumns, labelColumns, metricColumns []string
+	var allColumns, labelColumns, promLabelColumns, metricColumns, jsonColumns []string
 	for _, column := range q.Metrics {
 		if _, isValid := ColumnUsage[column.Usage]; !isValid {
 			return fmt.Errorf("column %s have unsupported usage: %s", column.Name, column.Desc)
 		}
 		column.Usage = strings.ToUpper(column.Usage)
+		if column.Normalize = strings.ToLower(column.Normalize); column.Normalize != "" && !columnNormalize[column.Normalize] {
+			return fmt.Errorf("query %s column %s normalize %q should be none, lower, upper or trim", q.Name, column.Name, column.Normalize)
+		}
+		column.PrometheusName = sanitizeName(column.Name)
+		if column.PrometheusName != column.Name {
+			if q.Strict {
+				return fmt.Errorf("query %s column %q is not a valid prometheus name", q.Name, column.Name)
+			}
+			log.Warnf("query %s column %q is not a valid prometheus name, renamed to %s", q.Name, column.Name, column.PrometheusName)
+		}
 		switch column.Usage {
 		case LABEL:
 			labelColumns = append(labelColumns, column.Name)
+			promLabelColumns = append(promLabelColumns, column.PrometheusName)
 			if strings.EqualFold(column.Name, "datname") {
 				q.dbNameLabel = column.Name
 			}
 			column.DisCard = true
 		case DISCARD:
 			column.DisCard = true
+		case JSONLabels:
+			column.DisCard = true
+			jsonColumns = append(jsonColumns, column.Name)
 		case GAUGE:
 			metricColumns = append(metricColumns, column.Name)
 		case COUNTER:
@@ -195,48 +275,441 @@ func (q *QueryInstance) Check() error {
 			metricColumns = append(metricColumns, column.Name)
 		case DURATION:
 			metricColumns = append(metricColumns, column.Name)
+		case LSN:
+			metricColumns = append(metricColumns, column.Name)
+		case INFO:
+			if column.InfoLabel != "" && sanitizeName(column.InfoLabel) != column.InfoLabel {
+				return fmt.Errorf("query %s column %s info label %q is not a valid prometheus name", q.Name, column.Name, column.InfoLabel)
+			}
+			metricColumns = append(metricColumns, column.Name)
 		}
 		allColumns = append(allColumns, column.Name)
 		columns[column.Name] = column
 	}
+	// label order decides desc, keep it stable when columns are reordered in config
+	sortLabels(labelColumns, promLabelColumns)
+	if q.SearchPath != "" && !searchPathRep.MatchString(q.SearchPath) {
+		return fmt.Errorf("query %s search path %q is invalid", q.Name, q.SearchPath)
+	}
+	if err := q.checkPivot(columns, promLabelColumns); err != nil {
+		return err
+	}
+	if err := q.checkHistograms(columns); err != nil {
+		return err
+	}
+	if err := q.checkJSONLabels(columns, jsonColumns, promLabelColumns); err != nil {
+		return err
+	}
+	if q.FamilyColumn != "" {
+		if col, ok := columns[q.FamilyColumn]; !ok || col.Usage != DISCARD {
+			return fmt.Errorf("query %s family column %s must be a DISCARD column", q.Name, q.FamilyColumn)
+		}
+		if len(q.PivotColumns) > 0 {
+			return fmt.Errorf("query %s family column can not be used with pivot columns", q.Name)
+		}
+	}
+	if q.KeyValue {
+		if col, ok := columns[keyValueValue]; !ok || len(metricColumns) != 1 || metricColumns[0] != keyValueValue {
+			return fmt.Errorf("query %s keyValue needs %s as the only metric column", q.Name, keyValueValue)
+		} else if col.Usage == HISTOGRAM || col.Usage == INFO {
+			return fmt.Errorf("query %s keyValue column %s must be numeric", q.Name, keyValueValue)
+		}
+	}
+	if q.TimestampColumn != "" {
+		if col, ok := columns[q.TimestampColumn]; !ok || col.Usage != DISCARD {
+			return fmt.Errorf("query %s timestamp column %s must be a DISCARD column of time type", q.Name, q.TimestampColumn)
+		}
+	}
+	for _, derived := range q.DerivedMetrics {
+		if err := derived.check(q.Name); err != nil {
+			return err
+		}
+	}
+	for label := range q.Completions {
+		if col, ok := columns[label]; !ok || col.Usage != LABEL {
+			return fmt.Errorf("query %s completion %s is not a label column", q.Name, label)
+		}
+	}
 	q.Columns, q.ColumnNames, q.LabelNames, q.MetricNames = columns, allColumns, labelColumns, metricColumns
+	q.promLabels = promLabelColumns
+	q.jsonLabels = jsonColumns
+	q.keyColumns = jsonColumns
+	if q.FamilyColumn != "" {
+		q.keyColumns = append(jsonColumns[:len(jsonColumns):len(jsonColumns)], q.FamilyColumn)
+	}
 	return nil
 }
 
+// checkParams only scalar values can be bound, cast in sql for a typed NULL, e.g. $1::oid
+func checkParams(params []QueryParam) error {
+	for i, param := range params {
+		switch param.(type) {
+		case nil, string, bool, int, int64, float64:
+		default:
+			return fmt.Errorf("param $%d %v of type %T is not a scalar", i+1, param, param)
+		}
+	}
+	return nil
+}
+
+// sortLabels sort label columns by prometheus label name, names and prometheus names stay paired
+func sortLabels(names, promNames []string) {
+	sort.Sort(labelSorter{names, promNames})
+}
+
+type labelSorter struct {
+	names, promNames []string
+}
+
+func (l labelSorter) Len() int           { return len(l.promNames) }
+func (l labelSorter) Less(i, j int) bool { return l.promNames[i] < l.promNames[j] }
+func (l labelSorter) Swap(i, j int) {
+	l.names[i], l.names[j] = l.names[j], l.names[i]
+	l.promNames[i], l.promNames[j] = l.promNames[j], l.promNames[i]
+}
+
+// checkHistograms counts and sum of HISTOGRAM column must be DISCARD columns
+func (q *QueryInstance) checkHistograms(columns map[string]*Column) error {
+	for _, column := range q.Metrics {
+		if column.Usage != HISTOGRAM {
+			continue
+		}
+		if column.Counts == "" && column.Sum != "" {
+			return fmt.Errorf("query %s histogram column %s has sum but no counts", q.Name, column.Name)
+		}
+		for _, name := range []string{column.Counts, column.Sum} {
+			if name == "" {
+				continue
+			}
+			if col, ok := columns[name]; !ok || col.Usage != DISCARD {
+				return fmt.Errorf("query %s histogram column %s: %s must be a DISCARD column", q.Name, column.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkJSONLabels validate JSON_LABELS columns declare keys, whose label names are valid and unique
+func (q *QueryInstance) checkJSONLabels(columns map[string]*Column, jsonColumns, promLabels []string) error {
+	taken := make(map[string]bool, len(promLabels)+1)
+	for _, label := range promLabels {
+		taken[label] = true
+	}
+	if len(q.pivotSet) > 0 {
+		taken[q.PivotLabel] = true
+	}
+	for _, name := range jsonColumns {
+		col := columns[name]
+		if len(col.Keys) == 0 {
+			return fmt.Errorf("query %s JSON_LABELS column %s declares no keys", q.Name, name)
+		}
+		for _, key := range col.Keys {
+			label := sanitizeName(key)
+			if label == "" || taken[label] {
+				return fmt.Errorf("query %s column %s key %q is not a valid or unique prometheus label name", q.Name, name, key)
+			}
+			taken[label] = true
+		}
+	}
+	return nil
+}
+
+// checkPivot validate pivot columns have same metric usage, pivot metric and label names are valid
+func (q *QueryInstance) checkPivot(columns map[string]*Column, promLabels []string) error {
+	q.pivotSet, q.pivotLabels = nil, nil
+	if len(q.PivotColumns) == 0 {
+		return nil
+	}
+	if q.PivotLabel == "" {
+		q.PivotLabel = "state"
+	}
+	if q.PivotName == "" || sanitizeName(q.PivotName) != q.PivotName {
+		return fmt.Errorf("query %s pivot metric name %q is not a valid prometheus name", q.Name, q.PivotName)
+	}
+	if sanitizeName(q.PivotLabel) != q.PivotLabel || Contains(promLabels, q.PivotLabel) {
+		return fmt.Errorf("query %s pivot label %q is not a valid or unique prometheus label name", q.Name, q.PivotLabel)
+	}
+	var usage string
+	pivotSet := make(map[string]bool, len(q.PivotColumns))
+	for _, name := range q.PivotColumns {
+		col, ok := columns[name]
+		if !ok || (col.Usage != GAUGE && col.Usage != COUNTER) {
+			return fmt.Errorf("query %s pivot column %s must be a GAUGE or COUNTER column", q.Name, name)
+		}
+		if usage != "" && col.Usage != usage {
+			return fmt.Errorf("query %s pivot columns have different usage %s %s", q.Name, usage, col.Usage)
+		}
+		usage = col.Usage
+		pivotSet[name] = true
+	}
+	for name, col := range columns {
+		if !pivotSet[name] && col.promName() == q.PivotName {
+			return fmt.Errorf("query %s pivot metric name %s conflicts with column %s", q.Name, q.PivotName, name)
+		}
+	}
+	q.pivotSet = pivotSet
+	q.pivotLabels = append(append([]string{}, promLabels...), q.PivotLabel)
+	return nil
+}
+
+// isPivot column is folded into pivot metric
+func (q *QueryInstance) isPivot(colName string) bool {
+	return q.pivotSet[colName]
+}
+
+// completeRows append zero value rows for label combinations of Completions absent from result.
+// Rows are grouped by other labels, each group is completed with all combinations of completion values
+func (q *QueryInstance) completeRows(columnNames []string, columnIdx map[string]int, list [][]interface{}) [][]interface{} {
+	var compLabels, baseLabels []string
+	for _, label := range q.LabelNames {
+		if _, ok := columnIdx[label]; !ok {
+			continue
+		}
+		if _, ok := q.Completions[label]; ok {
+			compLabels = append(compLabels, label)
+		} else {
+			baseLabels = append(baseLabels, label)
+		}
+	}
+	if len(compLabels) == 0 {
+		return list
+	}
+	key := func(row []interface{}, labels []string) string {
+		values := make([]string, len(labels))
+		for i, label := range labels {
+			values[i], _ = dbToString(row[columnIdx[label]], false)
+		}
+		return strings.Join(values, "\x00")
+	}
+	var (
+		groups    []string
+		templates = map[string][]interface{}{}
+		seen      = map[string]bool{}
+	)
+	for _, row := range list {
+		base := key(row, baseLabels)
+		if _, ok := templates[base]; !ok {
+			groups = append(groups, base)
+			templates[base] = row
+		}
+		seen[base+"\x01"+key(row, compLabels)] = true
+	}
+	// without other labels, the only group is known even if result is empty
+	if len(list) == 0 && len(baseLabels) == 0 {
+		groups = append(groups, "")
+		templates[""] = make([]interface{}, len(columnNames))
+	}
+	combos := [][]string{{}}
+	for _, label := range compLabels {
+		var next [][]string
+		for _, combo := range combos {
+			for _, v := range q.Completions[label] {
+				next = append(next, append(append([]string{}, combo...), v))
+			}
+		}
+		combos = next
+	}
+	for _, base := range groups {
+		for _, combo := range combos {
+			if seen[base+"\x01"+strings.Join(combo, "\x00")] {
+				continue
+			}
+			row := make([]interface{}, len(columnNames))
+			for i, name := range columnNames {
+				col, ok := q.Columns[name]
+				if !ok {
+					continue
+				}
+				switch {
+				case col.Usage == LABEL:
+					row[i] = templates[base][i]
+				case !col.DisCard && !col.Histogram:
+					row[i] = int64(0)
+				}
+			}
+			for i, label := range compLabels {
+				row[columnIdx[label]] = combo[i]
+			}
+			list = append(list, row)
+		}
+	}
+	return list
+}
+
+// sqlLeadingRep leading keyword of sql, after comments and opening parentheses
+var sqlLeadingRep = regexp.MustCompile(`^(?:\s+|--[^\n]*\n?|/\*(?s:.*?)\*/|\()*([a-zA-Z]+)`)
+
+// sqlTrailingRep what may follow the trailing ; of sql, whitespace, comments and more ;
+var sqlTrailingRep = regexp.MustCompile(`^(?:\s+|--[^\n]*\n?|/\*(?s:.*?)\*/|;)*$`)
+
+// dollarQuoteRep opening tag of dollar quoted string, like $$ or $body$. $1 is a parameter
+var dollarQuoteRep = regexp.MustCompile(`^\$(?:[a-zA-Z_][a-zA-Z0-9_]*)?\$`)
+
+// readOnlyKeywords leading keywords of statements allowed with read only sql
+var readOnlyKeywords = map[string]bool{"SELECT": true, "WITH": true, "SHOW": true, "TABLE": true, "VALUES": true}
+
+// checkReadOnly reject sql not starting with a read only keyword, or carrying more statements after ;.
+// Only leading keyword is checked, volatile functions and data modifying WITH are left to read only session
+func (q *QueryInstance) checkReadOnly() error {
+	for _, query := range q.Queries {
+		m := sqlLeadingRep.FindStringSubmatch(query.SQL)
+		if m == nil || !readOnlyKeywords[strings.ToUpper(m[1])] || multiStatement(query.SQL) {
+			return fmt.Errorf("query %s sql is not read only: %q", q.Name, strings.TrimSpace(query.SQL))
+		}
+	}
+	return nil
+}
+
+// multiStatement true if sql has a ; outside literals, quoted identifiers, dollar quotes and comments
+// which is followed by another statement
+func multiStatement(sql string) bool {
+	for i := 0; i < len(sql); i++ {
+		// opening and closing of literal, quoted identifier or comment starting at i
+		var opening, closing string
+		switch c := sql[i]; {
+		case c == '\'' || c == '"':
+			// doubled quote escaping it just closes and reopens
+			opening, closing = sql[i:i+1], sql[i:i+1]
+		case strings.HasPrefix(sql[i:], "--"):
+			opening, closing = "--", "\n"
+		case strings.HasPrefix(sql[i:], "/*"):
+			opening, closing = "/*", "*/"
+		case c == '$':
+			opening = dollarQuoteRep.FindString(sql[i:])
+			closing = opening
+		case c == ';':
+			return !sqlTrailingRep.MatchString(sql[i+1:])
+		}
+		if opening == "" {
+			continue
+		}
+		end := strings.Index(sql[i+len(opening):], closing)
+		if end < 0 {
+			// unterminated, rest of sql is quoted or commented out
+			return false
+		}
+		i += len(opening) + end + len(closing) - 1
+	}
+	return false
+}
+
+// searchPathRep schema list of search_path, like monitor, "$user", public
+var searchPathRep = regexp.MustCompile(`^[\w\s,"$]+$`)
+
+var invalidNameCharRep = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// sanitizeName replace characters illegal in prometheus label name with _, prefix _ to leading digit
+func sanitizeName(name string) string {
+	s := invalidNameCharRep.ReplaceAllString(name, "_")
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+	return s
+}
+
 // GetQuerySQL Get query sql according to version
 func (q *QueryInstance) GetQuerySQL(ver semver.Version, isPrimary bool) *Query {
+	if queries := q.GetQuerySQLs(ver, isPrimary); len(queries) > 0 {
+		return queries[0]
+	}
+	return nil
+}
+
+// GetQuerySQLs all queries matching version in config order, the first is preferred and the others are fallbacks
+func (q *QueryInstance) GetQuerySQLs(ver semver.Version, isPrimary bool) []*Query {
+	var queries []*Query
 	for _, query := range q.Queries {
 		if query.IsSQL(ver, isPrimary) {
-			return query
+			queries = append(queries, query)
 		}
 	}
-	return nil
+	return queries
 }
+
+// matchVersion true if any query matches version, regardless of db role
+func (q *QueryInstance) matchVersion(ver semver.Version) bool {
+	for _, query := range q.Queries {
+		if query.versionRange != nil && query.versionRange(ver) {
+			return true
+		}
+	}
+	return false
+}
+
 func (q *QueryInstance) IsEnableCache() bool {
 	return strings.EqualFold(q.EnableCache, statusEnable)
 }
 
 // GetColumn Get column information
 func (q *QueryInstance) GetColumn(colName string, serverLabels prometheus.Labels) *Column {
+	return q.getColumn(colName, serverLabels, rowDesc{})
+}
+
+// rowDesc how descs of a row differ from declared columns
+type rowDesc struct {
+	extraLabels []string            // labels taken from JSON_LABELS columns, follow label columns
+	family      string              // metric family selected by FamilyColumn of row
+	renamer     func(string) string // rewrite metric names
+}
+
+// getColumn like GetColumn, descs are adjusted by row. Descs are always built on a copy, declared column
+// is left intact: metrics keep the desc they were built with, cached or not, and servers never share it
+func (q *QueryInstance) getColumn(colName string, serverLabels prometheus.Labels, row rowDesc) *Column {
 	if col, ok := q.Columns[colName]; ok {
+		var (
+			metricName  = fmt.Sprintf("%s_%s", q.Name, col.promName())
+			help        = q.metricHelp(col, colName)
+			promLabels  = q.promLabels
+			extraLabels = row.extraLabels
+			renamer     = row.renamer
+		)
+		c := *col
+		col = &c
+		if len(extraLabels) > 0 {
+			promLabels = append(append(make([]string, 0, len(q.promLabels)+len(extraLabels)+1), q.promLabels...), extraLabels...)
+		}
+		if row.family != "" {
+			// one metric column is named after family only
+			metricName = fmt.Sprintf("%s_%s", q.Name, row.family)
+			if len(q.MetricNames) > 1 {
+				metricName = fmt.Sprintf("%s_%s", metricName, col.promName())
+			}
+		}
+		if q.isPivot(colName) {
+			metricName = fmt.Sprintf("%s_%s", q.Name, q.PivotName)
+			help = q.pivotHelp()
+			if len(extraLabels) > 0 {
+				promLabels = append(promLabels, q.PivotLabel)
+			} else {
+				promLabels = q.pivotLabels
+			}
+		}
 		switch col.Usage {
-		case LABEL, DISCARD:
+		case LABEL, DISCARD, JSONLabels:
 			col.DisCard = true
 		case GAUGE:
 			col.PrometheusType = prometheus.GaugeValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(renameMetric(renamer, metricName), help, promLabels, serverLabels)
 		case COUNTER:
 			col.PrometheusType = prometheus.CounterValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(renameMetric(renamer, metricName), help, promLabels, serverLabels)
 		case HISTOGRAM:
 			col.PrometheusType = prometheus.UntypedValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(renameMetric(renamer, metricName), help, promLabels, serverLabels)
 		case MappedMETRIC:
 			col.PrometheusType = prometheus.GaugeValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(renameMetric(renamer, metricName), help, promLabels, serverLabels)
 		case DURATION:
 			col.PrometheusType = prometheus.GaugeValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s_milliseconds", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(renameMetric(renamer, metricName+"_milliseconds"), help, promLabels, serverLabels)
+		case LSN:
+			col.PrometheusType = prometheus.GaugeValue
+			col.PrometheusDesc = prometheus.NewDesc(renameMetric(renamer, metricName), help, promLabels, serverLabels)
+		case INFO:
+			// text value as label named after column
+			infoLabels := append(append(make([]string, 0, len(promLabels)+1), promLabels...), col.infoLabel())
+			col.PrometheusType = prometheus.GaugeValue
+			col.PrometheusDesc = prometheus.NewDesc(renameMetric(renamer, metricName), help, infoLabels, serverLabels)
 		}
 
 		return col
@@ -244,6 +717,63 @@ func (q *QueryInstance) GetColumn(colName string, serverLabels prometheus.Labels
 	return nil
 }
 
+// columnOrder indices of result columns in declared order, undeclared ones follow in result order.
+// Metrics of a row come out in the same order whatever column order the result has
+func (q *QueryInstance) columnOrder(columnNames []string) []int {
+	order := make([]int, 0, len(columnNames))
+	for _, name := range q.ColumnNames {
+		for idx, columnName := range columnNames {
+			if columnName == name {
+				order = append(order, idx)
+				break
+			}
+		}
+	}
+	for idx, columnName := range columnNames {
+		if _, ok := q.Columns[columnName]; !ok {
+			order = append(order, idx)
+		}
+	}
+	return order
+}
+
+// latencyColumn first declared metric column, labeled with query latency on all rows so its label names
+// never differ between rows. Pivot and INFO columns share metric name with others or have their own labels,
+// they are passed over, as is keyValue query whose metrics are named by rows. Empty if none left
+func (q *QueryInstance) latencyColumn() string {
+	if q.KeyValue {
+		return ""
+	}
+	for _, name := range q.MetricNames {
+		if col := q.Columns[name]; col != nil && col.Usage != INFO && !q.isPivot(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// pivotHelp help text of pivot metric
+func (q *QueryInstance) pivotHelp() string {
+	help := fmt.Sprintf("columns %s of %s by %s", strings.Join(q.PivotColumns, ","), q.Name, q.PivotLabel)
+	if q.Desc != "" {
+		help = fmt.Sprintf("%s: %s", help, q.Desc)
+	}
+	return help
+}
+
+// metricHelp help text of declared column metric. Column use its Desc,
+// otherwise build it from query instance name, desc and column name
+func (q *QueryInstance) metricHelp(col *Column, columnName string) string {
+	if col.Desc != "" {
+		return col.Desc
+	}
+	help := fmt.Sprintf("column %s of %s", columnName, q.Name)
+	if q.Desc != "" {
+		help = fmt.Sprintf("%s: %s", help, q.Desc)
+	}
+	return help
+}
+
 func (q *QueryInstance) Explain() string {
 	buf := new(bytes.Buffer)
 	err := queryTemplate.Execute(buf, q)
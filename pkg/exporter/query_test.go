@@ -4,8 +4,11 @@ package exporter
 
 import (
 	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/blang/semver"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 	"testing"
 	"time"
 )
@@ -230,6 +233,273 @@ func TestQueryInstance(t *testing.T) {
 		fmt.Println(pgStatDatabase.Explain())
 	})
 }
+func TestQueryInstance_Check_sanitizeName(t *testing.T) {
+	genQueryInstance := func() *QueryInstance {
+		return &QueryInstance{
+			Name: "test",
+			Queries: []*Query{
+				{SQL: `select db as "data base", total as "total count", first as "1st" from dual`},
+			},
+			Metrics: []*Column{
+				{Name: "data base", Usage: LABEL, Desc: "database"},
+				{Name: "total count", Usage: GAUGE, Desc: "total"},
+				{Name: "1st", Usage: COUNTER, Desc: "first"},
+			},
+		}
+	}
+	t.Run("sanitize", func(t *testing.T) {
+		q := genQueryInstance()
+		assert.NoError(t, q.Check())
+		assert.Equal(t, []string{"data base"}, q.LabelNames)
+		assert.Equal(t, []string{"data_base"}, q.promLabels)
+		col := q.GetColumn("total count", nil)
+		assert.Equal(t, "total_count", col.PrometheusName)
+		assert.Contains(t, col.PrometheusDesc.String(), `fqName: "test_total_count"`)
+		assert.Contains(t, col.PrometheusDesc.String(), `variableLabels: [data_base]`)
+		col = q.GetColumn("1st", nil)
+		assert.Contains(t, col.PrometheusDesc.String(), `fqName: "test__1st"`)
+		assert.NotPanics(t, func() {
+			prometheus.MustNewConstMetric(col.PrometheusDesc, col.PrometheusType, 1, "postgres")
+		})
+	})
+	t.Run("strict", func(t *testing.T) {
+		q := genQueryInstance()
+		q.Strict = true
+		assert.Error(t, q.Check())
+	})
+	t.Run("sanitizeName", func(t *testing.T) {
+		assert.Equal(t, "total_count", sanitizeName("total count"))
+		assert.Equal(t, "_1st", sanitizeName("1st"))
+		assert.Equal(t, "a_b_c", sanitizeName("a-b.c"))
+		assert.Equal(t, "datname", sanitizeName("datname"))
+	})
+}
+
+func TestQueryInstance_Check_params(t *testing.T) {
+	var q QueryInstance
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+name: pg_stat_activity
+query:
+  - sql: SELECT count(*) FROM pg_stat_get_activity($1) WHERE state = $2
+    params: [null, active]
+metrics:
+  - name: count
+    usage: GAUGE
+`), &q))
+	assert.NoError(t, q.Check())
+	assert.Equal(t, []QueryParam{nil, "active"}, q.Queries[0].Params)
+
+	q.Queries[0].Params = []QueryParam{map[interface{}]interface{}{"pid": 1}}
+	assert.Error(t, q.Check())
+}
+
+func TestQueryInstance_checkReadOnly(t *testing.T) {
+	for _, tt := range []struct {
+		sql     string
+		wantErr bool
+	}{
+		{sql: "SELECT count(*) FROM pg_stat_activity"},
+		{sql: "WITH a AS (SELECT 1 AS x) SELECT x FROM a"},
+		{sql: "  -- comment\n/* block\ncomment */ (select 1) UNION (SELECT 2)"},
+		{sql: "show max_connections"},
+		{sql: "TABLE pg_stat_bgwriter"},
+		{sql: "VALUES (1)"},
+		{sql: "UPDATE t SET a = 1", wantErr: true},
+		{sql: "/* SELECT */ DELETE FROM t", wantErr: true},
+		{sql: "DROP TABLE t", wantErr: true},
+		{sql: "", wantErr: true},
+		{sql: "SELECT 1;"},
+		{sql: "SELECT 1; -- done\n;"},
+		{sql: "SELECT ';' AS a, \"b;\" FROM t -- ; DROP\n/* ; */"},
+		{sql: "SELECT 'it''s;' || $$;$$ || $f$;$f$ AS a, $1"},
+		{sql: "SELECT 1; DROP TABLE t", wantErr: true},
+		{sql: "SELECT 1 /* ; */; DELETE FROM t", wantErr: true},
+		{sql: "SELECT $$;$$; UPDATE t SET a = 1", wantErr: true},
+	} {
+		t.Run(tt.sql, func(t *testing.T) {
+			q := &QueryInstance{Name: "q", Queries: []*Query{{SQL: "SELECT 1"}, {SQL: tt.sql}}}
+			if tt.wantErr {
+				assert.Error(t, q.checkReadOnly())
+			} else {
+				assert.NoError(t, q.checkReadOnly())
+			}
+		})
+	}
+}
+
+func TestQueryInstance_Check_labelOrder(t *testing.T) {
+	genQueryInstance := func(labels ...string) *QueryInstance {
+		q := &QueryInstance{
+			Name:    "pg_lock",
+			Queries: []*Query{{SQL: `select datname, mode, count from pg_locks`}},
+		}
+		for _, label := range labels {
+			q.Metrics = append(q.Metrics, &Column{Name: label, Usage: LABEL})
+		}
+		q.Metrics = append(q.Metrics, &Column{Name: "count", Usage: GAUGE})
+		assert.NoError(t, q.Check())
+		return q
+	}
+	q1 := genQueryInstance("mode", "datname")
+	q2 := genQueryInstance("datname", "mode")
+	assert.Equal(t, []string{"datname", "mode"}, q1.LabelNames)
+	assert.Equal(t, q1.LabelNames, q2.LabelNames)
+	assert.Equal(t, q1.GetColumn("count", nil).PrometheusDesc.String(), q2.GetColumn("count", nil).PrometheusDesc.String())
+
+	// values are mapped by column name whatever the result column order is
+	s := &Server{}
+	labels1 := s.rowLabels(q1, map[string]int{"datname": 0, "mode": 1}, []interface{}{"postgres", "AccessShareLock"})
+	labels2 := s.rowLabels(q2, map[string]int{"mode": 0, "datname": 1}, []interface{}{"AccessShareLock", "postgres"})
+	assert.Equal(t, []string{"postgres", "AccessShareLock"}, labels1)
+	assert.Equal(t, labels1, labels2)
+}
+
+func TestQueryInstance_metricHelp(t *testing.T) {
+	q := &QueryInstance{
+		Name: "pg_database",
+		Desc: "OpenGauss Database size",
+		Queries: []*Query{
+			{SQL: `SELECT datname,size_bytes,age from dual`},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL, Desc: "Name of this database"},
+			{Name: "size_bytes", Usage: GAUGE, Desc: "Disk space used by the database"},
+			{Name: "age", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	t.Run("declared", func(t *testing.T) {
+		col := q.GetColumn("size_bytes", nil)
+		assert.Equal(t, "Disk space used by the database", q.metricHelp(col, "size_bytes"))
+		assert.Contains(t, col.PrometheusDesc.String(), `help: "Disk space used by the database"`)
+	})
+	t.Run("declared_without_desc", func(t *testing.T) {
+		col := q.GetColumn("age", nil)
+		assert.Equal(t, "column age of pg_database: OpenGauss Database size", q.metricHelp(col, "age"))
+		assert.Contains(t, col.PrometheusDesc.String(), `help: "column age of pg_database: OpenGauss Database size"`)
+	})
+}
+
+func TestQueryInstance_completeRows(t *testing.T) {
+	modes := []string{"AccessShareLock", "RowShareLock", "ExclusiveLock"}
+	q := &QueryInstance{
+		Name: "pg_lock",
+		Queries: []*Query{
+			{SQL: `SELECT datname, mode, count FROM pg_locks`},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "mode", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+		Completions: map[string][]string{"mode": modes},
+	}
+	assert.NoError(t, q.Check())
+	var (
+		columnNames = []string{"datname", "mode", "count"}
+		columnIdx   = map[string]int{"datname": 0, "mode": 1, "count": 2}
+	)
+	t.Run("partial", func(t *testing.T) {
+		list := q.completeRows(columnNames, columnIdx, [][]interface{}{
+			{"postgres", "AccessShareLock", int64(4)},
+			{"omm", []byte("RowShareLock"), int64(1)},
+		})
+		got := map[string]interface{}{}
+		for _, row := range list {
+			datname, _ := dbToString(row[0], false)
+			mode, _ := dbToString(row[1], false)
+			got[datname+"/"+mode] = row[2]
+		}
+		assert.Equal(t, map[string]interface{}{
+			"postgres/AccessShareLock": int64(4),
+			"postgres/RowShareLock":    int64(0),
+			"postgres/ExclusiveLock":   int64(0),
+			"omm/AccessShareLock":      int64(0),
+			"omm/RowShareLock":         int64(1),
+			"omm/ExclusiveLock":        int64(0),
+		}, got)
+	})
+	t.Run("empty", func(t *testing.T) {
+		// datname unknown, nothing to complete
+		assert.Len(t, q.completeRows(columnNames, columnIdx, nil), 0)
+	})
+	t.Run("check", func(t *testing.T) {
+		invalid := &QueryInstance{
+			Name:        "pg_lock",
+			Metrics:     []*Column{{Name: "count", Usage: GAUGE}},
+			Completions: map[string][]string{"count": {"1"}},
+		}
+		assert.Error(t, invalid.Check())
+	})
+}
+
+func TestInferColumns(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("datname").OfType("NAME", ""),
+		sqlmock.NewColumn("state").OfType("TEXT", ""),
+		sqlmock.NewColumn("xact_commit").OfType("INT8", int64(0)),
+		sqlmock.NewColumn("blks_hit_ratio").OfType("NUMERIC", float64(0)),
+		sqlmock.NewColumn("active").OfType("BOOL", false),
+		sqlmock.NewColumn("untyped").OfType("", int64(0)),
+	).AddRow("postgres", "active", 1, 0.9, true, 1))
+	rows, err := db.Query("SELECT * FROM pg_stat_database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columns, err := InferColumns(rows)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Column{
+		{Name: "datname", Usage: LABEL},
+		{Name: "state", Usage: LABEL},
+		{Name: "xact_commit", Usage: GAUGE},
+		{Name: "blks_hit_ratio", Usage: GAUGE},
+		{Name: "active", Usage: GAUGE},
+		{Name: "untyped", Usage: GAUGE},
+	}, columns)
+}
+
+func TestQueryInstance_Check_pivot(t *testing.T) {
+	genQuery := func() *QueryInstance {
+		return &QueryInstance{
+			Name: "pg_connections",
+			Metrics: []*Column{
+				{Name: "datname", Usage: LABEL},
+				{Name: "active", Usage: GAUGE},
+				{Name: "idle", Usage: GAUGE},
+				{Name: "total", Usage: COUNTER},
+			},
+			PivotColumns: []string{"active", "idle"},
+			PivotName:    "count",
+		}
+	}
+	q := genQuery()
+	assert.NoError(t, q.Check())
+	assert.Equal(t, []string{"datname", "state"}, q.pivotLabels)
+	assert.True(t, q.isPivot("idle"))
+	assert.False(t, q.isPivot("total"))
+
+	for name, modify := range map[string]func(q *QueryInstance){
+		"empty_name":      func(q *QueryInstance) { q.PivotName = "" },
+		"invalid_name":    func(q *QueryInstance) { q.PivotName = "count-1" },
+		"conflict_name":   func(q *QueryInstance) { q.PivotName = "total" },
+		"invalid_label":   func(q *QueryInstance) { q.PivotLabel = "st ate" },
+		"duplicate_label": func(q *QueryInstance) { q.PivotLabel = "datname" },
+		"label_column":    func(q *QueryInstance) { q.PivotColumns = []string{"datname", "active"} },
+		"unknown_column":  func(q *QueryInstance) { q.PivotColumns = []string{"waiting"} },
+		"mixed_usage":     func(q *QueryInstance) { q.PivotColumns = []string{"active", "total"} },
+	} {
+		q := genQuery()
+		modify(q)
+		assert.Error(t, q.Check(), name)
+	}
+}
+
 func TestQuery(t *testing.T) {
 	query := &Query{}
 	t.Run("Query_TimeoutDuration_other", func(t *testing.T) {
@@ -3,19 +3,39 @@
 package exporter
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	pq "gitee.com/opengauss/openGauss-connector-go-pq"
 	"github.com/blang/semver"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/sirupsen/logrus"
+	"net"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
 
+const defaultMaxLabelLength = 256
+
+// upQueryTimeout up query must finish in it
+const upQueryTimeout = 3 * time.Second
+
+// defaultReconnectSQLStates admin_shutdown, crash_shutdown, cannot_connect_now
+var defaultReconnectSQLStates = []string{"57P01", "57P02", "57P03"}
+
 var (
-	serverLabelName = "server"
+	serverLabelName        = "server"
+	compatibilityLabelName = "compatibility"
+	nodeNameLabelName      = "node_name"
+	nodeTypeLabelName      = "node_type"
+	userLabelName          = "db_user"
+	dataDirectoryLabelName = "data_directory"
+	systemIDLabelName      = "system_identifier"
+	clusterLabelName       = "cluster"
 	// staticLabelName = "static"
 )
 
@@ -45,6 +65,20 @@ func ServerWithDisableSettingsMetrics(b bool) ServerOpt {
 	}
 }
 
+// ServerWithConfigChecksum emit config_checksum of these settings with pg_settings metrics
+func ServerWithConfigChecksum(settings []string) ServerOpt {
+	return func(s *Server) {
+		s.checksumSettings = settings
+	}
+}
+
+// ServerWithTextSettingsAsInfo emit textual pg_settings as info metric instead of skip them
+func ServerWithTextSettingsAsInfo(b bool) ServerOpt {
+	return func(s *Server) {
+		s.textSettingsAsInfo = b
+	}
+}
+
 // ServerWithDisableCache  will specify metric namespace, by default is pg or pgbouncer
 func ServerWithDisableCache(b bool) ServerOpt {
 	return func(s *Server) {
@@ -63,17 +97,262 @@ func ServerWithParallel(i int) ServerOpt {
 	}
 }
 
+// ServerWithRoleQuery override pg_is_in_recovery() to determine primary/standby role.
+// The query must return a single boolean (true for in recovery) or a role string like primary/standby
+func ServerWithRoleQuery(sql string) ServerOpt {
+	return func(s *Server) {
+		s.roleQuery = sql
+	}
+}
+
+// ServerWithMaxLabelLength truncate label value longer than n. 0 means unlimited
+func ServerWithMaxLabelLength(n int) ServerOpt {
+	return func(s *Server) {
+		s.maxLabelLength = n
+	}
+}
+
+// ServerWithSessionSetup sql statements run on connection before query metrics, like SET search_path
+func ServerWithSessionSetup(sqls []string) ServerOpt {
+	return func(s *Server) {
+		s.sessionSetup = sqls
+	}
+}
+
+// ServerWithMaxRows stop scanning query result after n rows, 0 means unlimited
+func ServerWithMaxRows(n int) ServerOpt {
+	return func(s *Server) {
+		s.maxRows = n
+	}
+}
+
+// ServerWithStatementTimeout run query in a transaction with SET LOCAL statement_timeout of query timeout,
+// it reverts with the transaction and never leaks to pooled connection
+func ServerWithStatementTimeout(b bool) ServerOpt {
+	return func(s *Server) {
+		s.statementTimeout = b
+	}
+}
+
+// ServerWithReconnectSQLStates SQLSTATE of query error which close connection and reconnect on next scrape,
+// like admin shutdown 57P01 after failover
+func ServerWithReconnectSQLStates(codes []string) ServerOpt {
+	return func(s *Server) {
+		s.reconnectSQLStates = nil
+		for _, code := range codes {
+			if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+				s.reconnectSQLStates = append(s.reconnectSQLStates, code)
+			}
+		}
+	}
+}
+
+// ServerWithErrorLogInterval log errors of same query at most once in interval, others are counted and summarized
+func ServerWithErrorLogInterval(interval time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.errorLogInterval = interval
+	}
+}
+
+// ServerWithUpQuery sql which must succeed for target to be up. Instance may ping fine while unusable,
+// like read-only due to disk full. Empty means ping only
+func ServerWithUpQuery(sql string) ServerOpt {
+	return func(s *Server) {
+		s.upQuery = sql
+	}
+}
+
+// ServerWithFingerprintJoin join all hosts of multi-host dsn with sep as fingerprint and server label,
+// so failover clusters sharing first host do not collide. Empty keeps the first host only
+func ServerWithFingerprintJoin(sep string) ServerOpt {
+	return func(s *Server) {
+		s.fingerprintJoin = sep
+	}
+}
+
+// ServerWithSocketFingerprint keep unix socket directory in fingerprint and server label,
+// like localhost:5432(socket:/tmp), so socket and TCP localhost targets do not share series
+func ServerWithSocketFingerprint(b bool) ServerOpt {
+	return func(s *Server) {
+		s.socketFingerprint = b
+	}
+}
+
+// ServerWithExposeQuerySQL emit query_info with sql of each executed query as label, for auditing
+func ServerWithExposeQuerySQL(b bool) ServerOpt {
+	return func(s *Server) {
+		s.exposeQuerySQL = b
+	}
+}
+
+// DialFunc open network connection to database, addr is host:port of target
+type DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ServerWithDialer connect database through dialer, e.g. ssh tunnel or socks5 proxy to reach target behind bastion
+func ServerWithDialer(dialer DialFunc) ServerOpt {
+	return func(s *Server) {
+		s.dialer = dialer
+	}
+}
+
+// ServerWithDedupMetrics buffer metrics of a scrape and drop repeated name and label set, keep the last one.
+// prometheus rejects the whole scrape with duplicate metric otherwise. Nothing is sent before the scrape ends
+func ServerWithDedupMetrics(b bool) ServerOpt {
+	return func(s *Server) {
+		s.dedupMetrics = b
+	}
+}
+
+// ServerWithSystemLabels add data_directory and system_identifier of instance as const label,
+// correlate metrics with host level metrics. Label is left out if it can not be queried
+func ServerWithSystemLabels(b bool) ServerOpt {
+	return func(s *Server) {
+		s.systemLabels = b
+	}
+}
+
+// ServerWithTLSCertExpiry record expiry of certificate presented in TLS handshake of the driver's own connections,
+// no extra connection is made. Nothing is emitted for non TLS connection
+func ServerWithTLSCertExpiry(b bool) ServerOpt {
+	return func(s *Server) {
+		s.tlsCertExpiry = b
+	}
+}
+
+// ServerWithStaleFactor serve metrics of last successful refresh while query fails, until the cache is
+// factor times ttl old. Stale series are not emitted then, so prometheus marks them stale. 0 disables
+func ServerWithStaleFactor(factor float64) ServerOpt {
+	return func(s *Server) {
+		s.staleFactor = factor
+	}
+}
+
+// ServerWithTargetError emit target_error with error text of last failed connect as label while target is down
+func ServerWithTargetError(b bool) ServerOpt {
+	return func(s *Server) {
+		s.targetError = b
+	}
+}
+
+// ServerWithKeepAlive ping database in interval between scrapes, keep connections warm and
+// detect failover early. Server is marked down on failure and reconnected by next scrape. 0 disables
+func ServerWithKeepAlive(interval time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.keepAlive = interval
+	}
+}
+
+// ServerWithQueryPlanDiagnostics explain queries at most once in 10 minutes, emit estimated cost of plan
+func ServerWithQueryPlanDiagnostics(b bool) ServerOpt {
+	return func(s *Server) {
+		s.planDiagnostics = b
+	}
+}
+
+// ServerWithStrictColumns fail query whose result has duplicate column names, otherwise later duplicates are renamed
+func ServerWithStrictColumns(b bool) ServerOpt {
+	return func(s *Server) {
+		s.strictColumns = b
+	}
+}
+
+// ServerWithTargetLabelFromDSN use host:port exactly as written in dsn as server label, fingerprint is unchanged
+func ServerWithTargetLabelFromDSN(b bool) ServerOpt {
+	return func(s *Server) {
+		s.targetLabelFromDSN = b
+	}
+}
+
+// ServerWithDeltaOnly experimental, emit query metric only when its sample changed since last scrape
+func ServerWithDeltaOnly(b bool) ServerOpt {
+	return func(s *Server) {
+		s.deltaOnly = b
+	}
+}
+
+// ServerWithUserLabel add user of dsn as db_user label to up and scrape metrics, password is never exposed
+func ServerWithUserLabel(b bool) ServerOpt {
+	return func(s *Server) {
+		s.userLabel = b
+	}
+}
+
+// ServerWithScrapeMemoryBudget abort scrape once scanned values exceed about bytes, 0 means unlimited
+func ServerWithScrapeMemoryBudget(bytes int64) ServerOpt {
+	return func(s *Server) {
+		s.memBudget = bytes
+	}
+}
+
+// ServerWithLatencyLabel add bucketed query latency as scrape_latency_ms label to first metric of each query instance.
+// Every row of that metric carries the label, so its label names stay the same
+func ServerWithLatencyLabel(b bool) ServerOpt {
+	return func(s *Server) {
+		s.latencyLabel = b
+	}
+}
+
+// ServerWithMetricRenamer rewrite names of emitted metrics, e.g. map them to schema of another exporter
+func ServerWithMetricRenamer(renamer func(name string) string) ServerOpt {
+	return func(s *Server) {
+		s.renamer = renamer
+	}
+}
+
+// ServerWithCompatibilityLabel add database datcompatibility as const label
+func ServerWithCompatibilityLabel(b bool) ServerOpt {
+	return func(s *Server) {
+		s.compatibilityLabel = b
+	}
+}
+
+// ServerWithNodeLabel discover local pgxc node on distributed deployment, add node_name/node_type as const label
+func ServerWithNodeLabel(b bool) ServerOpt {
+	return func(s *Server) {
+		s.nodeLabel = b
+	}
+}
+
 type Server struct {
 	fingerprint            string
 	dsn                    string
 	db                     *sql.DB
 	labels                 prometheus.Labels
 	primary                bool
+	recoveryState          int    // finer role than primary, see recoveryStatePrimary
 	namespace              string // default prometheus namespace from cmd args
 	disableSettingsMetrics bool
+	textSettingsAsInfo     bool
 	notCollInternalMetrics bool // 不采集部分指标
 	disableCache           bool
 	timeToString           bool
+	compatibilityLabel     bool     // add datcompatibility of current database as label
+	roleQuery              string   // override pg_is_in_recovery() role detection
+	upQuery                string   // probe run after ping, up only if it succeeds
+	fingerprintJoin        string   // join all hosts of multi-host dsn as fingerprint
+	socketFingerprint      bool     // keep unix socket directory in fingerprint
+	maxLabelLength         int      // truncate label value longer than it, 0 means unlimited
+	sessionSetup           []string // statements run on connection before query metrics
+	checksumSettings       []string // settings hashed into config_checksum, empty disables it
+	nodeLabel              bool     // discover local pgxc node and add it as label
+	maxRows                int      // default row limit of query, 0 means unlimited
+	statementTimeout       bool     // set statement_timeout of query transaction to query timeout
+	reconnectSQLStates     []string // SQLSTATE of query error which needs reconnect
+	latencyLabel           bool     // add bucketed query latency as label to first metric of query
+	exposeQuerySQL         bool     // emit sql of executed queries as label of query_info
+	userLabel              bool     // add user of dsn as db_user label of internal metrics
+	dbUser                 string   // user of dsn, value of db_user label
+	dedupMetrics           bool     // drop repeated metric with same name and labels in a scrape, keep the last
+	systemLabels           bool     // discover data_directory and system_identifier and add them as label
+	systemLabelsDB         *sql.DB  // connection system labels discovered on, discover again after reconnect
+	tlsCertExpiry          bool     // record certificate expiry of TLS connections, emit tls_cert_expiry_timestamp_seconds
+	staleFactor            float64  // serve cache on failed refresh until staleFactor times ttl old, 0 for never
+	targetError            bool     // emit target_error with connection error while target is down
+	connError              string   // sanitized error of last failed connect, cleared on success
+	strictColumns          bool     // fail query returning duplicate column names instead of renaming them
+	targetLabelFromDSN     bool     // server label is host:port as written in dsn, not fingerprint
+	nodeName               string   // local pgxc node name, empty on single node deployment
+	schemas                []string // discovered schemas of current database, bound into perSchema queries
 
 	parallel int
 	// Last version used to calculate metric map. If mismatch on scrape,
@@ -88,6 +367,9 @@ type Server struct {
 	ScrapeErrorCount int64     // 采集失败个数
 	scrapeBegin      time.Time // server level scrape begin
 	scrapeDone       time.Time // server last scrape done
+	connectedAt      time.Time // when current *sql.DB opened, reset on reconnect
+	certMtx          sync.Mutex
+	certExpiry       time.Time // server certificate expiry of last TLS handshake, zero for non TLS
 
 	up               prometheus.Gauge
 	recovery         prometheus.Gauge   // postgres is in recovery ?
@@ -96,15 +378,61 @@ type Server struct {
 	scrapeTotalCount prometheus.Counter // exporter level: total scrape count of this server
 	scrapeErrorCount prometheus.Counter // exporter level: error scrape count
 
+	queryStatsMtx          sync.Mutex         // guard internal query metrics, written by parallel workers
 	queryCacheTTL          map[string]float64 // internal query metrics: cache time to live
 	queryScrapeTotalCount  map[string]float64 // internal query metrics: total executed
 	queryScrapeHitCount    map[string]float64 // internal query metrics: times serving from hit cache
 	queryScrapeErrorCount  map[string]float64 // internal query metrics: times failed
 	queryScrapeMetricCount map[string]float64 // internal query metrics: number of metrics scrapped
+	queryPrecisionLoss     map[string]float64 // internal query metrics: values lost precision converting to float64
+	precisionLossLogged    map[string]bool    // metric already logged precision loss
 	queryScrapeDuration    map[string]float64 // internal query metrics: time spend on executing
+	querySQLText           map[string]string  // internal query metrics: sql executed in last scrape
+	queryFallback          map[string]float64 // internal query metrics: index of query succeeded among candidates, 0 preferred
+	querySkipped           map[skipID]float64 // internal query metrics: times query skipped, by reason
 	clientEncoding         string
 	dbInfoMap              map[string]*DBInfo
 	dbName                 string
+
+	infoValues map[string]map[string]bool // distinct values of INFO column, up to infoCardinalityLimit
+	queueDepth float64                    // query instances dispatched in last scrape
+	queueWait  prometheus.Histogram       // seconds query instances wait before a worker picks them up
+	renamer    func(string) string        // rewrite names of emitted metrics, nil keeps them
+	missingLog sync.Map                   // query label columns already warned missing from result
+	memBudget  int64                      // approximate bytes of values a scrape may scan, 0 means unlimited
+	mem        *scrapeMemory              // approximate bytes scanned in current scrape, shared by databases of a dsn
+	memOnce    sync.Once                  // create mem of server not sharing it
+	dialer     DialFunc                   // open connections through it, e.g. ssh tunnel or socks5 proxy
+
+	errorLogInterval time.Duration // log errors of same query at most once in it, 0 means unlimited
+	errorLogMtx      sync.Mutex
+	errorLogThrottle map[string]*errorLogState // last error log of query, guarded by errorLogMtx
+
+	privilegeMtx     sync.Mutex
+	privilegeChecked map[string]bool   // queries whose Requires probed on current connection
+	disabledQueries  map[string]string // queries disabled by probe, with reason
+
+	reconnectMtx     sync.Mutex
+	reconnectPending bool // query err asked for reconnect, closed by closeOnReconnect
+
+	keepAlive     time.Duration // ping database in it between scrapes, 0 disables
+	keepAliveMtx  sync.Mutex
+	keepAliveStop chan struct{} // stop keepalive goroutine, nil if not running
+
+	planDiagnostics bool                 // explain queries at most once in queryPlanInterval, emit estimated cost
+	planMtx         sync.Mutex           // guard planCost and planAt, written by parallel workers
+	planCost        map[string]float64   // estimated total cost of query plan
+	planAt          map[string]time.Time // when query explained last time
+
+	deltaOnly   bool              // experimental, emit query metric only if its sample changed since last scrape
+	deltaMtx    sync.Mutex        // guard deltaValues, scrapes of server may overlap
+	deltaValues map[string]string // last emitted sample of series by metricKey, series absent in last scrape dropped
+}
+
+// errorLogState when query error logged last time, and how many errors suppressed since then
+type errorLogState struct {
+	last       time.Time
+	suppressed int
 }
 
 type DBInfo struct {
@@ -115,6 +443,14 @@ type DBInfo struct {
 
 // Close disconnects from OpenGauss.
 func (s *Server) Close() error {
+	s.stopKeepAlive()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closeDB()
+}
+
+// closeDB close connection and mark server down, s.lock must be held
+func (s *Server) closeDB() error {
 	if s.db == nil {
 		return nil
 	}
@@ -123,10 +459,70 @@ func (s *Server) Close() error {
 	return s.db.Close()
 }
 
+// UpdateCredentials rebuild dsn with new password, reconnect on next scrape
+func (s *Server) UpdateCredentials(password string) error {
+	s.stopKeepAlive()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dsnSetting, err := pq.ParseURLToMap(s.dsn)
+	if err != nil {
+		return fmt.Errorf("parse dsn of %s err %s", s.fingerprint, err)
+	}
+	dsnSetting[DSNPassword] = password
+	if err = s.closeDB(); err != nil {
+		log.Warnf("close connection of %s err %s", s.fingerprint, err)
+	}
+	s.db = nil
+	s.connectedAt = time.Time{}
+	s.UP = false
+	s.dsn = genDSNString(dsnSetting)
+	log.Infof("Credentials of %s/%s updated, reconnect on next scrape", s.fingerprint, s.dbName)
+	return nil
+}
+
+// reconnectOnError ask for reconnect if query err carries a SQLSTATE which needs it. Connection is shared
+// by parallel workers, so it is closed by closeOnReconnect after they drain. Return true if asked.
+func (s *Server) reconnectOnError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || !Contains(s.reconnectSQLStates, string(pqErr.Code)) {
+		return false
+	}
+	log.Warnf("Query on %s/%s failed with SQLSTATE %s, close connection and reconnect on next scrape",
+		s.fingerprint, s.dbName, pqErr.Code)
+	s.reconnectMtx.Lock()
+	s.reconnectPending = true
+	s.reconnectMtx.Unlock()
+	return true
+}
+
+// closeOnReconnect close connection if a query asked for reconnect, server is marked down and
+// reconnect on next scrape. Call it after workers of scrape drained
+func (s *Server) closeOnReconnect() {
+	s.reconnectMtx.Lock()
+	pending := s.reconnectPending
+	s.reconnectPending = false
+	s.reconnectMtx.Unlock()
+	if !pending {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.closeDB(); err != nil {
+		log.Errorf("Error while closing DB connection to %q: %v", s, err)
+	}
+}
+
 // Ping checks connection availability and possibly invalidates the connection if it fails.
 func (s *Server) Ping() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ping()
+}
+
+// ping like Ping, s.lock must be held
+func (s *Server) ping() error {
 	if err := s.db.Ping(); err != nil {
-		if closeErr := s.Close(); closeErr != nil {
+		if closeErr := s.closeDB(); closeErr != nil {
 			log.Errorf("Error while closing non-pinging DB connection to %q: %v", s, closeErr)
 		}
 		return err
@@ -134,35 +530,55 @@ func (s *Server) Ping() error {
 	return nil
 }
 
+// fqName full name of server internal metric, rewritten by renamer
+func (s *Server) fqName(subsystem, name string) string {
+	return renameMetric(s.renamer, prometheus.BuildFQName(s.namespace, subsystem, name))
+}
+
 // String returns server's fingerprint.
 func (s *Server) String() string {
 	return s.labels[serverLabelName]
 }
 
+// internalLabels labels of up and scrape metrics, s.labels with db_user if enabled. db_user is
+// left out of query metrics
+func (s *Server) internalLabels() prometheus.Labels {
+	if !s.userLabel || s.dbUser == "" {
+		return s.labels
+	}
+	labels := make(prometheus.Labels, len(s.labels)+1)
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	labels[userLabelName] = s.dbUser
+	return labels
+}
+
 func (s *Server) setupServerInternalMetrics() error {
+	labels := s.internalLabels()
 	s.scrapeTotalCount = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: s.namespace, ConstLabels: s.labels,
-		Subsystem: "exporter_query", Name: "scrape_total_count", Help: "times exporter was scraped for metrics",
+		Name: s.fqName("exporter_query", "scrape_total_count"), ConstLabels: labels,
+		Help: "times exporter was scraped for metrics",
 	})
 	s.scrapeErrorCount = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: s.namespace, ConstLabels: s.labels,
-		Subsystem: "exporter_query", Name: "scrape_error_count", Help: "times exporter was scraped for metrics and failed",
+		Name: s.fqName("exporter_query", "scrape_error_count"), ConstLabels: labels,
+		Help: "times exporter was scraped for metrics and failed",
 	})
 	s.scrapeDuration = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: s.namespace, ConstLabels: s.labels,
-		Subsystem: "exporter_query", Name: "scrape_duration", Help: "seconds exporter spending on scrapping",
+		Name: s.fqName("exporter_query", "scrape_duration"), ConstLabels: labels,
+		Help: "seconds exporter spending on scrapping",
 	})
 	s.lastScrapeTime = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: s.namespace, ConstLabels: s.labels,
-		Subsystem: "exporter_query", Name: "last_scrape_time", Help: "seconds exporter spending on scrapping",
+		Name: s.fqName("exporter_query", "last_scrape_time"), ConstLabels: labels,
+		Help: "seconds exporter spending on scrapping",
 	})
 	s.recovery = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: s.namespace, ConstLabels: s.labels,
-		Name: "in_recovery", Help: "server is in recovery mode? 1 for yes 0 for no",
+		Name: s.fqName("", "in_recovery"), ConstLabels: labels,
+		Help: "server is in recovery mode? 1 for yes 0 for no",
 	})
 	s.up = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: s.namespace, ConstLabels: s.labels,
-		Name: "up", Help: "always be 1 if your could retrieve metrics",
+		Name: s.fqName("", "up"), ConstLabels: labels,
+		Help: "always be 1 if your could retrieve metrics",
 	})
 	return nil
 }
@@ -195,8 +611,8 @@ func (s *Server) collectorServerInternalMetrics(ch chan<- prometheus.Metric) {
 	// 采集耗时
 	s.scrapeDuration.Set(s.scrapeDone.Sub(s.scrapeBegin).Seconds())
 
-	versionDesc := prometheus.NewDesc(fmt.Sprintf("%s_%s", s.namespace, "version"),
-		"Version string as reported by OpenGauss", []string{"version", "short_version"}, s.labels)
+	versionDesc := prometheus.NewDesc(s.fqName("", "version"),
+		"Version string as reported by OpenGauss", []string{"version", "short_version"}, s.internalLabels())
 	version := prometheus.MustNewConstMetric(versionDesc,
 		prometheus.UntypedValue, 1, s.lastMapVersion.String(), s.lastMapVersion.String())
 	s.scrapeTotalCount.Add(float64(s.ScrapeTotalCount))
@@ -204,21 +620,330 @@ func (s *Server) collectorServerInternalMetrics(ch chan<- prometheus.Metric) {
 
 	ch <- s.up
 	ch <- s.recovery
+	ch <- s.recoveryStateMetric()
 	ch <- s.scrapeTotalCount
 	ch <- s.scrapeErrorCount
 	ch <- s.scrapeDuration
 	ch <- s.lastScrapeTime
 	ch <- version
+	if age := s.connectionAgeMetric(); age != nil {
+		ch <- age
+	}
+	if expiry := s.certExpiryMetric(); expiry != nil {
+		ch <- expiry
+	}
+	if targetErr := s.targetErrorMetric(); targetErr != nil {
+		ch <- targetErr
+	}
+	s.collectQueryInternalMetrics(ch)
+
+}
+
+// targetErrorLabelLength connection error longer than it is truncated in target_error label
+const targetErrorLabelLength = 256
+
+var passwordRep = regexp.MustCompile(`(?i)(password\s*=\s*)\S+`)
+
+// setConnError keep sanitized error of connect for target_error, nil clears it
+func (s *Server) setConnError(err error) {
+	if err == nil {
+		s.connError = ""
+		return
+	}
+	text := passwordRep.ReplaceAllString(strings.Join(strings.Fields(err.Error()), " "), "${1}******")
+	s.connError, _ = truncateLabelValue(text, targetErrorLabelLength)
+}
+
+// targetErrorMetric error of last failed connect as label, nil unless enabled and target is down
+func (s *Server) targetErrorMetric() prometheus.Metric {
+	if !s.targetError || s.UP || s.connError == "" {
+		return nil
+	}
+	desc := prometheus.NewDesc(s.fqName("exporter", "target_error"),
+		"error of last failed connect to the target, present only while the target is down", []string{"error"}, s.labels)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, s.connError)
+}
+
+// connectionAgeMetric seconds since current connection opened, nil if never connected
+func (s *Server) connectionAgeMetric() prometheus.Metric {
+	if s.connectedAt.IsZero() {
+		return nil
+	}
+	desc := prometheus.NewDesc(s.fqName("exporter", "connection_age_seconds"),
+		"seconds since the connection to the target was established", nil, s.labels)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, time.Since(s.connectedAt).Seconds())
+}
+
+func (s *Server) collectQueryInternalMetrics(ch chan<- prometheus.Metric) {
+	s.queryStatsMtx.Lock()
+	defer s.queryStatsMtx.Unlock()
+	metricCountDesc := prometheus.NewDesc(s.fqName("exporter_query", "metric_count"),
+		"number of metrics the query produced in last scrape", []string{"query"}, s.labels)
+	for name, count := range s.queryScrapeMetricCount {
+		ch <- prometheus.MustNewConstMetric(metricCountDesc, prometheus.GaugeValue, count, name)
+	}
+	precisionLossDesc := prometheus.NewDesc(s.fqName("exporter", "precision_loss_total"),
+		"number of integer values beyond 2^53 which lost precision converting to float64", []string{"query"}, s.labels)
+	for name, count := range s.queryPrecisionLoss {
+		ch <- prometheus.MustNewConstMetric(precisionLossDesc, prometheus.CounterValue, count, name)
+	}
+	if s.exposeQuerySQL {
+		queryInfoDesc := prometheus.NewDesc(s.fqName("exporter", "query_info"),
+			"sql the query executed in last scrape, always be 1", []string{"query", "sql"}, s.labels)
+		for name, sql := range s.querySQLText {
+			ch <- prometheus.MustNewConstMetric(queryInfoDesc, prometheus.GaugeValue, 1, name, sql)
+		}
+	}
+	fallbackDesc := prometheus.NewDesc(s.fqName("exporter_query", "fallback"),
+		"index of query succeeded in last scrape among queries matching version, 0 is the preferred one", []string{"query"}, s.labels)
+	for name, index := range s.queryFallback {
+		ch <- prometheus.MustNewConstMetric(fallbackDesc, prometheus.GaugeValue, index, name)
+	}
+	skippedDesc := prometheus.NewDesc(s.fqName("exporter", "query_skipped_total"),
+		"times query skipped without querying database, by reason db_role, disabled or version", []string{"query", "reason"}, s.labels)
+	for key, count := range s.querySkipped {
+		ch <- prometheus.MustNewConstMetric(skippedDesc, prometheus.CounterValue, count, key.query, key.reason)
+	}
+	s.planMtx.Lock()
+	planCostDesc := prometheus.NewDesc(s.fqName("exporter", "query_plan_cost"),
+		"estimated total cost of query plan, explained at most once in 10 minutes", []string{"query"}, s.labels)
+	for name, cost := range s.planCost {
+		ch <- prometheus.MustNewConstMetric(planCostDesc, prometheus.GaugeValue, cost, name)
+	}
+	s.planMtx.Unlock()
+	memoryDesc := prometheus.NewDesc(s.fqName("exporter", "scrape_memory_bytes"),
+		"approximate bytes of values scanned in last scrape", nil, s.labels)
+	ch <- prometheus.MustNewConstMetric(memoryDesc, prometheus.GaugeValue, float64(s.memory().add(0)))
+	queueDepthDesc := prometheus.NewDesc(s.fqName("exporter", "scrape_queue_depth"),
+		"number of query instances dispatched to workers in last scrape", nil, s.labels)
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, s.queueDepth)
+	if s.queueWait != nil {
+		ch <- s.queueWait
+	}
+	s.privilegeMtx.Lock()
+	defer s.privilegeMtx.Unlock()
+	disabledDesc := prometheus.NewDesc(s.fqName("exporter_query", "disabled"),
+		"1 if the query is disabled since monitoring role can not read its relations or its extension is absent", []string{"query"}, s.labels)
+	for name := range s.disabledQueries {
+		ch <- prometheus.MustNewConstMetric(disabledDesc, prometheus.GaugeValue, 1, name)
+	}
+}
+
+// addPrecisionLoss count value of query which lost precision, log once per metric
+func (s *Server) addPrecisionLoss(name, columnName string, value interface{}) {
+	s.queryStatsMtx.Lock()
+	defer s.queryStatsMtx.Unlock()
+	if s.queryPrecisionLoss == nil {
+		s.queryPrecisionLoss = map[string]float64{}
+	}
+	if s.precisionLossLogged == nil {
+		s.precisionLossLogged = map[string]bool{}
+	}
+	s.queryPrecisionLoss[name]++
+	if metricName := name + "_" + columnName; !s.precisionLossLogged[metricName] {
+		s.precisionLossLogged[metricName] = true
+		log.Debugf("Collect Metric [%s] on %s value %v beyond 2^53 lost precision as float64", metricName, s.dbName, value)
+	}
+}
+
+// addInfoValue record value of INFO column, warn once if distinct values exceed infoCardinalityLimit.
+// Return true if the limit exceeded.
+func (s *Server) addInfoValue(metricName, value string) bool {
+	s.queryStatsMtx.Lock()
+	defer s.queryStatsMtx.Unlock()
+	if s.infoValues == nil {
+		s.infoValues = map[string]map[string]bool{}
+	}
+	values, ok := s.infoValues[metricName]
+	if !ok {
+		values = map[string]bool{}
+		s.infoValues[metricName] = values
+	}
+	if len(values) > infoCardinalityLimit || values[value] {
+		return len(values) > infoCardinalityLimit
+	}
+	values[value] = true
+	if len(values) > infoCardinalityLimit {
+		log.Warnf("Collect Metric [%s] on %s has more than %d distinct values, INFO column should be low cardinality",
+			metricName, s.dbName, infoCardinalityLimit)
+		return true
+	}
+	return false
+}
+
+// allowErrorLog decide whether errors of query should be logged now. If not, count them as suppressed.
+// Return number of errors suppressed since last log when allowed.
+func (s *Server) allowErrorLog(name string, errCount int) (bool, int) {
+	if s.errorLogInterval <= 0 {
+		return true, 0
+	}
+	s.errorLogMtx.Lock()
+	defer s.errorLogMtx.Unlock()
+	if s.errorLogThrottle == nil {
+		s.errorLogThrottle = map[string]*errorLogState{}
+	}
+	now := time.Now()
+	state, ok := s.errorLogThrottle[name]
+	if ok && now.Sub(state.last) < s.errorLogInterval {
+		state.suppressed += errCount
+		return false, 0
+	}
+	var suppressed int
+	if ok {
+		suppressed = state.suppressed
+	}
+	s.errorLogThrottle[name] = &errorLogState{last: now}
+	return true, suppressed
+}
+
+// setQueueDepth record how many query instances a scrape dispatched
+func (s *Server) setQueueDepth(n int) {
+	s.queryStatsMtx.Lock()
+	defer s.queryStatsMtx.Unlock()
+	s.queueDepth = float64(n)
+}
+
+// scrapeMemory approximate bytes of values scanned in a scrape, shared by all databases of a dsn
+// so memory budget bounds the whole scrape
+type scrapeMemory struct {
+	mtx  sync.Mutex
+	used int64
+}
+
+// reset start accounting of a new scrape
+func (m *scrapeMemory) reset() {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.used = 0
+}
+
+// add charge bytes to current scrape, return bytes used so far
+func (m *scrapeMemory) add(bytes int64) int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.used += bytes
+	return m.used
+}
+
+// serverWithScrapeMemory share memory accounting of scrape with other databases of the same dsn
+func serverWithScrapeMemory(mem *scrapeMemory) ServerOpt {
+	return func(s *Server) {
+		s.mem = mem
+	}
+}
+
+// memory accounting of current scrape, a server not sharing it accounts on its own
+func (s *Server) memory() *scrapeMemory {
+	s.memOnce.Do(func() {
+		if s.mem == nil {
+			s.mem = &scrapeMemory{}
+		}
+	})
+	return s.mem
+}
+
+// chargeMemory add approximate size of scanned row to current scrape, error once budget is exceeded
+func (s *Server) chargeMemory(bytes int64) error {
+	if used := s.memory().add(bytes); s.memBudget > 0 && used > s.memBudget {
+		return fmt.Errorf("scrape memory budget %d bytes exceeded", s.memBudget)
+	}
+	return nil
+}
+
+// memoryExceeded whether current scrape has used up memory budget, remaining queries are skipped
+func (s *Server) memoryExceeded() bool {
+	return s.memBudget > 0 && s.memory().add(0) > s.memBudget
+}
+
+// observeQueueWait record time query instance spent in queue before a worker picked it up
+func (s *Server) observeQueueWait(wait time.Duration) {
+	s.queryStatsMtx.Lock()
+	defer s.queryStatsMtx.Unlock()
+	if s.queueWait == nil {
+		s.queueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: s.fqName("exporter", "scrape_queue_wait_seconds"), ConstLabels: s.labels,
+			Help: "seconds query instances wait in queue before a worker picks them up",
+		})
+	}
+	s.queueWait.Observe(wait.Seconds())
+}
+
+// querySQLLabelLength sql longer than it is truncated in query_info label
+const querySQLLabelLength = 1024
+
+// setQuerySQL record sql executed by query, whitespace collapsed to keep label on one line
+func (s *Server) setQuerySQL(name, sql string) {
+	if !s.exposeQuerySQL {
+		return
+	}
+	s.queryStatsMtx.Lock()
+	defer s.queryStatsMtx.Unlock()
+	if s.querySQLText == nil {
+		s.querySQLText = map[string]string{}
+	}
+	s.querySQLText[name], _ = truncateLabelValue(strings.Join(strings.Fields(sql), " "), querySQLLabelLength)
+}
+
+// reasons of query skipped without querying database
+const (
+	skipReasonDBRole   = "db_role"  // no query for role of database
+	skipReasonDisabled = "disabled" // query status is disable
+	skipReasonVersion  = "version"  // no query matches version of database
+)
+
+type skipID struct {
+	query, reason string
+}
+
+// addQuerySkipped count query skipped for reason
+func (s *Server) addQuerySkipped(name, reason string) {
+	s.queryStatsMtx.Lock()
+	defer s.queryStatsMtx.Unlock()
+	if s.querySkipped == nil {
+		s.querySkipped = map[skipID]float64{}
+	}
+	s.querySkipped[skipID{query: name, reason: reason}]++
+}
 
+// setQueryFallback record index of query succeeded, only for query instances with fallback queries
+func (s *Server) setQueryFallback(name string, index int) {
+	s.queryStatsMtx.Lock()
+	defer s.queryStatsMtx.Unlock()
+	if s.queryFallback == nil {
+		s.queryFallback = map[string]float64{}
+	}
+	s.queryFallback[name] = float64(index)
+}
+
+// setQueryMetricCount record how many metrics the query produced
+func (s *Server) setQueryMetricCount(name string, count int) {
+	s.queryStatsMtx.Lock()
+	defer s.queryStatsMtx.Unlock()
+	if s.queryScrapeMetricCount == nil {
+		s.queryScrapeMetricCount = map[string]float64{}
+	}
+	s.queryScrapeMetricCount[name] = float64(count)
 }
 
 func (s *Server) CheckConn() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	if s.db == nil || !s.UP {
-		return fmt.Errorf("not connect database")
+		return &ErrorConnectToServer{Msg: "not connect database"}
 	}
 	return nil
 }
 
+// isPrimary role of server, keepalive may refresh it concurrently
+func (s *Server) isPrimary() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.primary
+}
+
 func (s *Server) DBRole() string {
 	if s.primary {
 		return "primary"
@@ -228,14 +953,86 @@ func (s *Server) DBRole() string {
 
 func (s *Server) SetDBInfoMap(info map[string]*DBInfo) {
 	s.dbInfoMap = info
+	if s.compatibilityLabel {
+		s.setCompatibilityLabel()
+	}
+}
+
+// setCompatibilityLabel look up current database in dbInfoMap and set datcompatibility label
+func (s *Server) setCompatibilityLabel() {
+	dbInfo, ok := s.dbInfoMap[s.dbName]
+	if !ok || dbInfo == nil || dbInfo.Datcompatibility == "" {
+		s.updateLabels(nil, compatibilityLabelName)
+		return
+	}
+	s.updateLabels(prometheus.Labels{compatibilityLabelName: dbInfo.Datcompatibility})
+}
+
+// updateLabels set and remove labels of server. labels map is replaced under s.lock instead of modified in place,
+// so scrape holding the old one keeps a consistent view
+func (s *Server) updateLabels(set prometheus.Labels, remove ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	labels := make(prometheus.Labels, len(s.labels)+len(set))
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	for _, k := range remove {
+		delete(labels, k)
+	}
+	for k, v := range set {
+		labels[k] = v
+	}
+	s.labels = labels
 }
 
+// undefinedColumn SQLSTATE of referencing a column which does not exist
+const undefinedColumn = "42703"
+
 // QueryDatabases 连接数据查询监控指标
+// datcompatibility only exists on openGauss, fallback to query without it on other backends
 func (s *Server) QueryDatabases() (map[string]*DBInfo, error) {
-	rows, err := s.db.Query(`SELECT d.datname,pg_encoding_to_char(d.encoding) as og_charset, d.datcompatibility FROM pg_database d
-	WHERE d.datallowconn = true AND d.datistemplate = false`) // nolint: safesql
+	result, err := s.queryDatabases(`SELECT d.datname,pg_encoding_to_char(d.encoding) as og_charset, d.datcompatibility FROM pg_database d
+	WHERE d.datallowconn = true AND d.datistemplate = false`, true) // nolint: safesql
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == undefinedColumn {
+		log.Warnf("QueryDatabases on %s without datcompatibility: %s", s.fingerprint, err)
+		result, err = s.queryDatabases(`SELECT d.datname,pg_encoding_to_char(d.encoding) as og_charset FROM pg_database d
+	WHERE d.datallowconn = true AND d.datistemplate = false`, false) // nolint: safesql
+	}
+	return result, err
+}
+
+// QuerySchemas user schemas and public of current database, system and temporary schemas are left out.
+// 0 timeout means none
+func (s *Server) QuerySchemas(timeout time.Duration) ([]string, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT nspname FROM pg_namespace
+	WHERE (oid >= 16384 OR nspname = 'public') AND nspname !~ '^pg_'`) // nolint: safesql
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving schemas: %v", err)
+	}
+	defer rows.Close() // nolint: errcheck
+	var schemas []string
+	for rows.Next() {
+		var schema string
+		if err = rows.Scan(&schema); err != nil {
+			return nil, fmt.Errorf("Error retrieving schemas: %v", err)
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, rows.Err()
+}
+
+func (s *Server) queryDatabases(sqlText string, withCompatibility bool) (map[string]*DBInfo, error) {
+	rows, err := s.db.Query(sqlText)
 	if err != nil {
-		return nil, fmt.Errorf("Error retrieving databases: %v", err)
+		return nil, fmt.Errorf("Error retrieving databases: %w", err)
 	}
 	defer rows.Close() // nolint: errcheck
 
@@ -244,7 +1041,11 @@ func (s *Server) QueryDatabases() (map[string]*DBInfo, error) {
 		var (
 			databaseName, charset, datcompatibility string
 		)
-		err = rows.Scan(&databaseName, &charset, &datcompatibility)
+		if withCompatibility {
+			err = rows.Scan(&databaseName, &charset, &datcompatibility)
+		} else {
+			err = rows.Scan(&databaseName, &charset)
+		}
 		if err != nil {
 			return nil, errors.New(fmt.Sprintln("Error retrieving rows:", err))
 		}
@@ -271,15 +1072,31 @@ func (s *Server) getBaseInfo() error {
 	}
 	var (
 		versionString, clientEncoding, currentDatabase string
-		b                                              bool
+		b, primary                                     bool
+		err                                            error
 	)
-	sqlText := "SELECT version(),current_setting('client_encoding'),pg_is_in_recovery(),current_database()"
-	logrus.Debugf(sqlText)
-	err := s.db.QueryRow(sqlText).Scan(&versionString, &clientEncoding, &b, &currentDatabase)
-	if err != nil {
-		return err
+	if s.roleQuery == "" {
+		sqlText := "SELECT version(),current_setting('client_encoding'),pg_is_in_recovery(),current_database()"
+		logrus.Debugf(sqlText)
+		err = s.db.QueryRow(sqlText).Scan(&versionString, &clientEncoding, &b, &currentDatabase)
+		if err != nil {
+			return err
+		}
+		primary = !b
+	} else {
+		sqlText := "SELECT version(),current_setting('client_encoding'),current_database()"
+		logrus.Debugf(sqlText)
+		err = s.db.QueryRow(sqlText).Scan(&versionString, &clientEncoding, &currentDatabase)
+		if err != nil {
+			return err
+		}
+		if primary, err = s.queryRole(context.Background(), s.db); err != nil {
+			return err
+		}
 	}
-	s.primary = !b
+	s.lock.Lock()
+	s.primary = primary
+	s.lock.Unlock()
 	s.clientEncoding = clientEncoding
 	semanticVersion, err := parseVersionSem(versionString)
 	if err != nil {
@@ -288,30 +1105,290 @@ func (s *Server) getBaseInfo() error {
 	}
 	s.lastMapVersion = semanticVersion
 	s.dbName = currentDatabase
+	if s.nodeLabel {
+		s.setNodeLabel()
+	}
+	if s.systemLabels {
+		s.setSystemLabels()
+	}
+	s.recoveryState = s.probeRecoveryState()
 	return nil
 }
 
-func (s *Server) ConnectDatabase() error {
+// values of recovery_state, in_recovery only tells primary from standby
+const (
+	recoveryStatePrimary = iota
+	recoveryStateStandby
+	recoveryStateCascading
+	recoveryStateLogical
+)
+
+// probeRecoveryState tell cascading standby from physical standby by local_role of stream replication,
+// and logical replica from primary by active subscriptions. Failed probe falls back to primary/standby
+func (s *Server) probeRecoveryState() int {
+	if !s.primary {
+		var role string
+		sqlText := "SELECT local_role FROM pg_stat_get_stream_replications()"
+		logrus.Debugf(sqlText)
+		if err := s.db.QueryRow(sqlText).Scan(&role); err != nil {
+			log.Debugf("probe replication role on %s err %s, treat as standby", s.fingerprint, err)
+			return recoveryStateStandby
+		}
+		if strings.EqualFold(strings.TrimSpace(role), "cascade standby") {
+			return recoveryStateCascading
+		}
+		return recoveryStateStandby
+	}
+	var subscriptions int
+	sqlText := "SELECT count(*) FROM pg_stat_subscription WHERE pid IS NOT NULL"
+	logrus.Debugf(sqlText)
+	if err := s.db.QueryRow(sqlText).Scan(&subscriptions); err != nil {
+		log.Debugf("probe subscriptions on %s err %s, treat as primary", s.fingerprint, err)
+		return recoveryStatePrimary
+	}
+	if subscriptions > 0 {
+		return recoveryStateLogical
+	}
+	return recoveryStatePrimary
+}
+
+// recoveryStateMetric recovery_state gauge, 0 primary 1 physical standby 2 cascading standby 3 logical replica
+func (s *Server) recoveryStateMetric() prometheus.Metric {
+	desc := prometheus.NewDesc(s.fqName("", "recovery_state"),
+		"replication role of server, 0 for primary 1 for physical standby 2 for cascading standby 3 for logical standby",
+		nil, s.labels)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(s.recoveryState))
+}
+
+// setNodeLabel query local node from pgxc_node. pgxc_node absent or empty means single node deployment
+func (s *Server) setNodeLabel() {
+	var nodeName, nodeType string
+	sqlText := "SELECT node_name,node_type::text FROM pgxc_node WHERE node_name = current_setting('pgxc_node_name')"
+	logrus.Debugf(sqlText)
+	if err := s.db.QueryRow(sqlText).Scan(&nodeName, &nodeType); err != nil {
+		log.Debugf("query pgxc node on %s err %s, treat as single node", s.fingerprint, err)
+		s.nodeName = ""
+		s.updateLabels(nil, nodeNameLabelName, nodeTypeLabelName)
+		return
+	}
+	s.nodeName = nodeName
+	s.updateLabels(prometheus.Labels{nodeNameLabelName: nodeName, nodeTypeLabelName: parseNodeType(nodeType)})
+}
+
+// setSystemLabels query data directory and system identifier of instance once per connection. SHOW data_directory
+// needs privilege to read settings, pg_control_system() is absent on old versions. Both labels are always set,
+// label of failed query keeps value discovered last time, empty if never discovered
+func (s *Server) setSystemLabels() {
+	if s.systemLabelsDB == s.db {
+		return
+	}
+	s.systemLabelsDB = s.db
+	dataDirectory, systemID := s.labels[dataDirectoryLabelName], s.labels[systemIDLabelName]
+	var value string
+	sqlText := "SHOW data_directory"
+	logrus.Debugf(sqlText)
+	if err := s.db.QueryRow(sqlText).Scan(&value); err != nil {
+		log.Debugf("query data_directory on %s err %s, keep %q", s.fingerprint, err, dataDirectory)
+	} else {
+		dataDirectory = value
+	}
+	sqlText = "SELECT system_identifier::text FROM pg_control_system()"
+	logrus.Debugf(sqlText)
+	if err := s.db.QueryRow(sqlText).Scan(&value); err != nil {
+		log.Debugf("query system_identifier on %s err %s, keep %q", s.fingerprint, err, systemID)
+	} else {
+		systemID = value
+	}
+	s.updateLabels(prometheus.Labels{dataDirectoryLabelName: dataDirectory, systemIDLabelName: systemID})
+}
+
+// parseNodeType pgxc_node node_type, C coordinator D datanode
+func parseNodeType(nodeType string) string {
+	switch nodeType {
+	case "C":
+		return "coordinator"
+	case "D":
+		return "datanode"
+	default:
+		return nodeType
+	}
+}
+
+// queryRole run roleQuery on db, return true when database is primary
+func (s *Server) queryRole(ctx context.Context, db *sql.DB) (bool, error) {
+	var role interface{}
+	logrus.Debugf(s.roleQuery)
+	if err := db.QueryRowContext(ctx, s.roleQuery).Scan(&role); err != nil {
+		return false, fmt.Errorf("role query %s err %s", s.roleQuery, err)
+	}
+	return parseRole(role)
+}
+
+// parseRole map role query result to primary. boolean means in recovery, same as pg_is_in_recovery()
+func parseRole(role interface{}) (bool, error) {
+	v, ok := dbToString(role, false)
+	if !ok {
+		return false, fmt.Errorf("unsupported role type %T", role)
+	}
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "primary", "master", "normal", "main":
+		return true, nil
+	case "standby", "slave", "secondary", "cascade standby", "cascade_standby":
+		return false, nil
+	case "true", "t":
+		return false, nil
+	case "false", "f":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown role %q", v)
+}
+
+// openDB open database of dsn, through dialer if set
+func (s *Server) openDB() (*sql.DB, error) {
+	if s.dialer == nil && !s.tlsCertExpiry {
+		return sql.Open("opengauss", s.dsn)
+	}
+	config, err := pq.ParseConfig(s.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if s.dialer != nil {
+		config.DialFunc = s.dialer
+	}
+	if s.tlsCertExpiry {
+		s.watchCertExpiry(config)
+	}
+	connector, err := pq.NewConnectorConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+func (s *Server) ConnectDatabase() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer func() {
+		s.setConnError(err)
+		if err == nil {
+			s.startKeepAlive()
+		}
+	}()
 	if s.db != nil {
-		if err := s.Ping(); err == nil {
-			s.UP = true
-			return nil
+		if err := s.ping(); err == nil {
+			return s.checkUp()
 		}
 		s.db.Close()
 	}
-	db, err := sql.Open("opengauss", s.dsn)
+	db, err := s.openDB()
 	if err != nil {
 		s.UP = false
 		return err
 	}
 	s.db = db
-	if err = s.Ping(); err != nil {
+	s.connectedAt = time.Time{}
+	s.setCertExpiry(time.Time{})
+	s.resetPrivilegeCheck()
+	if err = s.ping(); err != nil {
 		s.UP = false
 		return err
 	}
+	s.connectedAt = time.Now()
 	s.db.SetConnMaxIdleTime(120 * time.Second)
 	s.db.SetMaxIdleConns(s.parallel)
 	// s.db.SetMaxOpenConns(s.parallel)
+	return s.checkUp()
+}
+
+// startKeepAlive run keepalive in background if enabled and not running yet
+func (s *Server) startKeepAlive() {
+	if s.keepAlive <= 0 {
+		return
+	}
+	s.keepAliveMtx.Lock()
+	defer s.keepAliveMtx.Unlock()
+	if s.keepAliveStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	s.keepAliveStop = stop
+	go func() {
+		ticker := time.NewTicker(s.keepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.keepAliveOnce()
+			}
+		}
+	}()
+}
+
+// stopKeepAlive stop keepalive goroutine if running
+func (s *Server) stopKeepAlive() {
+	s.keepAliveMtx.Lock()
+	defer s.keepAliveMtx.Unlock()
+	if s.keepAliveStop != nil {
+		close(s.keepAliveStop)
+		s.keepAliveStop = nil
+	}
+}
+
+// keepAliveOnce ping database and refresh role, server is marked down if ping fails
+func (s *Server) keepAliveOnce() {
+	s.lock.RLock()
+	db := s.db
+	s.lock.RUnlock()
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.keepAlive)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		log.Warnf("keepalive ping %s err %s, mark down", s.fingerprint, err)
+		s.lock.Lock()
+		s.UP = false
+		s.lock.Unlock()
+		return
+	}
+	var (
+		primary bool
+		err     error
+	)
+	if s.roleQuery != "" {
+		primary, err = s.queryRole(ctx, db)
+	} else {
+		var inRecovery bool
+		err = db.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery)
+		primary = !inRecovery
+	}
+	if err != nil {
+		log.Debugf("keepalive role query on %s err %s", s.fingerprint, err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if primary != s.primary {
+		log.Warnf("keepalive %s role changed, primary %v", s.fingerprint, primary)
+		s.primary = primary
+	}
+}
+
+// checkUp mark server up after ping succeeded, unless upQuery fails. s.lock must be held
+func (s *Server) checkUp() error {
+	if s.upQuery == "" {
+		s.UP = true
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), upQueryTimeout)
+	defer cancel()
+	logrus.Debugf(s.upQuery)
+	if _, err := s.db.ExecContext(ctx, s.upQuery); err != nil {
+		s.UP = false
+		return fmt.Errorf("up query %s err %s", s.upQuery, err)
+	}
 	s.UP = true
 	return nil
 }
@@ -323,8 +1400,6 @@ func NewServer(dsn string, opts ...ServerOpt) (*Server, error) {
 		return nil, err
 	}
 
-	log.Infof("Established new database connection to %q.", fingerprint)
-
 	s := &Server{
 		fingerprint: fingerprint,
 		dsn:         dsn,
@@ -332,12 +1407,36 @@ func NewServer(dsn string, opts ...ServerOpt) (*Server, error) {
 		labels: prometheus.Labels{
 			serverLabelName: fingerprint,
 		},
-		metricCache: make(map[string]*cachedMetrics),
+		metricCache:            make(map[string]*cachedMetrics),
+		queryScrapeMetricCount: make(map[string]float64),
+		maxLabelLength:         defaultMaxLabelLength,
 	}
+	ServerWithReconnectSQLStates(defaultReconnectSQLStates)(s)
 
 	for _, opt := range opts {
 		opt(s)
 	}
+	if s.fingerprintJoin != "" || s.socketFingerprint {
+		if fingerprint, err = parseFingerprintJoin(dsn, s.fingerprintJoin, s.socketFingerprint); err != nil {
+			return nil, err
+		}
+		s.fingerprint = fingerprint
+		s.labels[serverLabelName] = fingerprint
+	}
+	if s.targetLabelFromDSN {
+		target, err := parseDSNTarget(dsn)
+		if err != nil {
+			return nil, err
+		}
+		s.labels[serverLabelName] = target
+	}
+	if s.userLabel {
+		if dsnSetting, err := pq.ParseURLToMap(dsn); err == nil {
+			s.dbUser = dsnSetting[DSNUser]
+		}
+	}
+
+	log.Infof("Established new database connection to %q.", fingerprint)
 
 	if err = s.ConnectDatabase(); err != nil {
 		return s, err
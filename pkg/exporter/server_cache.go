@@ -11,6 +11,7 @@ type cachedMetrics struct {
 	metrics        []prometheus.Metric
 	lastScrape     time.Time
 	nonFatalErrors []error
+	emptyOK        bool // query succeeded with zero rows, still worth caching
 	err            error
 	name           string
 	collect        bool
@@ -24,6 +25,43 @@ func (c *cachedMetrics) IsValid(ttl float64) bool {
 	return !(time.Now().Sub(c.lastScrape).Seconds() >= ttl)
 }
 
+// servable true if cache holds result of a successful refresh
+func (c *cachedMetrics) servable() bool {
+	return c != nil && !c.lastScrape.IsZero() && c.err == nil && len(c.nonFatalErrors) == 0
+}
+
 func (c *cachedMetrics) IsCollect() bool {
 	return c.collect
 }
+
+// CacheEntryInfo summary of a cached metric, for debugging
+type CacheEntryInfo struct {
+	LastScrape     time.Time
+	MetricCount    int
+	NonFatalErrors bool
+}
+
+// CacheSnapshot returns summary of every cached metric, keyed by metric name
+func (s *Server) CacheSnapshot() map[string]CacheEntryInfo {
+	s.cacheMtx.Lock()
+	defer s.cacheMtx.Unlock()
+	snapshot := make(map[string]CacheEntryInfo, len(s.metricCache))
+	for name, c := range s.metricCache {
+		if c == nil {
+			continue
+		}
+		snapshot[name] = CacheEntryInfo{
+			LastScrape:     c.lastScrape,
+			MetricCount:    len(c.metrics),
+			NonFatalErrors: len(c.nonFatalErrors) > 0,
+		}
+	}
+	return snapshot
+}
+
+// FlushCache drop all cached metrics, next scrape query database again
+func (s *Server) FlushCache() {
+	s.cacheMtx.Lock()
+	defer s.cacheMtx.Unlock()
+	s.metricCache = make(map[string]*cachedMetrics)
+}
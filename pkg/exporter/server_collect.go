@@ -5,10 +5,13 @@ package exporter
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -33,45 +36,299 @@ import (
 // }
 
 func (s *Server) doCollectMetric(queryInstance *QueryInstance, conn *sql.Conn) ([]prometheus.Metric, []error, error) {
-	// 根据版本获取查询sql
-	query := queryInstance.GetQuerySQL(s.lastMapVersion, s.primary)
-	if query == nil {
+	if s.memoryExceeded() {
+		return []prometheus.Metric{}, []error{},
+			fmt.Errorf("Collect Metric [%s] on %s skipped, scrape memory budget %d bytes exceeded", queryInstance.Name, s.dbName, s.memBudget)
+	}
+	// 根据版本获取查询sql. Queries matching the same version are tried in order until one succeeds
+	queries := queryInstance.GetQuerySQLs(s.lastMapVersion, s.primary)
+	if len(queries) == 0 {
 		// Return success (no pertinent data)
 		return []prometheus.Metric{}, []error{}, nil
 	}
+	ctx := context.Background()
+	if queryInstance.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queryInstance.TotalTimeoutDuration())
+		defer cancel()
+	}
+	if !queryInstance.PerSchema {
+		return s.collectQueries(ctx, queryInstance, queries, conn)
+	}
+	// one round of candidates for every schema, failure of a schema does not drop others
+	var (
+		metrics        = []prometheus.Metric{}
+		nonFatalErrors = []error{}
+	)
+	for _, schema := range s.schemas {
+		if err := s.checkTotalTimeout(ctx, queryInstance, "schema "+schema); err != nil {
+			return []prometheus.Metric{}, []error{}, err
+		}
+		schemaMetrics, schemaErrors, err := s.collectQueries(ctx, queryInstance, bindSchema(queries, schema), conn)
+		metrics = append(metrics, schemaMetrics...)
+		nonFatalErrors = append(nonFatalErrors, schemaErrors...)
+		if err != nil {
+			nonFatalErrors = append(nonFatalErrors, fmt.Errorf("schema %s: %w", schema, err))
+		}
+	}
+	return metrics, nonFatalErrors, nil
+}
+
+// checkTotalTimeout error if TotalTimeout of query instance passed, at tells where collection stopped
+func (s *Server) checkTotalTimeout(ctx context.Context, queryInstance *QueryInstance, at string) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	log.Errorf("Collect Metric [%s] on %s total timeout %v, aborted at %s", queryInstance.Name, s.dbName, queryInstance.TotalTimeoutDuration(), at)
+	return newQueryError(ErrTimeout, ctx.Err(), "Collect Metric [%s] on %s total timeout %v, aborted at %s",
+		queryInstance.Name, s.dbName, queryInstance.TotalTimeoutDuration(), at)
+}
+
+// collectQueries try candidate queries in order until one succeeds
+func (s *Server) collectQueries(ctx context.Context, queryInstance *QueryInstance, queries []*Query, conn *sql.Conn) ([]prometheus.Metric, []error, error) {
+	var (
+		metrics        = []prometheus.Metric{}
+		nonFatalErrors = []error{}
+		err            error
+	)
+	for i, query := range queries {
+		if i > 0 && strings.EqualFold(query.Status, statusDisable) {
+			continue
+		}
+		if i > 0 {
+			if err := s.checkTotalTimeout(ctx, queryInstance, fmt.Sprintf("query %d", i)); err != nil {
+				return []prometheus.Metric{}, []error{}, err
+			}
+		}
+		metrics, nonFatalErrors, err = s.doCollectQuery(ctx, queryInstance, query, conn)
+		if err == nil {
+			if len(queries) > 1 {
+				s.setQueryFallback(queryInstance.Name, i)
+			}
+			if i > 0 {
+				s.setQuerySQL(queryInstance.Name, query.SQL)
+			}
+			s.explainQuery(ctx, queryInstance, query, conn)
+			break
+		}
+		if i < len(queries)-1 {
+			log.Warnf("Collect Metric [%s] on %s query %d failed, try next query: %s", queryInstance.Name, s.dbName, i, err)
+		}
+	}
+	return metrics, nonFatalErrors, err
+}
+
+// disambiguateColumns rename repeated column name by its occurrence, e.g. id, id_2, id_3.
+// Names repeated are returned in order of first appearance
+func disambiguateColumns(columnNames []string) ([]string, []string) {
+	seen := make(map[string]int, len(columnNames))
+	var duplicates []string
+	for _, n := range columnNames {
+		seen[n]++
+		if seen[n] == 2 {
+			duplicates = append(duplicates, n)
+		}
+	}
+	if len(duplicates) == 0 {
+		return columnNames, nil
+	}
+	names := make([]string, len(columnNames))
+	occurrence := make(map[string]int, len(columnNames))
+	for i, n := range columnNames {
+		occurrence[n]++
+		names[i] = n
+		if occurrence[n] > 1 {
+			names[i] = fmt.Sprintf("%s_%d", n, occurrence[n])
+		}
+	}
+	return names, duplicates
+}
 
+// beginQueryTx begin transaction with search_path and statement_timeout set, empty / 0 leaves them as is.
+// SET LOCAL only lasts in transaction, pooled connection keeps its own settings. Caller rolls it back
+func beginQueryTx(ctx context.Context, conn *sql.Conn, searchPath string, statementTimeout time.Duration) (*sql.Tx, error) {
+	var sets []string
+	if searchPath != "" {
+		sets = append(sets, "SET LOCAL search_path = "+searchPath)
+	}
+	if statementTimeout > 0 {
+		ms := statementTimeout.Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		sets = append(sets, fmt.Sprintf("SET LOCAL statement_timeout = %d", ms))
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction err %w", err)
+	}
+	if len(sets) == 0 {
+		return tx, nil
+	}
+	// one round trip for all settings
+	sqlText := strings.Join(sets, "; ")
+	if _, err = tx.ExecContext(ctx, sqlText); err != nil {
+		_ = tx.Rollback()
+		return nil, fmt.Errorf("exec %s err %w", sqlText, err)
+	}
+	return tx, nil
+}
+
+// queryPlanInterval query is explained at most once in it, plan diagnostics cost a round trip
+const queryPlanInterval = 10 * time.Minute
+
+// explainQuery record estimated total cost of query plan if plan diagnostics enabled and due. Plan is bound by
+// the same timeouts and search_path as the query itself. Failure is only logged
+func (s *Server) explainQuery(ctx context.Context, queryInstance *QueryInstance, query *Query, conn *sql.Conn) {
+	if !s.planDiagnostics || ctx.Err() != nil {
+		return
+	}
+	name := queryInstance.Name
+	s.planMtx.Lock()
+	if last, ok := s.planAt[name]; ok && time.Since(last) < queryPlanInterval {
+		s.planMtx.Unlock()
+		return
+	}
+	if s.planAt == nil {
+		s.planAt = map[string]time.Time{}
+	}
+	s.planAt[name] = time.Now()
+	s.planMtx.Unlock()
+
+	if query.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, query.TimeoutDuration())
+		defer cancel()
+	}
+	var querier interface {
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	} = conn
+	if queryInstance.SearchPath != "" {
+		tx, err := beginQueryTx(ctx, conn, queryInstance.SearchPath, 0)
+		if err != nil {
+			log.Debugf("Explain Metric [%s] on %s err %s", name, s.dbName, err)
+			return
+		}
+		defer tx.Rollback() // nolint: errcheck
+		querier = tx
+	}
+	var plan []byte
+	sqlText := "EXPLAIN (FORMAT JSON) " + strings.TrimSuffix(strings.TrimSpace(query.SQL), ";")
+	if err := querier.QueryRowContext(ctx, sqlText, query.Params...).Scan(&plan); err != nil {
+		log.Debugf("Explain Metric [%s] on %s err %s", name, s.dbName, err)
+		return
+	}
+	cost, err := parsePlanCost(plan)
+	if err != nil {
+		log.Debugf("Explain Metric [%s] on %s err %s", name, s.dbName, err)
+		return
+	}
+	s.planMtx.Lock()
+	defer s.planMtx.Unlock()
+	if s.planCost == nil {
+		s.planCost = map[string]float64{}
+	}
+	s.planCost[name] = cost
+}
+
+// parsePlanCost Total Cost of top level plan in output of EXPLAIN (FORMAT JSON)
+func parsePlanCost(plan []byte) (float64, error) {
+	var plans []struct {
+		Plan *struct {
+			TotalCost float64 `json:"Total Cost"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal(plan, &plans); err != nil {
+		return 0, fmt.Errorf("parse plan: %s", err)
+	}
+	if len(plans) == 0 || plans[0].Plan == nil {
+		return 0, fmt.Errorf("plan has no Total Cost")
+	}
+	return plans[0].Plan.TotalCost, nil
+}
+
+const schemaPlaceholder = "{{schema}}"
+
+// bindSchema copy queries with schema placeholder replaced by quoted schema name
+func bindSchema(queries []*Query, schema string) []*Query {
+	literal := "'" + strings.ReplaceAll(schema, "'", "''") + "'"
+	bound := make([]*Query, len(queries))
+	for i, query := range queries {
+		q := *query
+		q.SQL = strings.ReplaceAll(query.SQL, schemaPlaceholder, literal)
+		bound[i] = &q
+	}
+	return bound
+}
+
+// rowSize approximate bytes held by scanned values of row, text by its length and others by a word
+func rowSize(row []interface{}) int64 {
+	var size int64
+	for _, v := range row {
+		switch v := v.(type) {
+		case []byte:
+			size += int64(len(v))
+		case string:
+			size += int64(len(v))
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// doCollectQuery run one query of query instance and build metrics of its rows
+func (s *Server) doCollectQuery(ctx context.Context, queryInstance *QueryInstance, query *Query, conn *sql.Conn) ([]prometheus.Metric, []error, error) {
 	// Don't fail on a bad scrape of one metric
 	var (
 		rows       *sql.Rows
 		err        error
-		ctx        = context.Background()
+		total      = ctx
 		metricName = queryInstance.Name
 	)
+	// database aborts runaway query itself, even while it is still parsing or planning
+	var statementTimeout time.Duration
+	if query.Timeout > 0 && s.statementTimeout {
+		statementTimeout = query.TimeoutDuration()
+	}
 	begin := time.Now()
 	// TODO disable timeout
 	if query.Timeout > 0 { // if timeout is provided, use context
 		var cancel context.CancelFunc
 		log.Debugf("Collect Metric [%s] on %s query with time limit: %v", query.Name, s.dbName, query.TimeoutDuration())
-		ctx, cancel = context.WithTimeout(context.Background(), query.TimeoutDuration())
+		ctx, cancel = context.WithTimeout(ctx, query.TimeoutDuration())
 		defer cancel()
 	}
+	var querier interface {
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	} = conn
+	if queryInstance.SearchPath != "" || statementTimeout > 0 {
+		tx, err := beginQueryTx(context.Background(), conn, queryInstance.SearchPath, statementTimeout)
+		if err != nil {
+			return []prometheus.Metric{}, []error{},
+				newQueryError(queryErrorKind(err), err, "Collect Metric [%s] on %s %s ", metricName, s.dbName, err)
+		}
+		defer tx.Rollback() // nolint: errcheck
+		querier = tx
+	}
 	log.Debugf("Collect Metric [%s] on %s query sql %s ", queryInstance.Name, s.dbName, query.SQL)
 	// rows, err = s.execSQL(ctx, conn, query.SQL)
-	rows, err = conn.QueryContext(ctx, query.SQL)
+	rows, err = querier.QueryContext(ctx, query.SQL, query.Params...)
 	end := time.Now().Sub(begin).Milliseconds()
 
 	log.Debugf("Collect Metric [%s] on %s query using time %vms", queryInstance.Name, s.dbName, end)
 	if err != nil {
-		if strings.Contains(err.Error(), "context deadline exceeded") ||
-			strings.Contains(err.Error(), "canceling statement due to user request") ||
-			strings.Contains(err.Error(), "canceling query due to user request") {
-			log.Errorf("Collect Metric [%s] on %s query timeout %v", queryInstance.Name, s.dbName, query.TimeoutDuration())
-			err = fmt.Errorf("timeout %v %s", query.TimeoutDuration(), err)
+		kind, errText := queryErrorKind(err), err.Error()
+		if kind == ErrTimeout {
+			log.Debugf("Collect Metric [%s] on %s query timeout %v", queryInstance.Name, s.dbName, query.TimeoutDuration())
+			errText = fmt.Sprintf("timeout %v %s", query.TimeoutDuration(), err)
 		} else {
-			log.Errorf("Collect Metric [%s] on %s query err %s", queryInstance.Name, s.dbName, err)
+			// logged by caller through error log throttle
+			log.Debugf("Collect Metric [%s] on %s query err %s", queryInstance.Name, s.dbName, err)
+			s.reconnectOnError(err)
 		}
 		return []prometheus.Metric{}, []error{},
-			fmt.Errorf("Collect Metric [%s] on %s query err %s ", metricName, s.dbName, err)
+			newQueryError(kind, err, "Collect Metric [%s] on %s query err %s ", metricName, s.dbName, errText)
 	}
 	defer rows.Close()
 	var columnNames []string
@@ -81,6 +338,24 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance, conn *sql.Conn) (
 		log.Error(err)
 		return []prometheus.Metric{}, []error{}, err
 	}
+	if names, duplicates := disambiguateColumns(columnNames); len(duplicates) > 0 {
+		if s.strictColumns {
+			err := fmt.Errorf("collect Metric [%s] on %s duplicate columns %s", queryInstance.Name, s.dbName, strings.Join(duplicates, ","))
+			log.Error(err)
+			return []prometheus.Metric{}, []error{}, err
+		}
+		log.Warnf("Collect Metric [%s] on %s duplicate columns %s, renamed to %s",
+			queryInstance.Name, s.dbName, strings.Join(duplicates, ","), strings.Join(names, ","))
+		columnNames = names
+	}
+	if queryInstance.KeyValue {
+		if len(columnNames) != 2 {
+			err := fmt.Errorf("collect Metric [%s] on %s keyValue query returns %d columns, want name and value", queryInstance.Name, s.dbName, len(columnNames))
+			log.Error(err)
+			return []prometheus.Metric{}, []error{}, err
+		}
+		columnNames = []string{keyValueName, keyValueValue}
+	}
 
 	// Make a lookup map for the column indices
 	var columnIdx = make(map[string]int, len(columnNames))
@@ -89,7 +364,20 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance, conn *sql.Conn) (
 	}
 	nonfatalErrors := []error{}
 	var list [][]interface{}
+	maxRows := query.MaxRows
+	if maxRows <= 0 {
+		maxRows = s.maxRows
+	}
 	for rows.Next() {
+		if err := s.checkTotalTimeout(total, queryInstance, fmt.Sprintf("row %d", len(list))); err != nil {
+			return []prometheus.Metric{}, []error{}, err
+		}
+		if maxRows > 0 && len(list) >= maxRows {
+			err = fmt.Errorf("collect Metric [%s] on %s row limit %d exceeded", queryInstance.Name, s.dbName, maxRows)
+			log.Warn(err)
+			nonfatalErrors = append(nonfatalErrors, err)
+			break
+		}
 		var columnData = make([]interface{}, len(columnNames))
 		var scanArgs = make([]interface{}, len(columnNames))
 		for i := range columnData {
@@ -98,28 +386,79 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance, conn *sql.Conn) (
 		err = rows.Scan(scanArgs...)
 		if err != nil {
 			log.Errorf("Collect Metric [%s] on %s fetch rows.Scan err %s", queryInstance.Name, s.dbName, err)
-			nonfatalErrors = append(nonfatalErrors, err)
+			nonfatalErrors = append(nonfatalErrors, fmt.Errorf("query %s row %d scan err %s", queryInstance.Name, len(list), err))
 			break
 		}
+		if err = s.chargeMemory(rowSize(columnData)); err != nil {
+			// drop rows of this query, so the memory is released
+			err = fmt.Errorf("collect Metric [%s] on %s aborted at row %d: %s", queryInstance.Name, s.dbName, len(list), err)
+			log.Error(err)
+			return []prometheus.Metric{}, []error{}, err
+		}
 		list = append(list, columnData)
 	}
+	// fetch canceled by total timeout is not a partial result
+	if err := s.checkTotalTimeout(total, queryInstance, fmt.Sprintf("row %d", len(list))); err != nil {
+		return []prometheus.Metric{}, []error{}, err
+	}
+	// rows fetched before an error or the row limit still produce metrics, the error is nonfatal
+	partial := len(nonfatalErrors) > 0
 	if err = rows.Err(); err != nil {
-		log.Debugf("Collect Metric [%s] on %s fetch data rows.Err() %s", metricName, s.dbName, err)
-		nonfatalErrors = append(nonfatalErrors, err)
+		log.Warnf("Collect Metric [%s] on %s fetch data rows.Err() %s, keep %d rows fetched", metricName, s.dbName, err, len(list))
+		nonfatalErrors = append(nonfatalErrors, fmt.Errorf("query %s row %d fetch err %s", queryInstance.Name, len(list), err))
+		partial = true
 	}
 	end = time.Now().Sub(begin).Milliseconds()
 	log.Debugf("Collect Metric [%s] on %s fetch total time %vms", queryInstance.Name, s.dbName, end)
 
-	metrics := make([]prometheus.Metric, 0)
+	// completing a partial result would report rows never fetched as zero
+	if len(queryInstance.Completions) > 0 && !partial {
+		list = queryInstance.completeRows(columnNames, columnIdx, list)
+	}
+	var latency string
+	if s.latencyLabel {
+		latency = latencyBucket(end)
+	}
+	// metrics of each row, a row repeating the label set of an earlier one replaces its metrics
+	rowMetrics := make([][]prometheus.Metric, 0, len(list))
+	labelSets := make(map[string]int, len(list))
 	for i := range list {
-		metric, errs := s.procRows(queryInstance, columnNames, columnIdx, list[i])
+		if err := s.checkTotalTimeout(total, queryInstance, fmt.Sprintf("processing row %d", i)); err != nil {
+			return []prometheus.Metric{}, []error{}, err
+		}
+		labels := s.rowLabels(queryInstance, columnIdx, list[i])
+		slot := len(rowMetrics)
+		if len(labels) > 0 || len(queryInstance.keyColumns) > 0 {
+			key := strings.Join(labels, "\xff")
+			for _, name := range queryInstance.keyColumns {
+				if idx, ok := columnIdx[name]; ok {
+					raw, _ := dbToString(list[i][idx], false)
+					key += "\xff" + raw
+				}
+			}
+			if earlier, ok := labelSets[key]; ok {
+				// same label set would be rejected by prometheus, keep the last row like --dedup-metrics
+				log.Warnf("Collect Metric [%s] on %s row %d duplicate label set %v of an earlier row, replaces it",
+					queryInstance.Name, s.dbName, i, labels)
+				slot = earlier
+			} else {
+				labelSets[key] = slot
+			}
+		}
+		metric, errs := s.procRowLatency(queryInstance, columnNames, list[i], labels, latency)
 		if len(errs) > 0 {
 			nonfatalErrors = append(nonfatalErrors, errs...)
 		}
-		if metric != nil {
-			metrics = append(metrics, metric...)
+		if slot < len(rowMetrics) {
+			rowMetrics[slot] = metric
+		} else {
+			rowMetrics = append(rowMetrics, metric)
 		}
 	}
+	metrics := make([]prometheus.Metric, 0)
+	for _, metric := range rowMetrics {
+		metrics = append(metrics, metric...)
+	}
 	return metrics, nonfatalErrors, nil
 }
 
@@ -129,6 +468,9 @@ func (s *Server) decode(queryInstance *QueryInstance, data interface{}, label, d
 	if col == nil {
 		return v, nil
 	}
+	if data == nil && col.NullLabelValue != "" {
+		return col.NullLabelValue, nil
+	}
 	if !col.CheckUTF8 {
 		return v, nil
 	}
@@ -164,40 +506,270 @@ func (s *Server) decode(queryInstance *QueryInstance, data interface{}, label, d
 }
 
 func (s *Server) procRows(queryInstance *QueryInstance, columnNames []string, columnIdx map[string]int, columnData []interface{}) ([]prometheus.Metric, []error) {
-	// Get the label values for this row.
-	metrics := make([]prometheus.Metric, 0)
-	nonfatalErrors := []error{}
+	return s.procRowLabels(queryInstance, columnNames, columnData, s.rowLabels(queryInstance, columnIdx, columnData))
+}
+
+// rowLabels Get the label values for this row.
+func (s *Server) rowLabels(queryInstance *QueryInstance, columnIdx map[string]int, columnData []interface{}) []string {
 	labels := make([]string, len(queryInstance.LabelNames))
 	var dbName string
 	dbNameLabel := queryInstance.dbNameLabel
-	if dbNameLabel != "" {
-		dbName, _ = dbToString(columnData[columnIdx[dbNameLabel]], s.timeToString)
+	if i, ok := columnIdx[dbNameLabel]; ok && dbNameLabel != "" {
+		dbName, _ = dbToString(columnData[i], s.timeToString)
 	}
 	for idx, label := range queryInstance.LabelNames {
-		v, err := s.decode(queryInstance, columnData[columnIdx[label]], label, dbName)
+		i, ok := columnIdx[label]
+		if !ok {
+			// declared label absent from result, e.g. column dropped in another version, treat as NULL
+			if _, logged := s.missingLog.LoadOrStore(queryInstance.Name+"."+label, true); !logged {
+				log.Warnf("Collect Metric [%s] on %s label column %s missing from result", queryInstance.Name, s.dbName, label)
+			}
+			labels[idx], _ = s.decode(queryInstance, nil, label, dbName)
+			continue
+		}
+		v, err := s.decode(queryInstance, columnData[i], label, dbName)
 		if err != nil {
 			log.Errorf("decode %s", err)
 		}
+		if col, ok := queryInstance.Columns[label]; ok {
+			v = col.normalize(v)
+		}
+		if truncated, ok := truncateLabelValue(v, s.maxLabelLength); ok {
+			log.Debugf("Collect Metric [%s] on %s label %s value truncated to %d", queryInstance.Name, s.dbName, label, s.maxLabelLength)
+			v = truncated
+		}
 		labels[idx] = v
 	}
+	return labels
+}
+
+func (s *Server) procRowLabels(queryInstance *QueryInstance, columnNames []string, columnData []interface{}, labels []string) ([]prometheus.Metric, []error) {
+	return s.procRowLatency(queryInstance, columnNames, columnData, labels, "")
+}
+
+// procRowLatency like procRowLabels, metric of latency column of query is labeled with latency bucket if not empty
+func (s *Server) procRowLatency(queryInstance *QueryInstance, columnNames []string, columnData []interface{},
+	labels []string, latency string) ([]prometheus.Metric, []error) {
+	metrics := make([]prometheus.Metric, 0)
+	nonfatalErrors := []error{}
+	family, err := queryInstance.rowFamily(columnNames, columnData)
+	if err != nil {
+		// metrics of row without family would mix into declared ones
+		log.Warnf("Collect Metric [%s] on %s %s, row dropped", queryInstance.Name, s.dbName, err)
+		return metrics, append(nonfatalErrors, err)
+	}
+	timestamp, err := queryInstance.rowTimestamp(columnNames, columnData)
+	if err != nil {
+		nonfatalErrors = append(nonfatalErrors, err)
+	}
+	jsonNames, jsonValues, err := s.rowJSONLabels(queryInstance, columnNames, columnData)
+	if err != nil {
+		log.Warnf("Collect Metric [%s] on %s %s", queryInstance.Name, s.dbName, err)
+		nonfatalErrors = append(nonfatalErrors, err)
+	}
+	if len(jsonNames) > 0 {
+		labels = append(append(make([]string, 0, len(labels)+len(jsonValues)), labels...), jsonValues...)
+	}
 	// Loop over column names, and match to scan data. Unknown columns
 	// will be filled with an untyped metric number *if* they can be
 	// converted to float64s. NULLs are allowed and treated as NaN.
-	for idx, columnName := range columnNames {
-		col := queryInstance.GetColumn(columnName, s.labels)
-		metric, err := s.newMetric(queryInstance, col, columnName, columnData[idx], labels)
+	latencyColumn := ""
+	if latency != "" {
+		latencyColumn = queryInstance.latencyColumn()
+	}
+	for _, idx := range queryInstance.columnOrder(columnNames) {
+		columnName := columnNames[idx]
+		extraLabels, colLabels := jsonNames, labels
+		if columnName == latencyColumn {
+			extraLabels = append(jsonNames[:len(jsonNames):len(jsonNames)], latencyLabelName)
+			colLabels = append(labels[:len(labels):len(labels)], latency)
+		}
+		col := queryInstance.getColumn(columnName, s.labels, rowDesc{extraLabels: extraLabels, family: family, renamer: s.renamer})
+		if queryInstance.isPivot(columnName) {
+			colLabels = append(colLabels[:len(colLabels):len(colLabels)], columnName)
+		}
+		var metric prometheus.Metric
+		if col != nil && col.Histogram && col.Counts != "" {
+			metric, err = s.newHistogramMetric(queryInstance, col, columnNames, columnData, idx, colLabels)
+		} else {
+			metric, err = s.newMetric(queryInstance, col, columnName, columnData[idx], colLabels)
+		}
 		if err != nil {
 			log.Errorf("newMetric %s", err)
 			nonfatalErrors = append(nonfatalErrors, err)
 			continue
 		}
 		if metric != nil {
+			if !timestamp.IsZero() {
+				metric = prometheus.NewMetricWithTimestamp(timestamp, metric)
+			}
 			metrics = append(metrics, metric)
 		}
 	}
 	return metrics, nonfatalErrors
 }
 
+// latencyLabelName label of bucketed query latency, see ServerWithLatencyLabel
+const latencyLabelName = "scrape_latency_ms"
+
+// latencyLabelBuckets upper bounds in milliseconds, query latency is rounded up to them to bound cardinality
+var latencyLabelBuckets = []int64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// latencyBucket smallest bucket not less than latency, +Inf beyond the last one
+func latencyBucket(ms int64) string {
+	for _, bucket := range latencyLabelBuckets {
+		if ms <= bucket {
+			return strconv.FormatInt(bucket, 10)
+		}
+	}
+	return "+Inf"
+}
+
+// rowJSONLabels expand declared keys of JSON_LABELS columns into label names and values, in declared order.
+// Keys absent or holding nested values are labeled empty, so every row carries the same labels.
+// Keys clashing with server labels are skipped
+func (s *Server) rowJSONLabels(q *QueryInstance, columnNames []string, columnData []interface{}) (names, values []string, err error) {
+	if len(q.jsonLabels) == 0 {
+		return nil, nil, nil
+	}
+	for _, columnName := range q.jsonLabels {
+		col := q.Columns[columnName]
+		var obj map[string]interface{}
+		for idx := range columnNames {
+			if columnNames[idx] != columnName || columnData[idx] == nil {
+				continue
+			}
+			text, _ := dbToString(columnData[idx], false)
+			if text == "" {
+				break
+			}
+			decoder := json.NewDecoder(strings.NewReader(text))
+			decoder.UseNumber()
+			if e := decoder.Decode(&obj); e != nil {
+				err = fmt.Errorf("query %s column %s value is not a JSON object: %s", q.Name, columnName, e)
+				obj = nil
+			}
+			break
+		}
+		for _, key := range col.Keys {
+			name := sanitizeName(key)
+			if _, ok := s.labels[name]; ok {
+				log.Debugf("query %s column %s key %s clashes with server label, skipped", q.Name, columnName, key)
+				continue
+			}
+			var value string
+			switch v := obj[key].(type) {
+			case nil:
+				if _, ok := obj[key]; ok {
+					value = col.NullLabelValue
+				}
+			case string:
+				value = v
+			case json.Number:
+				value = v.String()
+			case bool:
+				value = fmt.Sprint(v)
+			default:
+				log.Debugf("query %s column %s key %s is not a scalar value, labeled empty", q.Name, columnName, key)
+			}
+			if truncated, ok := truncateLabelValue(value, s.maxLabelLength); ok {
+				value = truncated
+			}
+			names, values = append(names, name), append(values, value)
+		}
+	}
+	return names, values, err
+}
+
+// rowFamily metric family of row selected by FamilyColumn, empty if not set
+func (q *QueryInstance) rowFamily(columnNames []string, columnData []interface{}) (string, error) {
+	if q.FamilyColumn == "" {
+		return "", nil
+	}
+	for idx, columnName := range columnNames {
+		if columnName != q.FamilyColumn {
+			continue
+		}
+		if v, _ := dbToString(columnData[idx], false); v != "" {
+			return sanitizeName(v), nil
+		}
+		return "", fmt.Errorf("query %s family column %s is empty", q.Name, columnName)
+	}
+	return "", fmt.Errorf("query %s family column %s not found in result", q.Name, q.FamilyColumn)
+}
+
+// rowTimestamp sample timestamp of row from TimestampColumn, zero time if not set or NULL
+func (q *QueryInstance) rowTimestamp(columnNames []string, columnData []interface{}) (time.Time, error) {
+	if q.TimestampColumn == "" {
+		return time.Time{}, nil
+	}
+	for idx, columnName := range columnNames {
+		if columnName != q.TimestampColumn {
+			continue
+		}
+		switch v := columnData[idx].(type) {
+		case nil:
+			return time.Time{}, nil
+		case time.Time:
+			return v, nil
+		default:
+			return time.Time{}, fmt.Errorf("query %s timestamp column %s value %v is not time type", q.Name, columnName, v)
+		}
+	}
+	return time.Time{}, fmt.Errorf("query %s timestamp column %s not found in result", q.Name, q.TimestampColumn)
+}
+
+// newHistogramMetric cumulative histogram from bucket bounds array of column idx and per bucket counts array
+// of its counts column. Arrays of different length, bounds not strictly increasing and counts not
+// a non-negative integer are rejected
+func (s *Server) newHistogramMetric(queryInstance *QueryInstance, col *Column, columnNames []string, columnData []interface{},
+	idx int, labels []string) (metric prometheus.Metric, err error) {
+	var counts, sum interface{}
+	for i, name := range columnNames {
+		switch name {
+		case col.Counts:
+			counts = columnData[i]
+		case col.Sum:
+			sum = columnData[i]
+		}
+	}
+	columnName := columnNames[idx]
+	bounds, err := parseFloatArray(columnData[idx])
+	if err != nil {
+		return nil, fmt.Errorf("query %s histogram %s bounds: %s", queryInstance.Name, columnName, err)
+	}
+	bucketCounts, err := parseFloatArray(counts)
+	if err != nil {
+		return nil, fmt.Errorf("query %s histogram %s counts: %s", queryInstance.Name, columnName, err)
+	}
+	if len(bounds) != len(bucketCounts) {
+		return nil, fmt.Errorf("query %s histogram %s has %d bounds but %d counts", queryInstance.Name, columnName, len(bounds), len(bucketCounts))
+	}
+	var (
+		buckets = make(map[float64]uint64, len(bounds))
+		count   uint64
+		sumV    float64
+	)
+	for i, bound := range bounds {
+		if math.IsNaN(bound) || (i > 0 && !(bound > bounds[i-1])) {
+			return nil, fmt.Errorf("query %s histogram %s bounds %v not strictly increasing", queryInstance.Name, columnName, bounds)
+		}
+		c := bucketCounts[i]
+		if math.IsNaN(c) || math.IsInf(c, 0) || c < 0 || c != math.Trunc(c) {
+			return nil, fmt.Errorf("query %s histogram %s bucket %v count %v is not a non-negative integer", queryInstance.Name, columnName, bound, c)
+		}
+		count += uint64(c)
+		buckets[bound] = count
+	}
+	if col.Sum != "" {
+		if v, ok := dbToFloat64(sum); ok && !math.IsNaN(v) {
+			sumV = v
+		}
+	}
+	defer RecoverErr(&err)
+	return prometheus.MustNewConstHistogram(col.PrometheusDesc, count, sumV, buckets, labels...), nil
+}
+
 func (s *Server) newMetric(queryInstance *QueryInstance, col *Column, columnName string, colValue interface{},
 	labels []string) (metric prometheus.Metric, err error) {
 	var (
@@ -221,10 +793,24 @@ func (s *Server) newMetric(queryInstance *QueryInstance, col *Column, columnName
 	}
 	desc = col.PrometheusDesc
 	valueType = col.PrometheusType
-	value, valueOK = dbToFloat64(colValue)
+	if strings.EqualFold(col.Usage, INFO) {
+		v, _ := dbToString(colValue, s.timeToString)
+		s.addInfoValue(metricName+"_"+columnName, v)
+		defer RecoverErr(&err)
+		metric = prometheus.MustNewConstMetric(desc, valueType, 1, append(append(make([]string, 0, len(labels)+1), labels...), v)...)
+		return metric, nil
+	}
+	if strings.EqualFold(col.Usage, LSN) {
+		value, valueOK = lsnToFloat64(colValue)
+	} else {
+		value, valueOK = dbToFloat64(colValue)
+	}
 	if !valueOK {
 		return nil, errors.New(fmt.Sprintln("Unexpected error parsing column: ", metricName, columnName, colValue))
 	}
+	if exceedsFloat64Precision(colValue) {
+		s.addPrecisionLoss(metricName, columnName, colValue)
+	}
 	defer RecoverErr(&err)
 	metric = prometheus.MustNewConstMetric(desc, valueType, value, labels...)
 	return metric, nil
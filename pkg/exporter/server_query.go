@@ -8,12 +8,16 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+const connRetries = 3
+
 type metricError struct {
 	lock   sync.Mutex
 	Errors map[string]error
@@ -29,14 +33,22 @@ func (e *metricError) addError(metricName string, err error) {
 
 // ScrapeWithMetric loads metrics.
 func (s *Server) ScrapeWithMetric(ch chan<- prometheus.Metric, queryMetric map[string]*QueryInstance) error {
+	_, err := s.scrapeWithMetric(ch, queryMetric)
+	return err
+}
+
+// scrapeWithMetric like ScrapeWithMetric, errors of failed queries are returned by name as well
+func (s *Server) scrapeWithMetric(ch chan<- prometheus.Metric, queryMetric map[string]*QueryInstance) (map[string]error, error) {
 	if err := s.CheckConn(); err != nil {
-		return err
+		return nil, err
 	}
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	// deferred in reverse, internal metrics are collected after connection is closed for reconnect
 	defer func() {
 		s.collectorServerInternalMetrics(ch)
 	}()
+	defer s.closeOnReconnect()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	s.scrapeBegin = time.Now()
 	var err error
 	if !s.disableSettingsMetrics && !s.notCollInternalMetrics {
@@ -48,7 +60,7 @@ func (s *Server) ScrapeWithMetric(ch chan<- prometheus.Metric, queryMetric map[s
 	if len(errMap) > 0 {
 		err = fmt.Errorf("queryMetrics returned %d errors", len(errMap))
 	}
-	return err
+	return errMap, err
 }
 
 // 查询监控指标. 先判断是否读取缓存. 禁用缓存或者缓存超时,则读取数据库
@@ -63,9 +75,67 @@ func (s *Server) queryMetrics(ch chan<- prometheus.Metric, queryMetric map[strin
 			Errors: map[string]error{},
 			Count:  0,
 		}
+		sessionErr    error // last session setup failure, reason of queries skipped
+		sessionErrMtx sync.Mutex
 	)
+	queueBegin := time.Now()
+	s.setQueueDepth(len(queryMetric))
+	// outermost, suppress what dedup and derived metrics finally emit
+	if s.deltaOnly {
+		out, deltaCh, forwarded := ch, make(chan prometheus.Metric), make(chan struct{})
+		go func() {
+			defer close(forwarded)
+			s.forwardChanged(out, deltaCh)
+		}()
+		defer func() {
+			close(deltaCh)
+			<-forwarded
+		}()
+		ch = deltaCh
+	}
+	// buffer metrics of this scrape, so a repeated name and label set keeps the last one only
+	if s.dedupMetrics {
+		out, buffered, received := ch, []prometheus.Metric{}, make(chan struct{})
+		dedupCh := make(chan prometheus.Metric)
+		go func() {
+			defer close(received)
+			for m := range dedupCh {
+				buffered = append(buffered, m)
+			}
+		}()
+		defer func() {
+			close(dedupCh)
+			<-received
+			metrics, suppressed := dedupSamples(buffered)
+			if suppressed > 0 {
+				log.Warnf("scrape on %s emitted %d duplicate metrics, suppressed keeping the last", s.dbName, suppressed)
+			}
+			for _, m := range metrics {
+				out <- m
+			}
+		}()
+		ch = dedupCh
+	}
+	// record emitted values for derived metrics, which are evaluated after all base metrics
+	if hasDerivedMetrics(queryMetric) {
+		out, samples, forwarded := ch, newSampleSet(s.labels, s.derivedSources(queryMetric)), make(chan struct{})
+		recordCh := make(chan prometheus.Metric)
+		go func() {
+			defer close(forwarded)
+			for m := range recordCh {
+				samples.add(m)
+				out <- m
+			}
+		}()
+		defer func() {
+			close(recordCh)
+			<-forwarded
+			s.emitDerivedMetrics(out, samples, queryMetric)
+		}()
+		ch = recordCh
+	}
 	go func() {
-		for _, metric := range queryMetric {
+		for _, metric := range sortByPriority(queryMetric) {
 			metricChan <- metric
 		}
 		close(metricChan)
@@ -74,26 +144,245 @@ func (s *Server) queryMetrics(ch chan<- prometheus.Metric, queryMetric map[strin
 	for i := 0; i < parallel; i++ {
 		go func(workNum int) {
 			defer wg.Done()
-			conn, err := s.db.Conn(context.Background())
+			conn, err := s.getConn()
 			if err != nil {
+				log.Errorf("worker %d get conn on %s err %s", workNum, s.dbName, err)
+				metricErrors.addError(fmt.Sprintf("worker %d conn", workNum),
+					newQueryError(ErrConnection, err, "worker %d get conn on %s err %s", workNum, s.dbName, err))
 				return
 			}
 			defer conn.Close()
-			s.startQueryMetricThread(conn, ch, metricChan, metricErrors)
+			if err = s.setupSession(conn); err != nil {
+				log.Errorf("worker %d setup session on %s err %s", workNum, s.dbName, err)
+				metricErrors.addError(fmt.Sprintf("worker %d session", workNum),
+					newQueryError(queryErrorKind(err), err, "worker %d setup session on %s err %s", workNum, s.dbName, err))
+				sessionErrMtx.Lock()
+				sessionErr = err
+				sessionErrMtx.Unlock()
+				return
+			}
+			s.startQueryMetricThread(conn, ch, metricChan, metricErrors, queueBegin)
 		}(i)
 	}
 	wg.Wait()
+	// all workers gone, metrics left in channel were never queried
+	for metric := range metricChan {
+		if sessionErr != nil {
+			metricErrors.addError(metric.Name, fmt.Errorf("Collect Metric [%s] on %s skipped, setup session err %w", metric.Name, s.dbName, sessionErr))
+			continue
+		}
+		metricErrors.addError(metric.Name, fmt.Errorf("Collect Metric [%s] on %s skipped, no available conn", metric.Name, s.dbName))
+	}
 	s.ScrapeErrorCount = metricErrors.Count
 	return metricErrors.Errors
 }
 
-func (s *Server) startQueryMetricThread(conn *sql.Conn, ch chan<- prometheus.Metric, metricChan chan *QueryInstance, metricErrors *metricError) error {
+// forwardChanged forward metrics whose sample differs from the one emitted in last scrape, series new or
+// absent in last scrape included. Unchanged series are missing from scrape, prometheus marks them stale
+func (s *Server) forwardChanged(out chan<- prometheus.Metric, in <-chan prometheus.Metric) {
+	s.deltaMtx.Lock()
+	defer s.deltaMtx.Unlock()
+	var (
+		values     = make(map[string]string, len(s.deltaValues))
+		suppressed int
+	)
+	for m := range in {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			out <- m
+			continue
+		}
+		key, sample := metricKey(m), pb.String()
+		values[key] = sample
+		if last, ok := s.deltaValues[key]; ok && last == sample {
+			suppressed++
+			continue
+		}
+		out <- m
+	}
+	s.deltaValues = values
+	log.Debugf("scrape on %s suppressed %d unchanged metrics", s.dbName, suppressed)
+}
+
+// dedupSamples drop metrics with the same name and labels as a later one, order of the kept is preserved
+func dedupSamples(metrics []prometheus.Metric) ([]prometheus.Metric, int) {
+	keys := make([]string, len(metrics))
+	last := make(map[string]int, len(metrics))
+	for i, m := range metrics {
+		keys[i] = metricKey(m)
+		last[keys[i]] = i
+	}
+	kept := make([]prometheus.Metric, 0, len(last))
+	for i, m := range metrics {
+		if last[keys[i]] == i {
+			kept = append(kept, m)
+		}
+	}
+	return kept, len(metrics) - len(kept)
+}
+
+// metricKey identify metric by desc and label values
+func metricKey(m prometheus.Metric) string {
+	pb := &dto.Metric{}
+	if err := m.Write(pb); err != nil {
+		return m.Desc().String()
+	}
+	labels := make(map[string]string, len(pb.Label))
+	for _, pair := range pb.Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return m.Desc().String() + "\xff" + labelsKey(labels)
+}
+
+func hasDerivedMetrics(queryMetric map[string]*QueryInstance) bool {
+	for _, q := range queryMetric {
+		if len(q.DerivedMetrics) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// derivedSources emitted name of metrics referenced by derived metrics -> name referenced, renamed by --metric-rename
+func (s *Server) derivedSources(queryMetric map[string]*QueryInstance) map[string]string {
+	names := map[string]string{}
+	for _, q := range queryMetric {
+		for _, d := range q.DerivedMetrics {
+			if d.expr == nil {
+				continue
+			}
+			for _, name := range d.expr.names() {
+				names[renameMetric(s.renamer, name)] = name
+			}
+		}
+	}
+	return names
+}
+
+// emitDerivedMetrics evaluate derived metrics of query instances over samples of this scrape
+func (s *Server) emitDerivedMetrics(ch chan<- prometheus.Metric, samples *sampleSet, queryMetric map[string]*QueryInstance) {
+	for _, q := range sortByPriority(queryMetric) {
+		for _, d := range q.DerivedMetrics {
+			if d.expr == nil {
+				continue
+			}
+			for _, m := range samples.derive(renameMetric(s.renamer, q.Name+"_"+d.Name), d) {
+				ch <- m
+			}
+		}
+	}
+}
+
+// sortByPriority order query instances by Priority, so cheap metrics configured with small priority emit first.
+// Priority 0 means not set and goes last, ties are ordered by name
+func sortByPriority(queryMetric map[string]*QueryInstance) []*QueryInstance {
+	list := make([]*QueryInstance, 0, len(queryMetric))
+	for _, metric := range queryMetric {
+		list = append(list, metric)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		pi, pj := list[i].Priority, list[j].Priority
+		if pi != pj {
+			if pi == 0 || pj == 0 {
+				return pj == 0
+			}
+			return pi < pj
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// getConn get conn from pool, retry connRetries times before give up
+func (s *Server) getConn() (conn *sql.Conn, err error) {
+	for i := 0; i < connRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+		}
+		if conn, err = s.db.Conn(context.Background()); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// readOnlySessionSQL make transactions of session read only, database rejects writes of queries
+const readOnlySessionSQL = "SET SESSION CHARACTERISTICS AS TRANSACTION READ ONLY"
+
+// setupSession run sessionSetup statements on conn. Run on every acquisition, since pooled conn can not be told apart
+func (s *Server) setupSession(conn *sql.Conn) error {
+	for _, sqlText := range s.sessionSetup {
+		log.Debugf("setup session on %s sql %s", s.dbName, sqlText)
+		if _, err := conn.ExecContext(context.Background(), sqlText); err != nil {
+			return fmt.Errorf("exec %s err %w", sqlText, err)
+		}
+	}
+	return nil
+}
+
+// checkPrivilege probe whether monitoring role can read relations the query requires, and its extension is installed.
+// Probed once per connection, inaccessible query is disabled instead of failing every scrape
+func (s *Server) checkPrivilege(queryInstance *QueryInstance, conn *sql.Conn) bool {
+	if len(queryInstance.Requires) == 0 && queryInstance.Extension == "" {
+		return true
+	}
+	s.privilegeMtx.Lock()
+	defer s.privilegeMtx.Unlock()
+	if s.privilegeChecked == nil {
+		s.privilegeChecked = map[string]bool{}
+		s.disabledQueries = map[string]string{}
+	}
+	if s.privilegeChecked[queryInstance.Name] {
+		_, disabled := s.disabledQueries[queryInstance.Name]
+		return !disabled
+	}
+	s.privilegeChecked[queryInstance.Name] = true
+	for _, relation := range queryInstance.Requires {
+		var ok bool
+		err := conn.QueryRowContext(context.Background(), "SELECT has_table_privilege($1, 'SELECT')", relation).Scan(&ok)
+		if err != nil || !ok {
+			reason := fmt.Sprintf("no SELECT privilege on %s", relation)
+			if err != nil {
+				reason = fmt.Sprintf("check privilege on %s err %s", relation, err)
+			}
+			log.Warnf("Collect Metric %s on %s disabled, %s", queryInstance.Name, s.dbName, reason)
+			s.disabledQueries[queryInstance.Name] = reason
+			return false
+		}
+	}
+	if extension := queryInstance.Extension; extension != "" {
+		var installed bool
+		err := conn.QueryRowContext(context.Background(), "SELECT count(*) > 0 FROM pg_extension WHERE extname = $1", extension).Scan(&installed)
+		if err != nil || !installed {
+			reason := fmt.Sprintf("extension %s is not installed", extension)
+			if err != nil {
+				reason = fmt.Sprintf("check extension %s err %s", extension, err)
+			}
+			log.Warnf("Collect Metric %s on %s disabled, %s", queryInstance.Name, s.dbName, reason)
+			s.disabledQueries[queryInstance.Name] = reason
+			return false
+		}
+	}
+	return true
+}
+
+// resetPrivilegeCheck probe privileges again on new connection, maybe granted meanwhile
+func (s *Server) resetPrivilegeCheck() {
+	s.privilegeMtx.Lock()
+	defer s.privilegeMtx.Unlock()
+	s.privilegeChecked, s.disabledQueries = nil, nil
+}
+
+func (s *Server) startQueryMetricThread(conn *sql.Conn, ch chan<- prometheus.Metric, metricChan chan *QueryInstance,
+	metricErrors *metricError, queueBegin time.Time) error {
 	for {
 		select {
 		case metric, ok := <-metricChan:
 			if !ok {
 				return nil
 			}
+			// all instances are queued at scrape begin
+			s.observeQueueWait(time.Since(queueBegin))
 			err := s.queryMetric(ch, metric, conn)
 			if err != nil {
 				// 存在并发写入问题. 改成结构体加锁
@@ -103,6 +392,14 @@ func (s *Server) startQueryMetricThread(conn *sql.Conn, ch chan<- prometheus.Met
 	}
 }
 
+// queryCacheKey metric name, with bound parameters appended if any, so results of different parameters are cached apart
+func queryCacheKey(metricName string, query *Query) string {
+	if len(query.Params) == 0 {
+		return metricName
+	}
+	return fmt.Sprintf("%s%v", metricName, query.Params)
+}
+
 func (s *Server) queryMetric(ch chan<- prometheus.Metric, queryInstance *QueryInstance, conn *sql.Conn) error {
 	var (
 		metricName     = queryInstance.Name
@@ -116,22 +413,38 @@ func (s *Server) queryMetric(ch chan<- prometheus.Metric, queryInstance *QueryIn
 	querySQL := queryInstance.GetQuerySQL(s.lastMapVersion, s.primary)
 	if querySQL == nil {
 		log.Warnf("Collect Metric %s not define querySQL for version %s on %s database ", metricName, s.lastMapVersion.String(), s.DBRole())
+		if queryInstance.matchVersion(s.lastMapVersion) {
+			s.addQuerySkipped(metricName, skipReasonDBRole)
+		} else {
+			s.addQuerySkipped(metricName, skipReasonVersion)
+		}
 		return nil
 	}
 	if strings.EqualFold(querySQL.Status, statusDisable) {
 		log.Debugf("Collect Metric %s disable. skip", metricName)
+		s.addQuerySkipped(metricName, skipReasonDisabled)
+		return nil
+	}
+	if queryInstance.Distributed && s.nodeName == "" {
+		log.Debugf("Collect Metric %s only on distributed deployment. skip", metricName)
+		return nil
+	}
+	if !s.checkPrivilege(queryInstance, conn) {
+		log.Debugf("Collect Metric %s disabled by privilege check. skip", metricName)
 		return nil
 	}
 
 	// 记录采集总个数
 	s.ScrapeTotalCount++
+	s.setQuerySQL(metricName, querySQL.SQL)
 
+	cacheKey := queryCacheKey(metricName, querySQL)
 	// Determine whether to enable caching and cache expiration 判断是否启用缓存和缓存过期
 	if !s.disableCache {
 		var found bool
 		// Check if the metric is cached
 		s.cacheMtx.Lock()
-		cachedMetric, found = s.metricCache[metricName]
+		cachedMetric, found = s.metricCache[cacheKey]
 		s.cacheMtx.Unlock()
 		// If found, check if needs refresh from cache
 		if !found {
@@ -139,14 +452,34 @@ func (s *Server) queryMetric(ch chan<- prometheus.Metric, queryInstance *QueryIn
 		} else if !cachedMetric.IsValid(querySQL.TTL) {
 			scrapeMetric = true
 		}
-		if cachedMetric != nil && (len(cachedMetric.nonFatalErrors) > 0 || len(cachedMetric.metrics) == 0) {
+		// errored or empty without confirm, scrape again. Empty but valid result is served from cache until ttl
+		if cachedMetric != nil && (len(cachedMetric.nonFatalErrors) > 0 || (len(cachedMetric.metrics) == 0 && !cachedMetric.emptyOK)) {
 			scrapeMetric = true
 		}
 	} else {
 		scrapeMetric = true
 	}
+	// Query database at most once in min interval, even if cache disabled or expired
+	if scrapeMetric && querySQL.MinInterval > 0 {
+		s.cacheMtx.Lock()
+		lastMetric, found := s.metricCache[cacheKey]
+		s.cacheMtx.Unlock()
+		if found && time.Now().Sub(lastMetric.lastScrape) < querySQL.MinIntervalDuration() {
+			scrapeMetric = false
+			cachedMetric = lastMetric
+		}
+	}
 	if scrapeMetric {
 		metrics, nonFatalErrors, err = s.doCollectMetric(queryInstance, conn)
+		if err != nil && s.staleFactor > 0 && cachedMetric.servable() {
+			// keep serving last good result until it is staleFactor times ttl old, then let series go stale
+			if cachedMetric.IsValid(querySQL.TTL * s.staleFactor) {
+				log.Warnf("Collect Metric [%s] on %s refresh failed, serve cache of %v", metricName, s.dbName, cachedMetric.lastScrape)
+				metrics, scrapeMetric = cachedMetric.metrics, false
+			} else {
+				log.Warnf("Collect Metric [%s] on %s refresh failed, cache of %v is stale, not emitted", metricName, s.dbName, cachedMetric.lastScrape)
+			}
+		}
 	} else {
 		log.Debugf("Collect Metric [%s] on %s use cache", metricName, s.dbName)
 		metrics, nonFatalErrors = cachedMetric.metrics, cachedMetric.nonFatalErrors
@@ -155,30 +488,45 @@ func (s *Server) queryMetric(ch chan<- prometheus.Metric, queryInstance *QueryIn
 	// Serious error - a namespace disappeared
 	if err != nil {
 		nonFatalErrors = append(nonFatalErrors, err)
-		log.Errorf("Collect Metric [%s] on %s err %s", metricName, s.dbName, err)
 	}
 	// Non-serious errors - likely version or parsing problems.
 	if len(nonFatalErrors) > 0 {
+		logErr, suppressed := s.allowErrorLog(metricName, len(nonFatalErrors))
+		if logErr && err != nil {
+			log.Errorf("Collect Metric [%s] on %s err %s", metricName, s.dbName, err)
+		}
+		if suppressed > 0 {
+			log.Errorf("Collect Metric [%s] on %s %d errors suppressed in last %v", metricName, s.dbName, suppressed, s.errorLogInterval)
+		}
 		var errText string
 		for _, err := range nonFatalErrors {
-			log.Errorf("Collect Metric [%s] %s nonFatalErrors err %s", metricName, s.dbName, err)
+			if logErr {
+				log.Errorf("Collect Metric [%s] %s nonFatalErrors err %s", metricName, s.dbName, err)
+			}
 			errText += err.Error()
 		}
-		err = errors.New(errText)
+		if len(nonFatalErrors) == 1 {
+			// keep typed error, e.g. QueryError
+			err = nonFatalErrors[0]
+		} else {
+			err = errors.New(errText)
+		}
 	}
 
 	// Emit the metrics into the channel
 	for _, m := range metrics {
 		ch <- m
 	}
+	s.setQueryMetricCount(metricName, len(metrics))
 
-	if scrapeMetric && queryInstance.TTL > 0 {
+	if scrapeMetric && (queryInstance.TTL > 0 || querySQL.MinInterval > 0) {
 		// Only cache if metric is meaningfully cacheable
 		s.cacheMtx.Lock()
-		s.metricCache[metricName] = &cachedMetrics{
+		s.metricCache[cacheKey] = &cachedMetrics{
 			metrics:        metrics,
 			lastScrape:     time.Now(), // 改为查询完时间
 			nonFatalErrors: nonFatalErrors,
+			emptyOK:        len(metrics) == 0 && len(nonFatalErrors) == 0,
 		}
 		s.cacheMtx.Unlock()
 	}
@@ -4,12 +4,29 @@ package exporter
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
+	"errors"
 	"fmt"
+	pq "gitee.com/opengauss/openGauss-connector-go-pq"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/blang/semver"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"math"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -67,6 +84,20 @@ func Test_dbToFloat64(t *testing.T) {
 			want:  0.0,
 			want1: true,
 		},
+		{name: "string_t", args: args{t: "t"}, want: 1.0, want1: true},
+		{name: "string_f", args: args{t: "f"}, want: 0.0, want1: true},
+		{name: "string_true", args: args{t: "TRUE"}, want: 1.0, want1: true},
+		{name: "string_false", args: args{t: "false"}, want: 0.0, want1: true},
+		{name: "string_on", args: args{t: "on"}, want: 1.0, want1: true},
+		{name: "string_off", args: args{t: "off"}, want: 0.0, want1: true},
+		{name: "string_yes", args: args{t: "Yes"}, want: 1.0, want1: true},
+		{name: "string_no", args: args{t: "no"}, want: 0.0, want1: true},
+		{name: "string_enabled", args: args{t: "enabled"}, want: 1.0, want1: true},
+		{name: "string_disabled", args: args{t: "disabled"}, want: 0.0, want1: true},
+		{name: "[]byte_t", args: args{t: []byte("t")}, want: 1.0, want1: true},
+		{name: "[]byte_off", args: args{t: []byte("off")}, want: 0.0, want1: true},
+		{name: "[]byte_enabled", args: args{t: []byte("enabled")}, want: 1.0, want1: true},
+		{name: "[]byte_no", args: args{t: []byte("no")}, want: 0.0, want1: true},
 		// {
 		// 	name:"nil",
 		// 	args: args{t: nil},
@@ -179,6 +210,36 @@ func genMockDB(t *testing.T, s *Server) (*sql.Conn, sqlmock.Sqlmock) {
 
 }
 
+// cleanupLogHook logtest.Hook which stops recording once its test finished
+type cleanupLogHook struct {
+	*logtest.Hook
+	mtx  sync.Mutex
+	done bool
+}
+
+func (h *cleanupLogHook) Fire(e *logrus.Entry) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.done {
+		return nil
+	}
+	return h.Hook.Fire(e)
+}
+
+// newLogHook record log entries of global logger until test finished. Global logger has no way
+// to remove a hook, so it is disabled on cleanup instead
+func newLogHook(t *testing.T) *logtest.Hook {
+	hook := &cleanupLogHook{Hook: new(logtest.Hook)}
+	log.AddHook(hook)
+	t.Cleanup(func() {
+		hook.mtx.Lock()
+		defer hook.mtx.Unlock()
+		hook.done = true
+		hook.Reset()
+	})
+	return hook.Hook
+}
+
 func Test_Server(t *testing.T) {
 	var (
 		db  *sql.DB
@@ -224,12 +285,85 @@ func Test_Server(t *testing.T) {
 		assert.Equal(t, "a1", s.namespace)
 		ServerWithDisableSettingsMetrics(false)(s)
 		assert.Equal(t, false, s.disableSettingsMetrics)
+		ServerWithTextSettingsAsInfo(true)(s)
+		assert.Equal(t, true, s.textSettingsAsInfo)
 		ServerWithDisableCache(false)(s)
 		assert.Equal(t, false, s.disableCache)
 		ServerWithTimeToString(false)(s)
 		assert.Equal(t, false, s.timeToString)
 		ServerWithParallel(2)(s)
 		assert.Equal(t, 2, s.parallel)
+		ServerWithCompatibilityLabel(true)(s)
+		assert.Equal(t, true, s.compatibilityLabel)
+		ServerWithNodeLabel(true)(s)
+		assert.Equal(t, true, s.nodeLabel)
+		ServerWithUpQuery("select 1")(s)
+		assert.Equal(t, "select 1", s.upQuery)
+		s.upQuery = ""
+		ServerWithFingerprintJoin(",")(s)
+		assert.Equal(t, ",", s.fingerprintJoin)
+		ServerWithMetricRenamer(strings.ToUpper)(s)
+		assert.NotNil(t, s.renamer)
+		s.renamer = nil
+		ServerWithSocketFingerprint(true)(s)
+		assert.Equal(t, true, s.socketFingerprint)
+		s.socketFingerprint = false
+		ServerWithExposeQuerySQL(true)(s)
+		assert.Equal(t, true, s.exposeQuerySQL)
+		s.exposeQuerySQL = false
+		ServerWithScrapeMemoryBudget(1024)(s)
+		assert.Equal(t, int64(1024), s.memBudget)
+		s.memBudget = 0
+		ServerWithDedupMetrics(true)(s)
+		assert.Equal(t, true, s.dedupMetrics)
+		s.dedupMetrics = false
+		ServerWithSystemLabels(true)(s)
+		assert.Equal(t, true, s.systemLabels)
+		s.systemLabels = false
+		ServerWithStaleFactor(2)(s)
+		assert.Equal(t, float64(2), s.staleFactor)
+		s.staleFactor = 0
+		ServerWithTargetError(true)(s)
+		assert.Equal(t, true, s.targetError)
+		s.targetError = false
+		ServerWithKeepAlive(time.Minute)(s)
+		assert.Equal(t, time.Minute, s.keepAlive)
+		s.keepAlive = 0
+		ServerWithQueryPlanDiagnostics(true)(s)
+		assert.Equal(t, true, s.planDiagnostics)
+		s.planDiagnostics = false
+		ServerWithStrictColumns(true)(s)
+		assert.Equal(t, true, s.strictColumns)
+		s.strictColumns = false
+		ServerWithTargetLabelFromDSN(true)(s)
+		assert.Equal(t, true, s.targetLabelFromDSN)
+		s.targetLabelFromDSN = false
+		ServerWithConfigChecksum([]string{"wal_level"})(s)
+		assert.Equal(t, []string{"wal_level"}, s.checksumSettings)
+		s.checksumSettings = nil
+		ServerWithDeltaOnly(true)(s)
+		assert.Equal(t, true, s.deltaOnly)
+		s.deltaOnly = false
+		ServerWithUserLabel(true)(s)
+		assert.Equal(t, true, s.userLabel)
+		s.userLabel = false
+		ServerWithLatencyLabel(true)(s)
+		assert.Equal(t, true, s.latencyLabel)
+		ServerWithRoleQuery("select 'primary'")(s)
+		assert.Equal(t, "select 'primary'", s.roleQuery)
+		ServerWithMaxLabelLength(10)(s)
+		assert.Equal(t, 10, s.maxLabelLength)
+		ServerWithMaxRows(1000)(s)
+		assert.Equal(t, 1000, s.maxRows)
+		ServerWithStatementTimeout(true)(s)
+		assert.Equal(t, true, s.statementTimeout)
+		s.statementTimeout = false
+		ServerWithErrorLogInterval(time.Minute)(s)
+		assert.Equal(t, time.Minute, s.errorLogInterval)
+		ServerWithReconnectSQLStates([]string{"57p01", " 57P03", ""})(s)
+		assert.Equal(t, []string{"57P01", "57P03"}, s.reconnectSQLStates)
+		ServerWithSessionSetup([]string{"SET ROLE monitor"})(s)
+		assert.Equal(t, []string{"SET ROLE monitor"}, s.sessionSetup)
 	})
 	t.Run("Close", func(t *testing.T) {
 		db, mock, err = sqlmock.New()
@@ -291,6 +425,91 @@ omm,UTF8,A`))
 		}
 		assert.Equal(t, e, r)
 	})
+	t.Run("QueryDatabases_without_datcompatibility", func(t *testing.T) {
+		db, mock, err = sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if err != nil {
+			t.Error(err)
+		}
+		s.db = db
+		mock.ExpectQuery("SELECT d.datname").WillReturnError(
+			&pq.Error{Code: "42703", Message: "column d.datcompatibility does not exist"})
+		mock.ExpectQuery("SELECT d.datname").WillReturnRows(
+			sqlmock.NewRows([]string{"datname", "encoding"}).FromCSVString(`postgres,UTF8
+omm,GBK`))
+		r, err := s.QueryDatabases()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]*DBInfo{
+			"postgres": {DBName: "postgres", Charset: "UTF8"},
+			"omm":      {DBName: "omm", Charset: "GBK"},
+		}, r)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("QueryDatabases_err", func(t *testing.T) {
+		db, mock, err = sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if err != nil {
+			t.Error(err)
+		}
+		s.db = db
+		mock.ExpectQuery("SELECT d.datname").WillReturnError(fmt.Errorf(`permission denied for relation pg_database`))
+		_, err := s.QueryDatabases()
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("QuerySchemas", func(t *testing.T) {
+		db, mock, err = sqlmock.New()
+		if err != nil {
+			t.Error(err)
+		}
+		s.db = db
+		mock.ExpectQuery(regexp.QuoteMeta("AND nspname !~ '^pg_'")).WillReturnRows(
+			sqlmock.NewRows([]string{"nspname"}).AddRow("public").AddRow("app"))
+		schemas, err := s.QuerySchemas(time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"public", "app"}, schemas)
+		// discovery is bounded by timeout
+		mock.ExpectQuery("SELECT nspname").WillDelayFor(time.Second).WillReturnRows(
+			sqlmock.NewRows([]string{"nspname"}).AddRow("public"))
+		_, err = s.QuerySchemas(10 * time.Millisecond)
+		assert.Error(t, err)
+	})
+	t.Run("QueryDatabases_missing_relation", func(t *testing.T) {
+		db, mock, err = sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if err != nil {
+			t.Error(err)
+		}
+		s.db = db
+		// only a missing column falls back, other "does not exist" errors are returned
+		mock.ExpectQuery("SELECT d.datname").WillReturnError(
+			&pq.Error{Code: "42P01", Message: "relation pg_database does not exist"})
+		_, err := s.QueryDatabases()
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("SetDBInfoMap_compatibilityLabel", func(t *testing.T) {
+		s := &Server{
+			dbName:             "db_b",
+			compatibilityLabel: true,
+			labels: prometheus.Labels{
+				"server": "localhost:5432",
+			},
+		}
+		dbInfoMap := map[string]*DBInfo{
+			"postgres": {DBName: "postgres", Charset: "UTF8", Datcompatibility: "A"},
+			"db_b":     {DBName: "db_b", Charset: "UTF8", Datcompatibility: "B"},
+		}
+		s.SetDBInfoMap(dbInfoMap)
+		assert.Equal(t, "B", s.labels[compatibilityLabelName])
+		s.dbName = "postgres"
+		s.SetDBInfoMap(dbInfoMap)
+		assert.Equal(t, "A", s.labels[compatibilityLabelName])
+		// labels are replaced, not modified under a scrape still holding them
+		old := s.labels
+		s.dbName = "unknown"
+		s.SetDBInfoMap(dbInfoMap)
+		_, ok := s.labels[compatibilityLabelName]
+		assert.False(t, ok)
+		assert.Equal(t, "A", old[compatibilityLabelName])
+	})
 	t.Run("getBaseInfo", func(t *testing.T) {
 		db, mock, err = sqlmock.New(sqlmock.MonitorPingsOption(true))
 		if err != nil {
@@ -307,6 +526,58 @@ omm,UTF8,A`))
 		assert.Equal(t, "UTF8", s.clientEncoding)
 		assert.Equal(t, true, s.primary)
 	})
+	t.Run("getBaseInfo_roleQuery", func(t *testing.T) {
+		db, mock, err = sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if err != nil {
+			t.Error(err)
+		}
+		s.db = db
+		s.UP = true
+		s.roleQuery = "SELECT local_role FROM pg_stat_get_stream_replications()"
+		defer func() {
+			s.roleQuery = ""
+		}()
+		mock.ExpectQuery("SELECT version").WillReturnRows(
+			sqlmock.NewRows([]string{"version", "client_encoding", "Name"}).AddRow(
+				"PostgreSQL 9.2.4 (openGauss 2.0.0 build 78689da9)", "UTF8", "postgres"))
+		mock.ExpectQuery("SELECT local_role").WillReturnRows(
+			sqlmock.NewRows([]string{"local_role"}).AddRow("Standby"))
+		err := s.getBaseInfo()
+		assert.NoError(t, err)
+		assert.Equal(t, false, s.primary)
+		assert.Equal(t, "postgres", s.dbName)
+
+		mock.ExpectQuery("SELECT version").WillReturnRows(
+			sqlmock.NewRows([]string{"version", "client_encoding", "Name"}).AddRow(
+				"PostgreSQL 9.2.4 (openGauss 2.0.0 build 78689da9)", "UTF8", "postgres"))
+		mock.ExpectQuery("SELECT local_role").WillReturnRows(
+			sqlmock.NewRows([]string{"local_role"}).AddRow("Primary"))
+		err = s.getBaseInfo()
+		assert.NoError(t, err)
+		assert.Equal(t, true, s.primary)
+
+		mock.ExpectQuery("SELECT version").WillReturnRows(
+			sqlmock.NewRows([]string{"version", "client_encoding", "Name"}).AddRow(
+				"PostgreSQL 9.2.4 (openGauss 2.0.0 build 78689da9)", "UTF8", "postgres"))
+		mock.ExpectQuery("SELECT local_role").WillReturnRows(
+			sqlmock.NewRows([]string{"local_role"}).AddRow("Unknown"))
+		err = s.getBaseInfo()
+		assert.Error(t, err)
+	})
+	t.Run("parseRole", func(t *testing.T) {
+		for role, want := range map[interface{}]bool{
+			true:      false,
+			false:     true,
+			"t":       false,
+			"primary": true,
+			"Main":    true,
+			"standby": false,
+		} {
+			got, err := parseRole(role)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got, "%v", role)
+		}
+	})
 	t.Run("doCollectMetric", func(t *testing.T) {
 		conn, mock := genMockDB(t, s)
 		mock.ExpectQuery("SELECT").WillReturnRows(
@@ -331,6 +602,24 @@ postgres,AccessExclusiveLock,0`))
 		assert.ElementsMatch(t, errs, []error{})
 		assert.NotNil(t, metrics)
 	})
+	t.Run("procRows_maxLabelLength", func(t *testing.T) {
+		s.maxLabelLength = 10
+		defer func() {
+			s.maxLabelLength = 0
+		}()
+		metrics, errs := s.procRows(queryInstance, []string{"datname", "mode", "count"},
+			map[string]int{"datname": 0, "mode": 1, "count": 2},
+			[]interface{}{"postgres", "ShareUpdateExclusiveLock", int64(1)})
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 1, len(metrics))
+		pb := &dto.Metric{}
+		_ = metrics[0].Write(pb)
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "mode" {
+				assert.Equal(t, "ShareUpda…", l.GetValue())
+			}
+		}
+	})
 	t.Run("doCollectMetric_NoTimeOut", func(t *testing.T) {
 		conn, mock := genMockDB(t, s)
 		queryInstance.Queries[0].Timeout = 0
@@ -404,6 +693,46 @@ postgres,AccessExclusiveLock,0`))
 		assert.ElementsMatch(t, []error{}, errs)
 		assert.ElementsMatch(t, []prometheus.Metric{}, metrics)
 	})
+	t.Run("doCollectMetric_maxRows", func(t *testing.T) {
+		rows := `postgres,AccessShareLock,4
+omm,RowShareLock,0
+postgres,ShareRowExclusiveLock,0
+postgres,ShareLock,0`
+		s.maxRows = 2
+		defer func() {
+			s.maxRows = 0
+		}()
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT").WillReturnRows(
+			sqlmock.NewRows([]string{"datname", "mode", "count"}).FromCSVString(rows))
+		metrics, errs, err := s.doCollectMetric(queryInstance, conn)
+		assert.NoError(t, err)
+		assert.Len(t, metrics, 2)
+		if assert.Len(t, errs, 1) {
+			assert.Contains(t, errs[0].Error(), "row limit 2 exceeded")
+		}
+
+		// query maxRows overrides server default
+		queryInstance.Queries[0].MaxRows = 3
+		defer func() {
+			queryInstance.Queries[0].MaxRows = 0
+		}()
+		mock.ExpectQuery("SELECT").WillReturnRows(
+			sqlmock.NewRows([]string{"datname", "mode", "count"}).FromCSVString(rows))
+		metrics, errs, err = s.doCollectMetric(queryInstance, conn)
+		assert.NoError(t, err)
+		assert.Len(t, metrics, 3)
+		assert.Len(t, errs, 1)
+
+		// result within limit
+		s.maxRows, queryInstance.Queries[0].MaxRows = 4, 0
+		mock.ExpectQuery("SELECT").WillReturnRows(
+			sqlmock.NewRows([]string{"datname", "mode", "count"}).FromCSVString(rows))
+		metrics, errs, err = s.doCollectMetric(queryInstance, conn)
+		assert.NoError(t, err)
+		assert.Len(t, metrics, 4)
+		assert.Len(t, errs, 0)
+	})
 	t.Run("doCollectMetric_pg_stat_replication", func(t *testing.T) {
 		queryInstance = pgStatReplication
 		queryInstance.Queries[0].Timeout = 100
@@ -429,6 +758,37 @@ postgres,AccessExclusiveLock,0`))
 			fmt.Printf("%#v\n", m)
 		}
 	})
+	t.Run("doCollectMetric_pg_stat_replication_lag_bytes", func(t *testing.T) {
+		queryInstance = pgStatReplication
+		if queries := queryInstance.GetQuerySQLs(semver.MustParse("2.0.0"), true); assert.Len(t, queries, 1) {
+			assert.Contains(t, queries[0].SQL, "pg_xlog_location_diff(pg_current_xlog_location(), receiver_replay_location)::float end) AS replication_lag_bytes")
+		}
+		// unparsed version tries xlog naming first, wal naming only after it failed
+		if queries := queryInstance.GetQuerySQLs(semver.MustParse("0.0.0"), true); assert.Len(t, queries, 2) {
+			assert.Contains(t, queries[0].SQL, "pg_current_xlog_location()")
+			assert.Contains(t, queries[1].SQL, "pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn)::float end) AS replication_lag_bytes")
+			assert.NotContains(t, queries[1].SQL, "AS pg_wal_lsn_diff")
+		}
+		for _, version := range []semver.Version{semver.MustParse("2.0.0"), semver.MustParse("0.0.0")} {
+			s.lastMapVersion = version
+			conn, mock := genMockDB(t, s)
+			if version.Equals(semver.MustParse("0.0.0")) {
+				mock.ExpectQuery("pg_current_xlog_location").WillReturnError(fmt.Errorf(`function pg_current_xlog_location() does not exist`))
+			}
+			mock.ExpectQuery("SELECT").WillReturnRows(
+				sqlmock.NewRows([]string{"application_name", "client_addr", "state", "replication_lag_bytes"}).
+					AddRow("WalSender to Standby", "192.168.122.92", "Streaming", 16777216.0))
+			metrics, errs, err := s.doCollectMetric(queryInstance, conn)
+			assert.NoError(t, err)
+			assert.Len(t, errs, 0)
+			if assert.Len(t, metrics, 1, version.String()) {
+				pb := &dto.Metric{}
+				assert.NoError(t, metrics[0].Write(pb))
+				assert.Contains(t, metrics[0].Desc().String(), "pg_stat_replication_replication_lag_bytes")
+				assert.Equal(t, float64(16777216), pb.GetGauge().GetValue())
+			}
+		}
+	})
 	t.Run("doCollectMetric_col_nil", func(t *testing.T) {
 		queryInstance = &QueryInstance{
 			Name: "a1",
@@ -597,6 +957,38 @@ postgres,AccessExclusiveLock,0`))
 		err = s.queryMetric(ch, q, conn)
 		assert.NoError(t, err)
 	})
+	t.Run("queryMetric_query_cache_empty", func(t *testing.T) {
+		var (
+			ch = make(chan prometheus.Metric, 100)
+			q  = &QueryInstance{
+				Name: "pg_database_empty",
+				Desc: "OpenGauss Database size",
+				Queries: []*Query{
+					{
+						SQL:     `SELECT datname,size_bytes from dual`,
+						Version: ">=0.0.0",
+					},
+				},
+				Metrics: []*Column{
+					{Name: "datname", Usage: LABEL, Desc: "Name of this database"},
+					{Name: "size_bytes", Usage: GAUGE, Desc: "Disk space used by the database"},
+				},
+				TTL: 10,
+			}
+		)
+		_ = q.Check()
+		s.disableCache = false
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"datname", "size_bytes"}))
+		err := s.queryMetric(ch, q, conn)
+		assert.NoError(t, err)
+		assert.True(t, s.metricCache["pg_database_empty"].emptyOK)
+		// served from cache, no query expected
+		err = s.queryMetric(ch, q, conn)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, 0, len(ch))
+	})
 	t.Run("queryMetric_standby", func(t *testing.T) {
 		var (
 			ch = make(chan prometheus.Metric, 100)
@@ -622,6 +1014,52 @@ postgres,AccessExclusiveLock,0`))
 		assert.NoError(t, err)
 		assert.Equal(t, 0, len(ch))
 	})
+	t.Run("queryMetric_metric_count", func(t *testing.T) {
+		var (
+			ch = make(chan prometheus.Metric, 100)
+			q  = &QueryInstance{
+				Name: "pg_database_count",
+				Desc: "OpenGauss Database size",
+				Queries: []*Query{
+					{
+						SQL:     `SELECT datname,size_bytes,age from dual`,
+						Version: ">=0.0.0",
+					},
+				},
+				Metrics: []*Column{
+					{Name: "datname", Usage: LABEL, Desc: "Name of this database"},
+					{Name: "size_bytes", Usage: GAUGE, Desc: "Disk space used by the database"},
+					{Name: "age", Usage: GAUGE, Desc: "Age of database"},
+				},
+			}
+		)
+		_ = q.Check()
+		s.disableCache = true
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT").WillReturnRows(
+			sqlmock.NewRows([]string{"datname", "size_bytes", "age"}).
+				AddRow("postgres", 1, 10).
+				AddRow("omm", 2, 20).
+				AddRow("test", 3, 30))
+		err := s.queryMetric(ch, q, conn)
+		assert.NoError(t, err)
+		assert.Equal(t, 6, len(ch))
+		assert.Equal(t, float64(len(ch)), s.queryScrapeMetricCount["pg_database_count"])
+
+		internalCh := make(chan prometheus.Metric, 100)
+		s.collectQueryInternalMetrics(internalCh)
+		close(internalCh)
+		var found bool
+		for m := range internalCh {
+			pb := &dto.Metric{}
+			_ = m.Write(pb)
+			if pb.GetLabel()[0].GetValue() == "pg_database_count" {
+				found = true
+				assert.Equal(t, float64(6), pb.GetGauge().GetValue())
+			}
+		}
+		assert.True(t, found)
+	})
 	t.Run("queryMetrics", func(t *testing.T) {
 		var (
 			ch          = make(chan prometheus.Metric, 100)
@@ -661,6 +1099,121 @@ postgres,AccessExclusiveLock,0`))
 		errs := s.queryMetrics(ch, queryInstanceMap)
 		assert.Equal(t, 0, len(errs))
 	})
+	t.Run("queryMetrics_sessionSetup", func(t *testing.T) {
+		var (
+			ch          = make(chan prometheus.Metric, 100)
+			pg_database = &QueryInstance{
+				Name: "pg_database",
+				Desc: "OpenGauss Database size",
+				Queries: []*Query{
+					{
+						SQL:     `SELECT datname,size_bytes from dual`,
+						Version: ">=0.0.0",
+					},
+				},
+				Metrics: []*Column{
+					{Name: "datname", Usage: LABEL, Desc: "Name of this database"},
+					{Name: "size_bytes", Usage: GAUGE, Desc: "Disk space used by the database"},
+				},
+			}
+		)
+		_ = pg_database.Check()
+		s := &Server{
+			parallel:     1,
+			disableCache: true,
+			metricCache:  map[string]*cachedMetrics{},
+			sessionSetup: []string{"SET search_path TO dbe_perf", "SET ROLE monitor"},
+		}
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Error(err)
+		}
+		s.db = db
+		mock.ExpectExec("SET search_path TO dbe_perf").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("SET ROLE monitor").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT").WillReturnRows(
+			sqlmock.NewRows([]string{"datname", "size_bytes"}).AddRow("postgres", 1))
+		errs := s.queryMetrics(ch, map[string]*QueryInstance{"pg_database": pg_database})
+		assert.Equal(t, 0, len(errs))
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, 1, len(ch))
+	})
+	t.Run("queryMetrics_sessionSetup_err", func(t *testing.T) {
+		var (
+			ch          = make(chan prometheus.Metric, 100)
+			pg_database = &QueryInstance{
+				Name:    "pg_database",
+				Queries: []*Query{{SQL: `SELECT datname,size_bytes from dual`, Version: ">=0.0.0"}},
+				Metrics: []*Column{
+					{Name: "datname", Usage: LABEL},
+					{Name: "size_bytes", Usage: GAUGE},
+				},
+			}
+		)
+		_ = pg_database.Check()
+		s := &Server{
+			parallel:     1,
+			disableCache: true,
+			metricCache:  map[string]*cachedMetrics{},
+			sessionSetup: []string{"SET ROLE monitor"},
+		}
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Error(err)
+		}
+		s.db = db
+		mock.ExpectExec("SET ROLE monitor").WillReturnError(fmt.Errorf(`role "monitor" does not exist`))
+		errs := s.queryMetrics(ch, map[string]*QueryInstance{"pg_database": pg_database})
+		assert.Contains(t, errs, "worker 0 session")
+		// query never run is reported with reason instead of silently missing
+		if assert.Contains(t, errs, "pg_database") {
+			assert.Contains(t, errs["pg_database"].Error(), `role "monitor" does not exist`)
+		}
+		assert.Equal(t, int64(2), s.ScrapeErrorCount)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, 0, len(ch))
+	})
+	t.Run("queryMetrics_conn_err", func(t *testing.T) {
+		var (
+			ch          = make(chan prometheus.Metric, 100)
+			pg_database = &QueryInstance{
+				Name: "pg_database",
+				Queries: []*Query{
+					{SQL: `SELECT datname,size_bytes from dual`, Version: ">=0.0.0"},
+				},
+				Metrics: []*Column{
+					{Name: "datname", Usage: LABEL, Desc: "Name of this database"},
+					{Name: "size_bytes", Usage: GAUGE, Desc: "Disk space used by the database"},
+				},
+			}
+			pg_lock = &QueryInstance{
+				Name: "pg_lock",
+				Queries: []*Query{
+					{SQL: `SELECT datname,count from dual`, Version: ">=0.0.0"},
+				},
+			}
+		)
+		_ = pg_database.Check()
+		_ = pg_lock.Check()
+		s := &Server{
+			parallel:    2,
+			metricCache: map[string]*cachedMetrics{},
+		}
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Error(err)
+		}
+		mock.ExpectClose()
+		_ = db.Close()
+		s.db = db
+		errs := s.queryMetrics(ch, map[string]*QueryInstance{"pg_database": pg_database, "pg_lock": pg_lock})
+		assert.Contains(t, errs, "worker 0 conn")
+		assert.Contains(t, errs, "worker 1 conn")
+		assert.Contains(t, errs, "pg_database")
+		assert.Contains(t, errs, "pg_lock")
+		assert.Equal(t, int64(4), s.ScrapeErrorCount)
+		assert.Equal(t, 0, len(ch))
+	})
 	t.Run("timeout", func(t *testing.T) {
 		conn, mock := genMockDB(t, s)
 		mock.ExpectQuery("SELECT").WillDelayFor(2 * time.Second).WillReturnRows(
@@ -688,6 +1241,61 @@ postgres,AccessExclusiveLock,0`))
 	})
 }
 
+func Test_pgReplicationSlots(t *testing.T) {
+	var (
+		s = &Server{
+			labels: prometheus.Labels{
+				"server": "localhost:5432",
+			},
+			primary:     true,
+			metricCache: map[string]*cachedMetrics{},
+		}
+		queryInstance = pgReplicationSlots
+	)
+	assert.NoError(t, queryInstance.Check())
+	t.Run("GetQuerySQL", func(t *testing.T) {
+		q := queryInstance.GetQuerySQL(semver.MustParse("3.0.0"), true)
+		assert.Contains(t, q.SQL, "confirmed_flush")
+		q = queryInstance.GetQuerySQL(semver.MustParse("1.1.0"), true)
+		assert.NotContains(t, q.SQL, "confirmed_flush")
+	})
+	t.Run("doCollectMetric", func(t *testing.T) {
+		s.lastMapVersion = semver.MustParse("3.0.0")
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT").WillReturnRows(
+			sqlmock.NewRows([]string{"slot_name", "plugin", "slot_type", "database", "active", "restart_lsn", "confirmed_flush", "retained_bytes"}).
+				AddRow("standby1", "", "physical", "", true, "0/331980B8", nil, 1024).
+				AddRow("sub1", "mppdb_decoding", "logical", "postgres", false, "0/33198000", "0/33198010", 2048))
+		metrics, errs, err := s.doCollectMetric(queryInstance, conn)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(errs))
+		values := map[string]float64{}
+		for _, m := range metrics {
+			pb := &dto.Metric{}
+			_ = m.Write(pb)
+			var slotType string
+			for _, l := range pb.GetLabel() {
+				if l.GetName() == "slot_type" {
+					slotType = l.GetValue()
+				}
+			}
+			name := fmt.Sprintf("%s{%s}", m.Desc().String(), slotType)
+			if strings.Contains(name, "pg_replication_slots_active") {
+				values["active_"+slotType] = pb.GetGauge().GetValue()
+			}
+			if strings.Contains(name, "pg_replication_slots_restart_lsn") {
+				values["restart_lsn_"+slotType] = pb.GetGauge().GetValue()
+			}
+		}
+		assert.Equal(t, map[string]float64{
+			"active_physical":      1,
+			"active_logical":       0,
+			"restart_lsn_physical": float64(0x331980B8),
+			"restart_lsn_logical":  float64(0x33198000),
+		}, values)
+	})
+}
+
 func Test_cachedMetrics(t *testing.T) {
 	var (
 		c = &cachedMetrics{
@@ -715,3 +1323,2606 @@ func Test_cachedMetrics(t *testing.T) {
 		assert.Equal(t, c.IsValid(10), false)
 	})
 }
+
+func TestServer_recoveryState(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}, UP: true, namespace: "pg"}
+	baseInfoRows := func(inRecovery bool) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"version", "client_encoding", "pg_is_in_recovery", "current_database"}).AddRow(
+			"(openGauss 2.0.0 build 78689da9)", "UTF8", inRecovery, "postgres")
+	}
+	tests := []struct {
+		name       string
+		inRecovery bool
+		probe      func(mock sqlmock.Sqlmock)
+		want       int
+	}{
+		{"primary", false, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("FROM pg_stat_subscription").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		}, recoveryStatePrimary},
+		{"logical", false, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("FROM pg_stat_subscription").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		}, recoveryStateLogical},
+		{"primary_probe_error", false, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("FROM pg_stat_subscription").WillReturnError(fmt.Errorf(`relation "pg_stat_subscription" does not exist`))
+		}, recoveryStatePrimary},
+		{"standby", true, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT local_role").WillReturnRows(sqlmock.NewRows([]string{"local_role"}).AddRow("Standby"))
+		}, recoveryStateStandby},
+		{"cascading", true, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT local_role").WillReturnRows(sqlmock.NewRows([]string{"local_role"}).AddRow("Cascade Standby"))
+		}, recoveryStateCascading},
+		{"standby_probe_error", true, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT local_role").WillReturnError(fmt.Errorf("function does not exist"))
+		}, recoveryStateStandby},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mock := genMockDB(t, s)
+			mock.ExpectQuery("SELECT version").WillReturnRows(baseInfoRows(tt.inRecovery))
+			tt.probe(mock)
+			assert.NoError(t, s.getBaseInfo())
+			assert.NoError(t, mock.ExpectationsWereMet())
+			assert.Equal(t, tt.want, s.recoveryState)
+			assert.Equal(t, !tt.inRecovery, s.primary)
+			var m dto.Metric
+			metric := s.recoveryStateMetric()
+			assert.NoError(t, metric.Write(&m))
+			assert.Equal(t, float64(tt.want), m.GetGauge().GetValue())
+			assert.Contains(t, metric.Desc().String(), `"pg_recovery_state"`)
+		})
+	}
+}
+
+func TestServer_nodeLabel(t *testing.T) {
+	s := &Server{
+		labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+		UP:           true,
+		nodeLabel:    true,
+		disableCache: true,
+		metricCache:  map[string]*cachedMetrics{},
+	}
+	assert.NoError(t, pgPgxcNode.Check())
+	baseInfoRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"version", "client_encoding", "pg_is_in_recovery", "current_database"}).AddRow(
+			"(openGauss 2.0.0 build 78689da9)", "UTF8", false, "postgres")
+	}
+	t.Run("single_node", func(t *testing.T) {
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT version").WillReturnRows(baseInfoRows())
+		mock.ExpectQuery("FROM pgxc_node").WillReturnError(fmt.Errorf(`relation "pgxc_node" does not exist`))
+		assert.NoError(t, s.getBaseInfo())
+		assert.Equal(t, "", s.nodeName)
+		assert.Equal(t, prometheus.Labels{serverLabelName: "localhost:5432"}, s.labels)
+
+		ch := make(chan prometheus.Metric, 10)
+		assert.NoError(t, s.queryMetric(ch, pgPgxcNode, conn))
+		close(ch)
+		assert.Len(t, ch, 0)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("distributed", func(t *testing.T) {
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT version").WillReturnRows(baseInfoRows())
+		mock.ExpectQuery("FROM pgxc_node").WillReturnRows(
+			sqlmock.NewRows([]string{"node_name", "node_type"}).AddRow("cn_5001", "C"))
+		assert.NoError(t, s.getBaseInfo())
+		assert.Equal(t, "cn_5001", s.nodeName)
+		assert.Equal(t, "cn_5001", s.labels[nodeNameLabelName])
+		assert.Equal(t, "coordinator", s.labels[nodeTypeLabelName])
+
+		mock.ExpectQuery("FROM pgxc_node").WillReturnRows(
+			sqlmock.NewRows([]string{"name", "type", "host", "port", "is_primary", "is_preferred"}).
+				AddRow("cn_5001", "C", "10.0.0.1", "8000", 0, 0).
+				AddRow("dn_6001", "D", "10.0.0.2", "40000", 1, 1))
+		ch := make(chan prometheus.Metric, 10)
+		assert.NoError(t, s.queryMetric(ch, pgPgxcNode, conn))
+		close(ch)
+		assert.Len(t, ch, 4)
+		for m := range ch {
+			desc := m.Desc().String()
+			assert.Contains(t, desc, `node_name="cn_5001"`)
+			assert.Contains(t, desc, `node_type="coordinator"`)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("parseNodeType", func(t *testing.T) {
+		assert.Equal(t, "coordinator", parseNodeType("C"))
+		assert.Equal(t, "datanode", parseNodeType("D"))
+		assert.Equal(t, "S", parseNodeType("S"))
+	})
+}
+
+func TestServer_systemLabels(t *testing.T) {
+	s := &Server{
+		labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+		UP:           true,
+		systemLabels: true,
+	}
+	baseInfoRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"version", "client_encoding", "pg_is_in_recovery", "current_database"}).AddRow(
+			"(openGauss 2.0.0 build 78689da9)", "UTF8", false, "postgres")
+	}
+	t.Run("available", func(t *testing.T) {
+		_, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT version").WillReturnRows(baseInfoRows())
+		mock.ExpectQuery("SHOW data_directory").WillReturnRows(
+			sqlmock.NewRows([]string{"data_directory"}).AddRow("/opt/og/data"))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM pg_control_system()")).WillReturnRows(
+			sqlmock.NewRows([]string{"system_identifier"}).AddRow("7012345678901234567"))
+		assert.NoError(t, s.getBaseInfo())
+		assert.Equal(t, prometheus.Labels{
+			serverLabelName:        "localhost:5432",
+			dataDirectoryLabelName: "/opt/og/data",
+			systemIDLabelName:      "7012345678901234567",
+		}, s.labels)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		// discovered once per connection
+		mock.ExpectQuery("SELECT version").WillReturnRows(baseInfoRows())
+		assert.NoError(t, s.getBaseInfo())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+	expectUnavailable := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT version").WillReturnRows(baseInfoRows())
+		mock.ExpectQuery("SHOW data_directory").WillReturnError(
+			fmt.Errorf("must be superuser or a member of pg_read_all_settings to examine \"data_directory\""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM pg_control_system()")).WillReturnError(
+			fmt.Errorf("function pg_control_system() does not exist"))
+	}
+	t.Run("unavailable after reconnect", func(t *testing.T) {
+		_, mock := genMockDB(t, s)
+		expectUnavailable(mock)
+		assert.NoError(t, s.getBaseInfo())
+		assert.Equal(t, prometheus.Labels{
+			serverLabelName:        "localhost:5432",
+			dataDirectoryLabelName: "/opt/og/data",
+			systemIDLabelName:      "7012345678901234567",
+		}, s.labels)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("unavailable", func(t *testing.T) {
+		s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}, UP: true, systemLabels: true}
+		_, mock := genMockDB(t, s)
+		expectUnavailable(mock)
+		assert.NoError(t, s.getBaseInfo())
+		assert.Equal(t, prometheus.Labels{serverLabelName: "localhost:5432", dataDirectoryLabelName: "", systemIDLabelName: ""},
+			s.labels)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestServer_CacheSnapshot(t *testing.T) {
+	var (
+		now    = time.Now()
+		metric = prometheus.MustNewConstMetric(prometheus.NewDesc("pg_up", "up", nil, nil), prometheus.GaugeValue, 1)
+		s      = &Server{
+			fingerprint: "localhost:5432",
+			dbName:      "postgres",
+			metricCache: map[string]*cachedMetrics{
+				"pg_lock": {
+					metrics:    []prometheus.Metric{metric, metric},
+					lastScrape: now,
+				},
+				"pg_database": {
+					lastScrape:     now.Add(-time.Minute),
+					nonFatalErrors: []error{fmt.Errorf("a1")},
+				},
+			},
+		}
+	)
+	want := map[string]CacheEntryInfo{
+		"pg_lock":     {LastScrape: now, MetricCount: 2},
+		"pg_database": {LastScrape: now.Add(-time.Minute), NonFatalErrors: true},
+	}
+	assert.Equal(t, want, s.CacheSnapshot())
+
+	exporter := &Exporter{servers: []*Servers{{servers: map[string]*Server{"dsn": s}}}}
+	assert.Equal(t, map[string]map[string]CacheEntryInfo{"localhost:5432/postgres": want}, exporter.CacheSnapshot())
+}
+
+func TestServer_UpdateCredentials(t *testing.T) {
+	var (
+		dsn        = "host=localhost password=old port=5432 user=omm"
+		newDSN     = "host=localhost password=new port=5432 user=omm"
+		discDSN    = "application_name=opengauss_exporter database=db1 host=localhost password=old port=5432 user=omm"
+		newDiscDSN = "application_name=opengauss_exporter database=db1 host=localhost password=new port=5432 user=omm"
+	)
+	genServer := func(dsn string) *Server {
+		db, _, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Server{fingerprint: "localhost:5432", dsn: dsn, db: db, UP: true}
+	}
+	t.Run("server", func(t *testing.T) {
+		s := genServer(dsn)
+		assert.NoError(t, s.UpdateCredentials("new"))
+		assert.Equal(t, newDSN, s.dsn)
+		assert.Nil(t, s.db)
+		assert.False(t, s.UP)
+		// next connect opens a new connection with new dsn instead of reusing the old one
+		_ = s.ConnectDatabase()
+		assert.NotNil(t, s.db)
+		assert.Equal(t, newDSN, s.dsn)
+	})
+	t.Run("concurrent with scrape", func(t *testing.T) {
+		s := genServer(dsn)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_ = s.CheckConn()
+		}()
+		assert.NoError(t, s.UpdateCredentials("new"))
+		<-done
+		assert.Equal(t, newDSN, s.dsn)
+	})
+	t.Run("exporter", func(t *testing.T) {
+		servers := &Servers{
+			dsn:        dsn,
+			dsnSetting: map[string]string{"host": "localhost", "port": "5432", "user": "omm", "password": "old"},
+			servers: map[string]*Server{
+				dsn:     genServer(dsn),
+				discDSN: genServer(discDSN),
+			},
+		}
+		exporter := &Exporter{servers: []*Servers{servers}}
+		assert.Error(t, exporter.UpdateCredentials("localhost:5433", "new"))
+		assert.NoError(t, exporter.UpdateCredentials("localhost:5432", "new"))
+		assert.Equal(t, newDSN, servers.dsn)
+		assert.Len(t, servers.servers, 2)
+		for _, dsn := range []string{newDSN, newDiscDSN} {
+			server, ok := servers.servers[dsn]
+			if assert.True(t, ok, dsn) {
+				assert.Equal(t, dsn, server.dsn)
+				assert.False(t, server.UP)
+			}
+		}
+	})
+}
+
+func TestServer_queryMetric_minInterval(t *testing.T) {
+	var (
+		s = &Server{
+			labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+			disableCache: true,
+			metricCache:  map[string]*cachedMetrics{},
+		}
+		queryInstance = &QueryInstance{
+			Name: "pg_table_bloat",
+			Queries: []*Query{
+				{SQL: "SELECT relname, bloat_bytes FROM bloat", Version: ">=0.0.0", MinInterval: 60},
+			},
+			Metrics: []*Column{
+				{Name: "relname", Usage: LABEL},
+				{Name: "bloat_bytes", Usage: GAUGE},
+			},
+		}
+	)
+	assert.NoError(t, queryInstance.Check())
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery("SELECT relname").WillReturnRows(
+		sqlmock.NewRows([]string{"relname", "bloat_bytes"}).AddRow("t1", 8192))
+	for i := 0; i < 3; i++ {
+		ch := make(chan prometheus.Metric, 10)
+		assert.NoError(t, s.queryMetric(ch, queryInstance, conn))
+		close(ch)
+		assert.Len(t, ch, 1)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// interval elapsed, query database again
+	s.metricCache[queryInstance.Name].lastScrape = time.Now().Add(-time.Minute)
+	mock.ExpectQuery("SELECT relname").WillReturnRows(
+		sqlmock.NewRows([]string{"relname", "bloat_bytes"}).AddRow("t1", 16384))
+	ch := make(chan prometheus.Metric, 10)
+	assert.NoError(t, s.queryMetric(ch, queryInstance, conn))
+	close(ch)
+	assert.Len(t, ch, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_queryMetric_staleFactor(t *testing.T) {
+	var (
+		s = &Server{
+			labels:      prometheus.Labels{serverLabelName: "localhost:5432"},
+			staleFactor: 3,
+			metricCache: map[string]*cachedMetrics{},
+		}
+		queryInstance = &QueryInstance{
+			Name:    "pg_table_size",
+			TTL:     10,
+			Queries: []*Query{{SQL: "SELECT relname, size_bytes FROM sizes"}},
+			Metrics: []*Column{
+				{Name: "relname", Usage: LABEL},
+				{Name: "size_bytes", Usage: GAUGE},
+			},
+		}
+	)
+	assert.NoError(t, queryInstance.Check())
+	conn, mock := genMockDB(t, s)
+	scrape := func() int {
+		ch := make(chan prometheus.Metric, 10)
+		_ = s.queryMetric(ch, queryInstance, conn)
+		close(ch)
+		return len(ch)
+	}
+	mock.ExpectQuery("SELECT relname").WillReturnRows(
+		sqlmock.NewRows([]string{"relname", "size_bytes"}).AddRow("t1", 8192))
+	assert.Equal(t, 1, scrape())
+
+	// ttl expired and refresh fails, cache younger than 3 times ttl is served
+	s.metricCache[queryInstance.Name].lastScrape = time.Now().Add(-20 * time.Second)
+	mock.ExpectQuery("SELECT relname").WillReturnError(fmt.Errorf("connection refused"))
+	assert.Equal(t, 1, scrape())
+
+	// cache aged past stale threshold, series are not emitted any more
+	s.metricCache[queryInstance.Name].lastScrape = time.Now().Add(-40 * time.Second)
+	mock.ExpectQuery("SELECT relname").WillReturnError(fmt.Errorf("connection refused"))
+	assert.Equal(t, 0, scrape())
+	mock.ExpectQuery("SELECT relname").WillReturnError(fmt.Errorf("connection refused"))
+	assert.Equal(t, 0, scrape())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_queryMetric_skipped(t *testing.T) {
+	s := &Server{
+		namespace:      "pg",
+		labels:         prometheus.Labels{serverLabelName: "localhost:5432"},
+		lastMapVersion: semver.MustParse("2.0.0"),
+		primary:        false,
+		metricCache:    map[string]*cachedMetrics{},
+	}
+	newQuery := func(name string, query *Query) *QueryInstance {
+		q := &QueryInstance{
+			Name:    name,
+			Queries: []*Query{query},
+			Metrics: []*Column{{Name: "count", Usage: GAUGE}},
+		}
+		assert.NoError(t, q.Check())
+		return q
+	}
+	for _, q := range []*QueryInstance{
+		newQuery("pg_primary_only", &Query{SQL: "SELECT count FROM a", DbRole: "primary"}),
+		newQuery("pg_disabled", &Query{SQL: "SELECT count FROM b", Status: statusDisable}),
+		newQuery("pg_new_version", &Query{SQL: "SELECT count FROM c", Version: ">=3.0.0"}),
+	} {
+		for i := 0; i < 2; i++ {
+			assert.NoError(t, s.queryMetric(make(chan prometheus.Metric, 10), q, nil))
+		}
+	}
+	ch := make(chan prometheus.Metric, 100)
+	s.collectQueryInternalMetrics(ch)
+	close(ch)
+	skipped := map[string]float64{}
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), `"pg_exporter_query_skipped_total"`) {
+			continue
+		}
+		var pb dto.Metric
+		assert.NoError(t, m.Write(&pb))
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		skipped[labels["query"]+"/"+labels["reason"]] = pb.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{
+		"pg_primary_only/" + skipReasonDBRole: 2,
+		"pg_disabled/" + skipReasonDisabled:   2,
+		"pg_new_version/" + skipReasonVersion: 2,
+	}, skipped)
+}
+
+func TestServer_doCollectMetric_completions(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name: "pg_lock_mode",
+		Queries: []*Query{
+			{SQL: `SELECT mode, count FROM pg_locks`},
+		},
+		Metrics: []*Column{
+			{Name: "mode", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+		Completions: map[string][]string{"mode": {"AccessShareLock", "RowShareLock", "ExclusiveLock"}},
+	}
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery("SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"mode", "count"}).AddRow("RowShareLock", 2))
+	metrics, errs, err := s.doCollectMetric(q, conn)
+	assert.NoError(t, err)
+	assert.Len(t, errs, 0)
+	got := map[string]float64{}
+	for _, m := range metrics {
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		got[pb.GetLabel()[0].GetValue()] = pb.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"AccessShareLock": 0, "RowShareLock": 2, "ExclusiveLock": 0}, got)
+}
+
+func TestExporter_FlushCache(t *testing.T) {
+	var (
+		s = &Server{
+			fingerprint: "localhost:5432",
+			labels:      prometheus.Labels{serverLabelName: "localhost:5432"},
+			metricCache: map[string]*cachedMetrics{},
+		}
+		servers       = &Servers{servers: map[string]*Server{"dsn": s}}
+		exporter      = &Exporter{servers: []*Servers{servers}}
+		queryInstance = &QueryInstance{
+			Name: "pg_lock_mode",
+			TTL:  60,
+			Queries: []*Query{
+				{SQL: "SELECT mode, count FROM pg_locks", Version: ">=0.0.0"},
+			},
+			Metrics: []*Column{
+				{Name: "mode", Usage: LABEL},
+				{Name: "count", Usage: GAUGE},
+			},
+		}
+	)
+	assert.NoError(t, queryInstance.Check())
+	conn, mock := genMockDB(t, s)
+	expectQuery := func() {
+		mock.ExpectQuery("SELECT mode").WillReturnRows(
+			sqlmock.NewRows([]string{"mode", "count"}).AddRow("RowShareLock", 2))
+	}
+	scrape := func() {
+		ch := make(chan prometheus.Metric, 10)
+		assert.NoError(t, s.queryMetric(ch, queryInstance, conn))
+		close(ch)
+		assert.Len(t, ch, 1)
+	}
+
+	expectQuery()
+	scrape()
+	scrape() // from cache
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Len(t, exporter.CacheSnapshot()["localhost:5432/"], 1)
+
+	exporter.FlushCache()
+	assert.Len(t, exporter.CacheSnapshot()["localhost:5432/"], 0)
+	expectQuery()
+	scrape()
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	exporter.SetCacheDisabled(true)
+	assert.True(t, s.disableCache)
+	assert.Len(t, servers.opts, 1)
+	expectQuery()
+	scrape()
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// toggling again replaces the opt, servers created later follow the last toggle
+	exporter.SetCacheDisabled(false)
+	exporter.SetCacheDisabled(true)
+	assert.Len(t, servers.opts, 1)
+	created := &Server{}
+	for _, opt := range servers.opts {
+		opt(created)
+	}
+	assert.True(t, created.disableCache)
+}
+
+func TestServer_precisionLoss(t *testing.T) {
+	s := &Server{namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name: "pg_stat_bytes",
+		Queries: []*Query{
+			{SQL: `SELECT datname, bytes FROM dual`},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "bytes", Usage: COUNTER},
+		},
+	}
+	assert.NoError(t, q.Check())
+	columnNames := []string{"datname", "bytes"}
+	columnIdx := map[string]int{"datname": 0, "bytes": 1}
+	for _, v := range []interface{}{int64(1024), int64(1<<53 + 1), []byte("18446744073709551615")} {
+		metrics, errs := s.procRows(q, columnNames, columnIdx, []interface{}{"postgres", v})
+		assert.Len(t, errs, 0)
+		assert.Len(t, metrics, 1)
+	}
+	assert.Equal(t, map[string]float64{"pg_stat_bytes": 2}, s.queryPrecisionLoss)
+
+	ch := make(chan prometheus.Metric, 10)
+	s.collectQueryInternalMetrics(ch)
+	close(ch)
+	var found bool
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), "pg_exporter_precision_loss_total") {
+			continue
+		}
+		found = true
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		assert.Equal(t, float64(2), pb.GetCounter().GetValue())
+	}
+	assert.True(t, found)
+}
+
+func TestServer_procRows_pivot(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name: "pg_connections",
+		Queries: []*Query{
+			{SQL: `SELECT datname, active, idle, idle_in_transaction FROM dual`},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "active", Usage: GAUGE},
+			{Name: "idle", Usage: GAUGE},
+			{Name: "idle_in_transaction", Usage: GAUGE},
+		},
+		PivotColumns: []string{"active", "idle", "idle_in_transaction"},
+		PivotName:    "count",
+	}
+	assert.NoError(t, q.Check())
+	assert.Equal(t, "state", q.PivotLabel)
+	metrics, errs := s.procRows(q, []string{"datname", "active", "idle", "idle_in_transaction"},
+		map[string]int{"datname": 0, "active": 1, "idle": 2, "idle_in_transaction": 3},
+		[]interface{}{"postgres", int64(3), int64(10), int64(1)})
+	assert.Len(t, errs, 0)
+	got := map[string]float64{}
+	for _, m := range metrics {
+		assert.Contains(t, m.Desc().String(), `fqName: "pg_connections_count"`)
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		assert.Equal(t, "postgres", labels["datname"])
+		got[labels["state"]] = pb.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"active": 3, "idle": 10, "idle_in_transaction": 1}, got)
+}
+
+func TestServer_doCollectMetric_statementTimeout(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}, statementTimeout: true}
+	q := &QueryInstance{
+		Name: "pg_lock_mode",
+		Queries: []*Query{
+			{SQL: `SELECT mode, count FROM pg_locks`, Timeout: 1.5},
+		},
+		Metrics: []*Column{
+			{Name: "mode", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+	// SET LOCAL reverts with the transaction, session value of pooled connection is kept
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SET LOCAL statement_timeout = 1500")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT mode").WillReturnRows(
+		sqlmock.NewRows([]string{"mode", "count"}).AddRow("RowShareLock", 2))
+	mock.ExpectRollback()
+	metrics, errs, err := s.doCollectMetric(q, conn)
+	assert.NoError(t, err)
+	assert.Len(t, errs, 0)
+	assert.Len(t, metrics, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	t.Run("searchPath", func(t *testing.T) {
+		q := &QueryInstance{
+			Name:       "monitor_lock_mode",
+			SearchPath: "monitor",
+			Queries:    []*Query{{SQL: `SELECT mode, count FROM lock_view`, Timeout: 1.5}},
+			Metrics: []*Column{
+				{Name: "mode", Usage: LABEL},
+				{Name: "count", Usage: GAUGE},
+			},
+		}
+		assert.NoError(t, q.Check())
+		conn, mock := genMockDB(t, s)
+		// both set in one round trip
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SET LOCAL search_path = monitor; SET LOCAL statement_timeout = 1500")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT mode").WillReturnRows(
+			sqlmock.NewRows([]string{"mode", "count"}).AddRow("RowShareLock", 2))
+		mock.ExpectRollback()
+		_, _, err := s.doCollectMetric(q, conn)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestServer_doCollectMetric_searchPath(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name:       "monitor_lock_mode",
+		SearchPath: "monitor, public",
+		Queries: []*Query{
+			{SQL: `SELECT mode, count FROM lock_view`},
+		},
+		Metrics: []*Column{
+			{Name: "mode", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SET LOCAL search_path = monitor, public")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT mode").WillReturnRows(
+		sqlmock.NewRows([]string{"mode", "count"}).AddRow("RowShareLock", 2))
+	mock.ExpectRollback()
+	metrics, errs, err := s.doCollectMetric(q, conn)
+	assert.NoError(t, err)
+	assert.Len(t, errs, 0)
+	assert.Len(t, metrics, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	q.SearchPath = "monitor; drop table t"
+	assert.Error(t, q.Check())
+}
+
+func TestServer_doCollectMetric_nullLabel(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	newQuery := func(nullLabelValue string) *QueryInstance {
+		q := &QueryInstance{
+			Name: "pg_slot",
+			Queries: []*Query{
+				{SQL: `SELECT slot_name, count FROM pg_replication_slots`},
+			},
+			Metrics: []*Column{
+				{Name: "slot_name", Usage: LABEL, NullLabelValue: nullLabelValue},
+				{Name: "count", Usage: GAUGE},
+			},
+		}
+		assert.NoError(t, q.Check())
+		return q
+	}
+	t.Run("collision", func(t *testing.T) {
+		hook := newLogHook(t)
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT slot_name").WillReturnRows(
+			sqlmock.NewRows([]string{"slot_name", "count"}).AddRow(nil, 1).AddRow("", 2))
+		metrics, errs, err := s.doCollectMetric(newQuery(""), conn)
+		assert.NoError(t, err)
+		// the last row of colliding ones is kept
+		if assert.Len(t, metrics, 1) {
+			var m dto.Metric
+			assert.NoError(t, metrics[0].Write(&m))
+			assert.Equal(t, float64(2), m.GetGauge().GetValue())
+		}
+		// collision is a warning, it must not fail the query
+		assert.Len(t, errs, 0)
+		var warned bool
+		for _, entry := range hook.AllEntries() {
+			warned = warned || strings.Contains(entry.Message, "duplicate label set")
+		}
+		assert.True(t, warned)
+	})
+	t.Run("sentinel", func(t *testing.T) {
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT slot_name").WillReturnRows(
+			sqlmock.NewRows([]string{"slot_name", "count"}).AddRow(nil, 1).AddRow("", 2))
+		metrics, errs, err := s.doCollectMetric(newQuery("__null__"), conn)
+		assert.NoError(t, err)
+		assert.Len(t, errs, 0)
+		if assert.Len(t, metrics, 2) {
+			var m dto.Metric
+			assert.NoError(t, metrics[0].Write(&m))
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "slot_name" {
+					assert.Equal(t, "__null__", l.GetValue())
+				}
+			}
+		}
+	})
+}
+
+func TestServer_connectionAge(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		dsn:         "host=localhost port=5432",
+		db:          db,
+		UP:          true,
+		namespace:   "pg",
+		labels:      prometheus.Labels{serverLabelName: "localhost:5432"},
+		connectedAt: time.Now().Add(-time.Hour),
+	}
+	var m dto.Metric
+	age := s.connectionAgeMetric()
+	if assert.NotNil(t, age) {
+		assert.NoError(t, age.Write(&m))
+		assert.InDelta(t, time.Hour.Seconds(), m.GetGauge().GetValue(), 5)
+		assert.Contains(t, age.Desc().String(), "pg_exporter_connection_age_seconds")
+	}
+	// broken connection forces reconnect, no age until reconnect pings
+	mock.ExpectPing().WillReturnError(fmt.Errorf("ping error"))
+	s.dialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, fmt.Errorf("dial error")
+	}
+	assert.Error(t, s.ConnectDatabase())
+	assert.Nil(t, s.connectionAgeMetric())
+	assert.Nil(t, (&Server{}).connectionAgeMetric())
+}
+
+func TestServer_procRows_info(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name: "pg_cluster",
+		Queries: []*Query{
+			{SQL: `SELECT node, state FROM cluster_state`},
+		},
+		Metrics: []*Column{
+			{Name: "node", Usage: LABEL},
+			{Name: "state", Usage: INFO},
+		},
+	}
+	assert.NoError(t, q.Check())
+	metrics, errs := s.procRows(q, []string{"node", "state"},
+		map[string]int{"node": 0, "state": 1}, []interface{}{"dn_6001", "Normal"})
+	assert.Len(t, errs, 0)
+	if assert.Len(t, metrics, 1) {
+		var m dto.Metric
+		assert.NoError(t, metrics[0].Write(&m))
+		assert.Equal(t, float64(1), m.GetGauge().GetValue())
+		assert.Contains(t, metrics[0].Desc().String(), `"pg_cluster_state"`)
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		assert.Equal(t, "Normal", labels["state"])
+		assert.Equal(t, "dn_6001", labels["node"])
+	}
+	t.Run("cardinality", func(t *testing.T) {
+		for i := 0; i < infoCardinalityLimit; i++ {
+			assert.False(t, s.addInfoValue("pg_cluster_node", fmt.Sprintf("v%d", i)))
+		}
+		assert.False(t, s.addInfoValue("pg_cluster_node", "v0"))
+		assert.True(t, s.addInfoValue("pg_cluster_node", "overflow"))
+	})
+}
+
+func TestServer_procRows_jsonLabels(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name: "pg_connection",
+		Queries: []*Query{
+			{SQL: `SELECT pid, attrs, count FROM connection_attrs`},
+		},
+		Metrics: []*Column{
+			{Name: "pid", Usage: LABEL},
+			{Name: "attrs", Usage: JSONLabels, Keys: []string{"app", "user"}},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	columnNames := []string{"pid", "attrs", "count"}
+	columnIdx := map[string]int{"pid": 0, "attrs": 1, "count": 2}
+	rowLabels := func(metric prometheus.Metric) map[string]string {
+		var m dto.Metric
+		assert.NoError(t, metric.Write(&m))
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		return labels
+	}
+	metrics, errs := s.procRows(q, columnNames, columnIdx, []interface{}{"1024", []byte(`{"app":"x","user":"y"}`), int64(3)})
+	assert.Len(t, errs, 0)
+	if assert.Len(t, metrics, 1) {
+		assert.Equal(t, map[string]string{serverLabelName: "localhost:5432", "pid": "1024", "app": "x", "user": "y"},
+			rowLabels(metrics[0]))
+	}
+	t.Run("declared keys", func(t *testing.T) {
+		// undeclared keys are dropped, missing ones labeled empty
+		metrics, errs := s.procRows(q, columnNames, columnIdx, []interface{}{"1024", `{"pid":"1","app":1,"c":"z"}`, int64(3)})
+		assert.Len(t, errs, 0)
+		if assert.Len(t, metrics, 1) {
+			assert.Equal(t, map[string]string{serverLabelName: "localhost:5432", "pid": "1024", "app": "1", "user": ""},
+				rowLabels(metrics[0]))
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		metrics, errs := s.procRows(q, columnNames, columnIdx, []interface{}{"1024", `[1,2]`, int64(3)})
+		assert.Len(t, errs, 1)
+		if assert.Len(t, metrics, 1) {
+			assert.Equal(t, map[string]string{serverLabelName: "localhost:5432", "pid": "1024", "app": "", "user": ""},
+				rowLabels(metrics[0]))
+		}
+	})
+	t.Run("check", func(t *testing.T) {
+		q.Metrics[1].Keys = nil
+		assert.Error(t, q.Check())
+		q.Metrics[1].Keys = []string{"app", "pid"}
+		assert.Error(t, q.Check())
+		q.Metrics[1].Keys = []string{"app", "user"}
+		assert.NoError(t, q.Check())
+	})
+}
+
+func TestServer_doCollectMetric_latencyLabel(t *testing.T) {
+	q := &QueryInstance{
+		Name:    "pg_slot",
+		Queries: []*Query{{SQL: `SELECT slot_name, count, size FROM pg_replication_slots`}},
+		Metrics: []*Column{
+			{Name: "slot_name", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+			{Name: "size", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	labelsOf := func(metric prometheus.Metric) map[string]string {
+		var m dto.Metric
+		assert.NoError(t, metric.Write(&m))
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		return labels
+	}
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled_%v", enabled), func(t *testing.T) {
+			s := &Server{namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"}, latencyLabel: enabled}
+			conn, mock := genMockDB(t, s)
+			mock.ExpectQuery("SELECT slot_name").WillDelayFor(60 * time.Millisecond).WillReturnRows(
+				sqlmock.NewRows([]string{"slot_name", "count", "size"}).AddRow("s1", 1, 10).AddRow("s2", 2, 20))
+			metrics, errs, err := s.doCollectMetric(q, conn)
+			assert.NoError(t, err)
+			assert.Len(t, errs, 0)
+			if !assert.Len(t, metrics, 4) {
+				return
+			}
+			for _, metric := range metrics {
+				latency, ok := labelsOf(metric)[latencyLabelName]
+				// every row of the first metric is labeled, label names of a metric never differ
+				if enabled && strings.Contains(metric.Desc().String(), `"pg_slot_count"`) {
+					assert.True(t, ok)
+					assert.Contains(t, []string{"100", "250", "500"}, latency)
+				} else {
+					assert.False(t, ok)
+				}
+			}
+		})
+	}
+	t.Run("latencyColumn", func(t *testing.T) {
+		assert.Equal(t, "count", q.latencyColumn())
+		pivot := &QueryInstance{
+			Name:         "pg_lock",
+			Queries:      []*Query{{SQL: `SELECT datname, granted, waiting, info FROM pg_locks`}},
+			PivotColumns: []string{"granted", "waiting"},
+			PivotName:    "count",
+			PivotLabel:   "state",
+			Metrics: []*Column{
+				{Name: "datname", Usage: LABEL},
+				{Name: "granted", Usage: GAUGE},
+				{Name: "waiting", Usage: GAUGE},
+				{Name: "info", Usage: INFO},
+			},
+		}
+		assert.NoError(t, pivot.Check())
+		assert.Equal(t, "", pivot.latencyColumn())
+	})
+	t.Run("bucket", func(t *testing.T) {
+		assert.Equal(t, "10", latencyBucket(0))
+		assert.Equal(t, "100", latencyBucket(51))
+		assert.Equal(t, "10000", latencyBucket(10000))
+		assert.Equal(t, "+Inf", latencyBucket(10001))
+	})
+}
+
+func TestServer_metricRenamer(t *testing.T) {
+	s := &Server{
+		namespace: "pg",
+		labels:    prometheus.Labels{serverLabelName: "localhost:5432"},
+		renamer:   func(name string) string { return "og_" + name },
+	}
+	q := &QueryInstance{
+		Name:    "pg_lock",
+		Queries: []*Query{{SQL: `SELECT mode, count FROM pg_locks`}},
+		Metrics: []*Column{
+			{Name: "mode", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	metrics, errs := s.procRows(q, []string{"mode", "count"},
+		map[string]int{"mode": 0, "count": 1}, []interface{}{"AccessShareLock", int64(3)})
+	assert.Len(t, errs, 0)
+	if assert.Len(t, metrics, 1) {
+		assert.Contains(t, metrics[0].Desc().String(), `"og_pg_lock_count"`)
+	}
+	assert.Contains(t, s.recoveryStateMetric().Desc().String(), `"og_pg_recovery_state"`)
+	assert.NoError(t, s.setupServerInternalMetrics())
+	assert.Contains(t, s.up.Desc().String(), `"og_pg_up"`)
+
+	t.Run("invalid", func(t *testing.T) {
+		s.renamer = func(name string) string { return "og-" + name }
+		assert.Equal(t, "pg_up", s.fqName("", "up"))
+	})
+}
+
+func TestServer_doCollectMetric_familyColumn(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name:         "pg_batch",
+		FamilyColumn: "metric_name",
+		Queries:      []*Query{{SQL: `SELECT metric_name, datname, value FROM batch_stats`}},
+		Metrics: []*Column{
+			{Name: "metric_name", Usage: DISCARD},
+			{Name: "datname", Usage: LABEL},
+			{Name: "value", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery("SELECT metric_name").WillReturnRows(
+		sqlmock.NewRows([]string{"metric_name", "datname", "value"}).
+			AddRow("connections", "postgres", 10).
+			AddRow("locks", "postgres", 3).
+			AddRow(nil, "postgres", 1))
+	metrics, errs, err := s.doCollectMetric(q, conn)
+	assert.NoError(t, err)
+	assert.Len(t, errs, 1)
+	values := map[string]float64{}
+	for _, m := range metrics {
+		var pb dto.Metric
+		assert.NoError(t, m.Write(&pb))
+		desc := m.Desc().String()
+		values[desc[strings.Index(desc, `"`)+1:strings.Index(desc, `",`)]] = pb.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"pg_batch_connections": 10, "pg_batch_locks": 3}, values)
+	// declared column keeps its own desc
+	assert.Contains(t, q.GetColumn("value", s.labels).PrometheusDesc.String(), `"pg_batch_value"`)
+
+	t.Run("check", func(t *testing.T) {
+		bad := &QueryInstance{
+			Name:         "pg_batch",
+			FamilyColumn: "metric_name",
+			Queries:      []*Query{{SQL: `SELECT metric_name, value FROM batch_stats`}},
+			Metrics: []*Column{
+				{Name: "metric_name", Usage: LABEL},
+				{Name: "value", Usage: GAUGE},
+			},
+		}
+		assert.Error(t, bad.Check())
+	})
+}
+
+func TestServer_procRows_missingLabel(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name:    "pg_slot",
+		Queries: []*Query{{SQL: `SELECT slot_name, plugin, count FROM pg_replication_slots`}},
+		Metrics: []*Column{
+			{Name: "slot_name", Usage: LABEL},
+			{Name: "plugin", Usage: LABEL, NullLabelValue: "unknown"},
+			{Name: "wal_status", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	hook := newLogHook(t)
+	for i := 0; i < 2; i++ {
+		// plugin and wal_status columns are absent from result
+		metrics, errs := s.procRows(q, []string{"slot_name", "count"},
+			map[string]int{"slot_name": 0, "count": 1}, []interface{}{"slot1", int64(1)})
+		assert.Len(t, errs, 0)
+		if assert.Len(t, metrics, 1) {
+			var m dto.Metric
+			assert.NoError(t, metrics[0].Write(&m))
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			assert.Equal(t, map[string]string{serverLabelName: "localhost:5432",
+				"slot_name": "slot1", "plugin": "unknown", "wal_status": ""}, labels)
+		}
+	}
+	var warned int
+	for _, entry := range hook.AllEntries() {
+		if strings.Contains(entry.Message, "missing from result") {
+			warned++
+		}
+	}
+	assert.Equal(t, 2, warned)
+}
+
+func TestServer_procRows_normalize(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name:    "pg_lock",
+		Queries: []*Query{{SQL: `SELECT mode, state, db, count FROM pg_locks`}},
+		Metrics: []*Column{
+			{Name: "mode", Usage: LABEL, Normalize: "LOWER"},
+			{Name: "state", Usage: LABEL, Normalize: NormalizeTrim},
+			{Name: "db", Usage: LABEL},
+			{Name: "count", Usage: GAUGE, Normalize: NormalizeLower},
+		},
+	}
+	assert.NoError(t, q.Check())
+	metrics, errs := s.procRows(q, []string{"mode", "state", "db", "count"},
+		map[string]int{"mode": 0, "state": 1, "db": 2, "count": 3},
+		[]interface{}{"AccessShareLock", "  Active ", "Postgres", 3.5})
+	assert.Len(t, errs, 0)
+	if assert.Len(t, metrics, 1) {
+		var m dto.Metric
+		assert.NoError(t, metrics[0].Write(&m))
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		assert.Equal(t, map[string]string{serverLabelName: "localhost:5432",
+			"mode": "accesssharelock", "state": "Active", "db": "Postgres"}, labels)
+		assert.Equal(t, 3.5, m.GetGauge().GetValue())
+	}
+
+	q.Metrics[2].Normalize = "title"
+	assert.Error(t, q.Check())
+}
+
+func TestServer_exposeQuerySQL(t *testing.T) {
+	q := &QueryInstance{
+		Name: "pg_lock",
+		Queries: []*Query{{SQL: `SELECT mode, count(*) AS count
+FROM pg_locks
+GROUP BY mode`}},
+		Metrics: []*Column{
+			{Name: "mode", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	querySQL := func(s *Server) map[string]string {
+		ch := make(chan prometheus.Metric, 10)
+		s.collectQueryInternalMetrics(ch)
+		close(ch)
+		sql := map[string]string{}
+		for m := range ch {
+			if !strings.Contains(m.Desc().String(), `"pg_exporter_query_info"`) {
+				continue
+			}
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			labels := map[string]string{}
+			for _, l := range pb.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			sql[labels["query"]] = labels["sql"]
+		}
+		return sql
+	}
+	for _, expose := range []bool{true, false} {
+		s := &Server{
+			namespace:      "pg",
+			labels:         prometheus.Labels{serverLabelName: "localhost:5432"},
+			disableCache:   true,
+			metricCache:    map[string]*cachedMetrics{},
+			exposeQuerySQL: expose,
+		}
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT mode").WillReturnRows(
+			sqlmock.NewRows([]string{"mode", "count"}).AddRow("AccessShareLock", 1))
+		assert.NoError(t, s.queryMetric(make(chan prometheus.Metric, 10), q, conn))
+		if expose {
+			assert.Equal(t, map[string]string{"pg_lock": "SELECT mode, count(*) AS count FROM pg_locks GROUP BY mode"}, querySQL(s))
+		} else {
+			assert.Len(t, querySQL(s), 0)
+		}
+	}
+	t.Run("truncate", func(t *testing.T) {
+		s := &Server{exposeQuerySQL: true}
+		s.setQuerySQL("pg_long", "SELECT "+strings.Repeat("x, ", querySQLLabelLength))
+		assert.Len(t, []rune(s.querySQLText["pg_long"]), querySQLLabelLength)
+	})
+}
+
+func TestServer_doCollectMetric_waitEvent(t *testing.T) {
+	assert.NoError(t, pgWaitEvent.Check())
+	t.Run("version", func(t *testing.T) {
+		assert.Contains(t, pgWaitEvent.GetQuerySQL(semver.MustParse("2.1.0"), true).SQL, "coalesce(wait_event, 'none')")
+		assert.Contains(t, pgWaitEvent.GetQuerySQL(semver.MustParse("1.1.0"), true).SQL, "'none' AS wait_event")
+	})
+	s := &Server{
+		labels:         prometheus.Labels{serverLabelName: "localhost:5432"},
+		lastMapVersion: semver.MustParse("2.0.0"),
+		primary:        true,
+	}
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM pg_thread_wait_status")).WillReturnRows(
+		sqlmock.NewRows([]string{"wait_event_type", "wait_event", "count"}).
+			AddRow("acquire lwlock", "ProcArrayLock", int64(3)).
+			AddRow("wait io", "DataFileRead", int64(1)))
+	metrics, errs, err := s.doCollectMetric(pgWaitEvent, conn)
+	assert.NoError(t, err)
+	assert.Len(t, errs, 0)
+	counts := map[string]float64{}
+	for _, m := range metrics {
+		var pb dto.Metric
+		assert.NoError(t, m.Write(&pb))
+		labels := map[string]string{}
+		for _, l := range pb.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		counts[labels["wait_event_type"]+"/"+labels["wait_event"]] = pb.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"acquire lwlock/ProcArrayLock": 3, "wait io/DataFileRead": 1}, counts)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_queryMetric_paramsCache(t *testing.T) {
+	s := &Server{
+		labels:      prometheus.Labels{serverLabelName: "localhost:5432"},
+		metricCache: map[string]*cachedMetrics{},
+	}
+	newQuery := func(param QueryParam) *QueryInstance {
+		q := &QueryInstance{
+			Name:    "pg_activity",
+			TTL:     60,
+			Queries: []*Query{{SQL: `SELECT state, count(*) AS count FROM pg_stat_get_activity($1) GROUP BY state`, Params: []QueryParam{param}}},
+			Metrics: []*Column{
+				{Name: "state", Usage: LABEL},
+				{Name: "count", Usage: GAUGE},
+			},
+		}
+		assert.NoError(t, q.Check())
+		return q
+	}
+	q1, q2 := newQuery(int64(1)), newQuery(int64(2))
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM pg_stat_get_activity($1)")).WithArgs(int64(1)).WillReturnRows(
+		sqlmock.NewRows([]string{"state", "count"}).AddRow("active", int64(1)))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM pg_stat_get_activity($1)")).WithArgs(int64(2)).WillReturnRows(
+		sqlmock.NewRows([]string{"state", "count"}).AddRow("active", int64(2)))
+	values := func(q *QueryInstance) []float64 {
+		ch := make(chan prometheus.Metric, 10)
+		assert.NoError(t, s.queryMetric(ch, q, conn))
+		close(ch)
+		var v []float64
+		for m := range ch {
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			v = append(v, pb.GetGauge().GetValue())
+		}
+		return v
+	}
+	// second round is served from cache entry of own parameters
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, []float64{1}, values(q1))
+		assert.Equal(t, []float64{2}, values(q2))
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Len(t, s.metricCache, 2)
+	assert.Contains(t, s.metricCache, "pg_activity[1]")
+	assert.Contains(t, s.metricCache, "pg_activity[2]")
+	assert.Equal(t, "pg_lock", queryCacheKey("pg_lock", &Query{}))
+}
+
+func TestServer_procRows_histogramArrays(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name: "pg_io_latency",
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "seconds", Usage: HISTOGRAM, Counts: "counts", Sum: "sum"},
+			{Name: "counts", Usage: DISCARD},
+			{Name: "sum", Usage: DISCARD},
+		},
+	}
+	assert.NoError(t, q.Check())
+	columnNames := []string{"datname", "seconds", "counts", "sum"}
+	columnIdx := map[string]int{"datname": 0, "seconds": 1, "counts": 2, "sum": 3}
+	metrics, errs := s.procRows(q, columnNames, columnIdx,
+		[]interface{}{"postgres", []byte("{0.1,0.5,1}"), []byte("{2,3,5}"), 4.2})
+	assert.Len(t, errs, 0)
+	if assert.Len(t, metrics, 1) {
+		var pb dto.Metric
+		assert.NoError(t, metrics[0].Write(&pb))
+		h := pb.GetHistogram()
+		if assert.NotNil(t, h) {
+			assert.Equal(t, uint64(10), h.GetSampleCount())
+			assert.Equal(t, 4.2, h.GetSampleSum())
+			cumulative := map[float64]uint64{}
+			for _, b := range h.GetBucket() {
+				cumulative[b.GetUpperBound()] = b.GetCumulativeCount()
+			}
+			assert.Equal(t, map[float64]uint64{0.1: 2, 0.5: 5, 1: 10}, cumulative)
+		}
+	}
+	t.Run("length_mismatch", func(t *testing.T) {
+		metrics, errs := s.procRows(q, columnNames, columnIdx,
+			[]interface{}{"postgres", []byte("{0.1,0.5,1}"), []byte("{2,3}"), 4.2})
+		assert.Len(t, metrics, 0)
+		if assert.Len(t, errs, 1) {
+			assert.Contains(t, errs[0].Error(), "3 bounds but 2 counts")
+		}
+	})
+	for name, tc := range map[string]struct {
+		bounds, counts string
+		err            string
+	}{
+		"negative_count":   {"{0.1,0.5,1}", "{2,-3,5}", "count -3 is not a non-negative integer"},
+		"nan_count":        {"{0.1,0.5,1}", "{2,NaN,5}", "count NaN is not a non-negative integer"},
+		"fractional_count": {"{0.1,0.5,1}", "{2,3.5,5}", "count 3.5 is not a non-negative integer"},
+		"unsorted_bounds":  {"{0.5,0.1,1}", "{2,3,5}", "not strictly increasing"},
+		"duplicate_bounds": {"{0.1,0.1,1}", "{2,3,5}", "not strictly increasing"},
+		"nan_bound":        {"{0.1,NaN,1}", "{2,3,5}", "not strictly increasing"},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			metrics, errs := s.procRows(q, columnNames, columnIdx,
+				[]interface{}{"postgres", []byte(tc.bounds), []byte(tc.counts), 4.2})
+			assert.Len(t, metrics, 0)
+			if assert.Len(t, errs, 1) {
+				assert.Contains(t, errs[0].Error(), tc.err)
+			}
+		})
+	}
+	t.Run("check", func(t *testing.T) {
+		q := &QueryInstance{
+			Name:    "pg_io_latency",
+			Metrics: []*Column{{Name: "seconds", Usage: HISTOGRAM, Counts: "counts"}},
+		}
+		assert.Error(t, q.Check())
+	})
+}
+
+func TestServer_doCollectMetric_keyValue(t *testing.T) {
+	s := &Server{namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name:     "og_show_stats",
+		KeyValue: true,
+		Queries:  []*Query{{SQL: "SHOW STATS"}},
+	}
+	assert.NoError(t, q.Check())
+	// checked again on reload
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery("SHOW STATS").WillReturnRows(
+		sqlmock.NewRows([]string{"item", "setting"}).
+			AddRow("active.sessions", "12").
+			AddRow("wal_buffers_full", []byte("3.5")).
+			AddRow("archive_mode", "on"))
+	metrics, errs, err := s.doCollectMetric(q, conn)
+	assert.NoError(t, err)
+	assert.Len(t, errs, 0)
+	values := map[string]float64{}
+	for _, m := range metrics {
+		var pb dto.Metric
+		assert.NoError(t, m.Write(&pb))
+		desc := m.Desc().String()
+		values[desc[strings.Index(desc, `"`)+1:strings.Index(desc, `",`)]] = pb.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{
+		"og_show_stats_active_sessions":  12,
+		"og_show_stats_wal_buffers_full": 3.5,
+		"og_show_stats_archive_mode":     1,
+	}, values)
+
+	mock.ExpectQuery("SHOW STATS").WillReturnRows(
+		sqlmock.NewRows([]string{"item", "setting", "desc"}).AddRow("a", "1", "x"))
+	_, _, err = s.doCollectMetric(q, conn)
+	assert.Error(t, err)
+
+	t.Run("check", func(t *testing.T) {
+		q := &QueryInstance{Name: "q", KeyValue: true, PivotColumns: []string{"a"}, Queries: []*Query{{SQL: "SHOW STATS"}}}
+		assert.Error(t, q.Check())
+		q = &QueryInstance{Name: "q", KeyValue: true, Queries: []*Query{{SQL: "SHOW STATS"}},
+			Metrics: []*Column{{Name: "name", Usage: DISCARD}, {Name: "value", Usage: INFO}}}
+		assert.Error(t, q.Check())
+		q = &QueryInstance{Name: "q", KeyValue: true, Queries: []*Query{{SQL: "SHOW STATS"}},
+			Metrics: []*Column{{Name: "name", Usage: DISCARD}, {Name: "value", Usage: COUNTER}}}
+		assert.NoError(t, q.Check())
+	})
+}
+
+func TestServer_queryMetric_totalTimeout(t *testing.T) {
+	q := &QueryInstance{
+		Name:         "pg_slow_rows",
+		Timeout:      1,
+		TotalTimeout: 0.05,
+		Queries:      []*Query{{SQL: "SELECT relname, size FROM t"}},
+		Metrics: []*Column{
+			{Name: "relname", Usage: LABEL},
+			{Name: "size", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	rows := sqlmock.NewRows([]string{"relname", "size"})
+	for i := 0; i < 20; i++ {
+		rows.AddRow(fmt.Sprintf("t%d", i), int64(i))
+	}
+	var renamed int
+	s := &Server{
+		namespace:    "pg",
+		labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+		disableCache: true,
+		metricCache:  map[string]*cachedMetrics{},
+		// slow row processing
+		renamer: func(name string) string {
+			renamed++
+			time.Sleep(10 * time.Millisecond)
+			return name
+		},
+	}
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery("SELECT relname").WillReturnRows(rows)
+	ch := make(chan prometheus.Metric, 100)
+	err := s.queryMetric(ch, q, conn)
+	close(ch)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrTimeout))
+		assert.Contains(t, err.Error(), "total timeout")
+	}
+	assert.Less(t, renamed, 20)
+	assert.Equal(t, float64(0), s.queryScrapeMetricCount[q.Name])
+	for m := range ch {
+		assert.NotContains(t, m.Desc().String(), "pg_slow_rows_size")
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_queryMetric_columnOrder(t *testing.T) {
+	q := &QueryInstance{
+		Name:    "pg_db",
+		Queries: []*Query{{SQL: "SELECT * FROM db_stats"}},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "size", Usage: GAUGE},
+			{Name: "age", Usage: COUNTER},
+		},
+	}
+	assert.NoError(t, q.Check())
+	s := &Server{
+		namespace:   "pg",
+		labels:      prometheus.Labels{serverLabelName: "localhost:5432"},
+		metricCache: map[string]*cachedMetrics{},
+	}
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery("SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"datname", "size", "age"}).AddRow("postgres", int64(10), int64(3)))
+	// columns reordered by schema change
+	mock.ExpectQuery("SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"age", "extra", "datname", "size"}).AddRow(int64(4), "x", "postgres", int64(20)))
+	scrape := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		assert.NoError(t, s.queryMetric(ch, q, conn))
+		close(ch)
+		var metrics []prometheus.Metric
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		return metrics
+	}
+	descs := func(metrics []prometheus.Metric) []string {
+		var descs []string
+		for _, m := range metrics {
+			descs = append(descs, m.Desc().String())
+		}
+		return descs
+	}
+	cached := scrape()
+	cachedDescs := descs(cached)
+	s.metricCache = map[string]*cachedMetrics{}
+	live := scrape()
+	assert.Equal(t, cachedDescs, descs(live))
+	// metrics served from cache keep their own desc
+	assert.Equal(t, cachedDescs, descs(cached))
+	assert.Nil(t, q.Columns["size"].PrometheusDesc)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_queryMetrics_deltaOnly(t *testing.T) {
+	q := &QueryInstance{
+		Name:    "pg_table",
+		Queries: []*Query{{SQL: "SELECT relname, size FROM t"}},
+		Metrics: []*Column{
+			{Name: "relname", Usage: LABEL},
+			{Name: "size", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		db:           db,
+		namespace:    "pg",
+		labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+		parallel:     1,
+		disableCache: true,
+		deltaOnly:    true,
+		metricCache:  map[string]*cachedMetrics{},
+	}
+	mock.ExpectQuery("SELECT relname").WillReturnRows(sqlmock.NewRows([]string{"relname", "size"}).
+		AddRow("t1", int64(10)).AddRow("t2", int64(20)))
+	mock.ExpectQuery("SELECT relname").WillReturnRows(sqlmock.NewRows([]string{"relname", "size"}).
+		AddRow("t1", int64(10)).AddRow("t2", int64(21)).AddRow("t3", int64(30)))
+	mock.ExpectQuery("SELECT relname").WillReturnRows(sqlmock.NewRows([]string{"relname", "size"}).
+		AddRow("t1", int64(10)))
+	scrape := func() map[string]float64 {
+		ch := make(chan prometheus.Metric, 100)
+		assert.Len(t, s.queryMetrics(ch, map[string]*QueryInstance{q.Name: q}), 0)
+		close(ch)
+		values := map[string]float64{}
+		for m := range ch {
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			values[pb.GetLabel()[0].GetValue()] = pb.GetGauge().GetValue()
+		}
+		return values
+	}
+	assert.Equal(t, map[string]float64{"t1": 10, "t2": 20}, scrape())
+	// unchanged t1 suppressed, changed t2 and new t3 emitted
+	assert.Equal(t, map[string]float64{"t2": 21, "t3": 30}, scrape())
+	assert.Equal(t, map[string]float64{}, scrape())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_doCollectMetric_duplicateColumns(t *testing.T) {
+	q := &QueryInstance{
+		Name:    "pg_join",
+		Queries: []*Query{{SQL: "SELECT a.id, b.id, a.size FROM a JOIN b USING (k)"}},
+		Metrics: []*Column{
+			{Name: "id", Usage: LABEL},
+			{Name: "id_2", Usage: LABEL},
+			{Name: "size", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "id", "size"}).AddRow("1", "2", int64(10))
+	}
+	t.Run("rename", func(t *testing.T) {
+		s := &Server{namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT a.id").WillReturnRows(rows())
+		metrics, errs, err := s.doCollectMetric(q, conn)
+		assert.NoError(t, err)
+		assert.Len(t, errs, 0)
+		if assert.Len(t, metrics, 1) {
+			var pb dto.Metric
+			assert.NoError(t, metrics[0].Write(&pb))
+			labels := map[string]string{}
+			for _, l := range pb.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			assert.Equal(t, "1", labels["id"])
+			assert.Equal(t, "2", labels["id_2"])
+		}
+	})
+	t.Run("strict", func(t *testing.T) {
+		s := &Server{namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"}, strictColumns: true}
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT a.id").WillReturnRows(rows())
+		metrics, _, err := s.doCollectMetric(q, conn)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "duplicate columns id")
+		assert.Len(t, metrics, 0)
+	})
+	t.Run("disambiguateColumns", func(t *testing.T) {
+		names, duplicates := disambiguateColumns([]string{"id", "x", "id", "x", "id"})
+		assert.Equal(t, []string{"id", "x", "id_2", "x_2", "id_3"}, names)
+		assert.Equal(t, []string{"id", "x"}, duplicates)
+		names, duplicates = disambiguateColumns([]string{"a", "b"})
+		assert.Equal(t, []string{"a", "b"}, names)
+		assert.Len(t, duplicates, 0)
+	})
+}
+
+func TestServer_doCollectMetric_planDiagnostics(t *testing.T) {
+	s := &Server{
+		namespace:       "pg",
+		labels:          prometheus.Labels{serverLabelName: "localhost:5432"},
+		planDiagnostics: true,
+	}
+	q := &QueryInstance{
+		Name:    "pg_table_bloat",
+		Queries: []*Query{{SQL: "SELECT relname, bloat_bytes FROM bloat;"}},
+		Metrics: []*Column{
+			{Name: "relname", Usage: LABEL},
+			{Name: "bloat_bytes", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery("SELECT relname").WillReturnRows(
+		sqlmock.NewRows([]string{"relname", "bloat_bytes"}).AddRow("t1", int64(8192)))
+	mock.ExpectQuery(regexp.QuoteMeta("EXPLAIN (FORMAT JSON) SELECT relname, bloat_bytes FROM bloat")).WillReturnRows(
+		sqlmock.NewRows([]string{"QUERY PLAN"}).AddRow([]byte(`[{"Plan": {"Node Type": "Seq Scan", "Startup Cost": 0.00, "Total Cost": 1234.5}}]`)))
+	// explained once in interval
+	mock.ExpectQuery("SELECT relname").WillReturnRows(
+		sqlmock.NewRows([]string{"relname", "bloat_bytes"}).AddRow("t1", int64(8192)))
+	for i := 0; i < 2; i++ {
+		_, _, err := s.doCollectMetric(q, conn)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	ch := make(chan prometheus.Metric, 100)
+	s.collectQueryInternalMetrics(ch)
+	close(ch)
+	var costs []float64
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), `"pg_exporter_query_plan_cost"`) {
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			costs = append(costs, pb.GetGauge().GetValue())
+		}
+	}
+	assert.Equal(t, []float64{1234.5}, costs)
+
+	t.Run("searchPath", func(t *testing.T) {
+		s := &Server{namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"}, planDiagnostics: true}
+		q := &QueryInstance{
+			Name:       "pg_table_bloat",
+			SearchPath: "app",
+			Queries:    []*Query{{SQL: "SELECT relname, bloat_bytes FROM bloat;", Timeout: 1}},
+			Metrics: []*Column{
+				{Name: "relname", Usage: LABEL},
+				{Name: "bloat_bytes", Usage: GAUGE},
+			},
+		}
+		assert.NoError(t, q.Check())
+		conn, mock := genMockDB(t, s)
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL search_path = app").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT relname").WillReturnRows(
+			sqlmock.NewRows([]string{"relname", "bloat_bytes"}).AddRow("t1", int64(8192)))
+		mock.ExpectRollback()
+		// plan of query is resolved on the same search_path
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL search_path = app").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("EXPLAIN (FORMAT JSON) SELECT relname")).WillReturnRows(
+			sqlmock.NewRows([]string{"QUERY PLAN"}).AddRow([]byte(`[{"Plan": {"Total Cost": 10}}]`)))
+		mock.ExpectRollback()
+		_, _, err := s.doCollectMetric(q, conn)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, map[string]float64{"pg_table_bloat": 10}, s.planCost)
+	})
+	t.Run("parsePlanCost", func(t *testing.T) {
+		_, err := parsePlanCost([]byte(`[]`))
+		assert.Error(t, err)
+		_, err = parsePlanCost([]byte(`not json`))
+		assert.Error(t, err)
+	})
+}
+
+func TestServer_doCollectMetric_params(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name:    "pg_activity",
+		Queries: []*Query{{SQL: `SELECT state, count(*) AS count FROM pg_stat_get_activity($1) GROUP BY state`, Params: []QueryParam{nil}}},
+		Metrics: []*Column{
+			{Name: "state", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+	// NULL argument of set-returning function means all backends
+	mock.ExpectQuery(regexp.QuoteMeta("FROM pg_stat_get_activity($1)")).WithArgs(nil).WillReturnRows(
+		sqlmock.NewRows([]string{"state", "count"}).AddRow("active", int64(2)).AddRow("idle", int64(5)))
+	metrics, errs, err := s.doCollectMetric(q, conn)
+	assert.NoError(t, err)
+	assert.Len(t, errs, 0)
+	assert.Len(t, metrics, 2)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_doCollectMetric_perSchema(t *testing.T) {
+	s := &Server{
+		labels:  prometheus.Labels{serverLabelName: "localhost:5432"},
+		schemas: []string{"public", "o'brien"},
+	}
+	q := &QueryInstance{
+		Name:      "pg_schema",
+		PerSchema: true,
+		Queries:   []*Query{{SQL: `SELECT {{schema}} AS schema, count(*) AS tables FROM pg_tables WHERE schemaname = {{schema}}`}},
+		Metrics: []*Column{
+			{Name: "schema", Usage: LABEL},
+			{Name: "tables", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT 'public' AS schema, count(*) AS tables FROM pg_tables WHERE schemaname = 'public'`)).WillReturnRows(
+		sqlmock.NewRows([]string{"schema", "tables"}).AddRow("public", int64(3)))
+	// failure of one schema is not fatal
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE schemaname = 'o''brien'`)).WillReturnError(fmt.Errorf("permission denied"))
+	metrics, errs, err := s.doCollectMetric(q, conn)
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	if assert.Len(t, errs, 1) {
+		assert.Contains(t, errs[0].Error(), "schema o'brien")
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	t.Run("no_placeholder", func(t *testing.T) {
+		q := &QueryInstance{Name: "pg_schema", PerSchema: true, Queries: []*Query{{SQL: `SELECT 1 AS tables`}}}
+		assert.Error(t, q.Check())
+	})
+}
+
+func TestServer_doCollectMetric_partialRows(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name:        "pg_lock",
+		Queries:     []*Query{{SQL: `SELECT mode, count FROM pg_locks`}},
+		Completions: map[string][]string{"mode": {"AccessShareLock", "RowShareLock", "ExclusiveLock"}},
+		Metrics: []*Column{
+			{Name: "mode", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	conn, mock := genMockDB(t, s)
+	// third row fails on fetch, e.g. a value the driver can not convert
+	mock.ExpectQuery("SELECT mode").WillReturnRows(
+		sqlmock.NewRows([]string{"mode", "count"}).
+			AddRow("AccessShareLock", 1).
+			AddRow("RowShareLock", 2).
+			AddRow("ExclusiveLock", "x").
+			RowError(2, fmt.Errorf(`invalid input syntax for integer: "x"`)))
+	metrics, errs, err := s.doCollectMetric(q, conn)
+	assert.NoError(t, err)
+	if assert.Len(t, errs, 1) {
+		assert.Contains(t, errs[0].Error(), "row 2")
+	}
+	// partial result is not completed with zero rows
+	if assert.Len(t, metrics, 2) {
+		for i, want := range []float64{1, 2} {
+			var pb dto.Metric
+			assert.NoError(t, metrics[i].Write(&pb))
+			assert.Equal(t, want, pb.GetGauge().GetValue())
+		}
+	}
+}
+
+func TestServer_queryMetrics_dedupMetrics(t *testing.T) {
+	q := &QueryInstance{
+		Name:    "pg_xlog",
+		Queries: []*Query{{SQL: "SELECT slot_name, lsn FROM pg_xlog"}},
+		Metrics: []*Column{{Name: "slot_name", Usage: LABEL}, {Name: "lsn", Usage: GAUGE}},
+	}
+	assert.NoError(t, q.Check())
+	// rows without label column have the same label set
+	labelLess := &QueryInstance{
+		Name:    "pg_xlog",
+		Queries: []*Query{{SQL: "SELECT lsn FROM pg_xlog"}},
+		Metrics: []*Column{{Name: "lsn", Usage: GAUGE}},
+	}
+	assert.NoError(t, labelLess.Check())
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("labelled_dedup_%v", enabled), func(t *testing.T) {
+			s := &Server{
+				namespace:    "pg",
+				labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+				parallel:     1,
+				disableCache: true,
+				dedupMetrics: enabled,
+				metricCache:  map[string]*cachedMetrics{},
+			}
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.db = db
+			mock.ExpectQuery("FROM pg_xlog").WillReturnRows(sqlmock.NewRows([]string{"slot_name", "lsn"}).
+				AddRow("slot1", int64(1)).AddRow("slot1", int64(2)))
+			ch := make(chan prometheus.Metric, 100)
+			assert.Len(t, s.queryMetrics(ch, map[string]*QueryInstance{"pg_xlog": q}), 0)
+			assert.NoError(t, mock.ExpectationsWereMet())
+			close(ch)
+			var values []float64
+			for m := range ch {
+				if strings.Contains(m.Desc().String(), `"pg_xlog_lsn"`) {
+					var pb dto.Metric
+					assert.NoError(t, m.Write(&pb))
+					values = append(values, pb.GetGauge().GetValue())
+				}
+			}
+			// both keep the last of rows repeating labels
+			assert.Equal(t, []float64{2}, values)
+		})
+		t.Run(fmt.Sprintf("dedup_%v", enabled), func(t *testing.T) {
+			s := &Server{
+				namespace:    "pg",
+				labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+				parallel:     1,
+				disableCache: true,
+				dedupMetrics: enabled,
+				metricCache:  map[string]*cachedMetrics{},
+			}
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.db = db
+			mock.ExpectQuery("FROM pg_xlog").WillReturnRows(sqlmock.NewRows([]string{"lsn"}).
+				AddRow(int64(1)).AddRow(int64(2)))
+			ch := make(chan prometheus.Metric, 100)
+			assert.Len(t, s.queryMetrics(ch, map[string]*QueryInstance{"pg_xlog": labelLess}), 0)
+			assert.NoError(t, mock.ExpectationsWereMet())
+			close(ch)
+			var values []float64
+			for m := range ch {
+				if strings.Contains(m.Desc().String(), `"pg_xlog_lsn"`) {
+					var pb dto.Metric
+					assert.NoError(t, m.Write(&pb))
+					values = append(values, pb.GetGauge().GetValue())
+				}
+			}
+			if enabled {
+				assert.Equal(t, []float64{2}, values)
+			} else {
+				assert.Equal(t, []float64{1, 2}, values)
+			}
+		})
+	}
+}
+
+func TestServer_queryMetrics_derivedMetrics(t *testing.T) {
+	newQuery := func(name, column string, derived ...*DerivedMetric) *QueryInstance {
+		q := &QueryInstance{
+			Name:           name,
+			Queries:        []*Query{{SQL: "SELECT datname," + column + " FROM " + name}},
+			Metrics:        []*Column{{Name: "datname", Usage: LABEL}, {Name: column, Usage: COUNTER}},
+			DerivedMetrics: derived,
+		}
+		assert.NoError(t, q.Check())
+		return q
+	}
+	s := &Server{
+		namespace:    "pg",
+		labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+		parallel:     1,
+		disableCache: true,
+		metricCache:  map[string]*cachedMetrics{},
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db = db
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery("FROM pg_hit").WillReturnRows(sqlmock.NewRows([]string{"datname", "hit"}).
+		AddRow("postgres", int64(30)).AddRow("omm", int64(0)))
+	mock.ExpectQuery("FROM pg_read").WillReturnRows(sqlmock.NewRows([]string{"datname", "read"}).
+		AddRow("postgres", int64(10)).AddRow("omm", int64(0)))
+	ch := make(chan prometheus.Metric, 100)
+	assert.Len(t, s.queryMetrics(ch, map[string]*QueryInstance{
+		"pg_hit": newQuery("pg_hit", "hit"),
+		"pg_read": newQuery("pg_read", "read", &DerivedMetric{
+			Name: "hit_ratio",
+			Expr: "pg_hit_hit / (pg_hit_hit + pg_read_read)",
+		}),
+	}), 0)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	close(ch)
+	var (
+		metrics []string
+		ratios  = map[string]float64{}
+	)
+	for m := range ch {
+		desc := m.Desc().String()
+		metrics = append(metrics, desc)
+		if strings.Contains(desc, `"pg_read_hit_ratio"`) {
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			for _, l := range pb.Label {
+				if l.GetName() == "datname" {
+					ratios[l.GetValue()] = pb.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	assert.Len(t, metrics, 6)
+	// derived metrics follow base metrics
+	assert.Contains(t, metrics[4], `"pg_read_hit_ratio"`)
+	assert.Equal(t, 0.75, ratios["postgres"])
+	assert.True(t, math.IsNaN(ratios["omm"]))
+}
+
+func TestServer_doCollectMetric_fallbackQuery(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_view",
+		Queries: []*Query{
+			{SQL: "SELECT count FROM pg_new_view"},
+			{SQL: "SELECT count FROM pg_old_view"},
+		},
+		Metrics: []*Column{{Name: "count", Usage: GAUGE}},
+	}
+	assert.NoError(t, queryInstance.Check())
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		db:             db,
+		namespace:      "pg",
+		primary:        true,
+		lastMapVersion: semver.MustParse("3.0.0"),
+		labels:         prometheus.Labels{serverLabelName: "localhost:5432"},
+		exposeQuerySQL: true,
+	}
+	assert.Len(t, queryInstance.GetQuerySQLs(s.lastMapVersion, s.primary), 2)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("SELECT count FROM pg_new_view").WillReturnError(fmt.Errorf(`relation "pg_new_view" does not exist`))
+	mock.ExpectQuery("SELECT count FROM pg_old_view").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(3)))
+	metrics, nonFatalErrors, err := s.doCollectMetric(queryInstance, conn)
+	assert.NoError(t, err)
+	assert.Len(t, nonFatalErrors, 0)
+	if assert.Len(t, metrics, 1) {
+		var pb dto.Metric
+		assert.NoError(t, metrics[0].Write(&pb))
+		assert.Equal(t, float64(3), pb.GetGauge().GetValue())
+	}
+	assert.Equal(t, float64(1), s.queryFallback["pg_view"])
+	assert.Equal(t, "SELECT count FROM pg_old_view", s.querySQLText["pg_view"])
+
+	// all queries fail, error of the last one is returned
+	mock.ExpectQuery("SELECT count FROM pg_new_view").WillReturnError(fmt.Errorf("timeout"))
+	mock.ExpectQuery("SELECT count FROM pg_old_view").WillReturnError(fmt.Errorf("permission denied"))
+	_, _, err = s.doCollectMetric(queryInstance, conn)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "permission denied")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestNewServer_targetLabelFromDSN(t *testing.T) {
+	dsn := "host=DB-Primary.Example.com port=1 user=monitor password=secret dbname=postgres connect_timeout=1"
+	s, _ := NewServer(dsn, ServerWithTargetLabelFromDSN(true))
+	if assert.NotNil(t, s) {
+		assert.Equal(t, "DB-Primary.Example.com:1", s.labels[serverLabelName])
+		fingerprint, err := parseFingerprint(dsn)
+		assert.NoError(t, err)
+		assert.Equal(t, fingerprint, s.fingerprint)
+		s.Close()
+	}
+}
+
+func TestNewServer_userLabel(t *testing.T) {
+	dsn := "host=127.0.0.1 port=1 user=monitor password=secret dbname=postgres connect_timeout=1"
+	for _, enabled := range []bool{true, false} {
+		s, _ := NewServer(dsn, ServerWithUserLabel(enabled), ServerWithNamespace("pg"))
+		if !assert.NotNil(t, s) {
+			return
+		}
+		ch := make(chan prometheus.Metric, 100)
+		s.collectorServerInternalMetrics(ch)
+		close(ch)
+		var found bool
+		for m := range ch {
+			desc := m.Desc().String()
+			assert.NotContains(t, desc, "secret")
+			if !strings.Contains(desc, `"pg_up"`) {
+				continue
+			}
+			found = true
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			labels := map[string]string{}
+			for _, l := range pb.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if enabled {
+				assert.Equal(t, "monitor", labels[userLabelName])
+			} else {
+				assert.NotContains(t, labels, userLabelName)
+			}
+		}
+		assert.True(t, found)
+		// query metrics are left without it
+		assert.NotContains(t, s.labels, userLabelName)
+		_ = s.Close()
+	}
+}
+
+func TestServer_targetErrorMetric(t *testing.T) {
+	dsn := "host=127.0.0.1 port=1 user=monitor password=secret dbname=postgres connect_timeout=1"
+	s, err := NewServer(dsn, ServerWithTargetError(true), ServerWithNamespace("pg"))
+	if !assert.NotNil(t, s) {
+		return
+	}
+	assert.Error(t, err)
+	targetErrors := func() []string {
+		ch := make(chan prometheus.Metric, 100)
+		s.collectorServerInternalMetrics(ch)
+		close(ch)
+		var errs []string
+		for m := range ch {
+			if !strings.Contains(m.Desc().String(), `"pg_exporter_target_error"`) {
+				continue
+			}
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			for _, l := range pb.GetLabel() {
+				if l.GetName() == "error" {
+					errs = append(errs, l.GetValue())
+				}
+			}
+		}
+		return errs
+	}
+	if errs := targetErrors(); assert.Len(t, errs, 1) {
+		assert.NotEmpty(t, errs[0])
+		assert.NotContains(t, errs[0], "secret")
+	}
+
+	t.Run("sanitize", func(t *testing.T) {
+		s.setConnError(fmt.Errorf("cannot parse `host=x password=secret`:\n  invalid"))
+		assert.Equal(t, "cannot parse `host=x password=****** invalid", s.connError)
+		s.setConnError(fmt.Errorf("%s", strings.Repeat("x", 300)))
+		assert.Len(t, []rune(s.connError), targetErrorLabelLength)
+	})
+
+	// target recovered, error is cleared
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db = db
+	assert.NoError(t, s.ConnectDatabase())
+	assert.Equal(t, "", s.connError)
+	assert.Len(t, targetErrors(), 0)
+	_ = s.Close()
+}
+
+func TestServer_keepAlive(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		fingerprint: "localhost:5432",
+		db:          db,
+		UP:          true,
+		primary:     true,
+		keepAlive:   time.Second,
+		labels:      prometheus.Labels{serverLabelName: "localhost:5432"},
+	}
+	// failover, server became standby
+	mock.ExpectPing()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_is_in_recovery()")).WillReturnRows(
+		sqlmock.NewRows([]string{"pg_is_in_recovery"}).AddRow(true))
+	s.keepAliveOnce()
+	assert.True(t, s.UP)
+	assert.False(t, s.primary)
+	// disconnected
+	mock.ExpectPing().WillReturnError(fmt.Errorf("connection reset by peer"))
+	s.keepAliveOnce()
+	assert.False(t, s.UP)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	t.Run("loop", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{fingerprint: "localhost:5432", db: db, UP: true, primary: true, keepAlive: 10 * time.Millisecond}
+		mock.ExpectPing().WillReturnError(fmt.Errorf("connection reset by peer"))
+		s.startKeepAlive()
+		s.startKeepAlive()
+		assert.Eventually(t, func() bool {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+			return !s.UP
+		}, time.Second, 10*time.Millisecond)
+		mock.ExpectClose()
+		assert.NoError(t, s.Close())
+		assert.Nil(t, s.keepAliveStop)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestServer_queryMetrics_memoryBudget(t *testing.T) {
+	newQuery := func(name string, priority int) *QueryInstance {
+		q := &QueryInstance{
+			Name:     name,
+			Priority: priority,
+			Queries:  []*Query{{SQL: "SELECT query, count FROM " + name}},
+			Metrics:  []*Column{{Name: "query", Usage: LABEL}, {Name: "count", Usage: GAUGE}},
+		}
+		assert.NoError(t, q.Check())
+		return q
+	}
+	s := &Server{
+		namespace:    "pg",
+		labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+		parallel:     1,
+		disableCache: true,
+		metricCache:  map[string]*cachedMetrics{},
+		memBudget:    4096,
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db = db
+	rows := sqlmock.NewRows([]string{"query", "count"})
+	for i := 0; i < 10; i++ {
+		rows.AddRow(strings.Repeat("x", 1000)+fmt.Sprint(i), int64(i))
+	}
+	mock.ExpectQuery("FROM pg_small").WillReturnRows(sqlmock.NewRows([]string{"query", "count"}).AddRow("select 1", int64(1)))
+	mock.ExpectQuery("FROM pg_large").WillReturnRows(rows)
+	ch := make(chan prometheus.Metric, 100)
+	errs := s.queryMetrics(ch, map[string]*QueryInstance{
+		"pg_small": newQuery("pg_small", 1),
+		"pg_large": newQuery("pg_large", 2),
+		"pg_next":  newQuery("pg_next", 3),
+	})
+	assert.NoError(t, mock.ExpectationsWereMet())
+	close(ch)
+	var emitted []string
+	for m := range ch {
+		emitted = append(emitted, m.Desc().String())
+	}
+	// metrics before budget exceeded are kept, large query is aborted and next one is skipped
+	if assert.Len(t, emitted, 1) {
+		assert.Contains(t, emitted[0], `"pg_small_count"`)
+	}
+	if assert.Len(t, errs, 2) {
+		assert.Contains(t, errs["pg_large"].Error(), "memory budget 4096 bytes exceeded")
+		assert.Contains(t, errs["pg_next"].Error(), "skipped")
+	}
+
+	ch = make(chan prometheus.Metric, 100)
+	s.collectQueryInternalMetrics(ch)
+	close(ch)
+	var memory float64
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), `"pg_exporter_scrape_memory_bytes"`) {
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			memory = pb.GetGauge().GetValue()
+		}
+	}
+	assert.Greater(t, memory, float64(4096))
+
+	t.Run("shared by databases", func(t *testing.T) {
+		other := &Server{
+			namespace:    "pg",
+			labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+			parallel:     1,
+			disableCache: true,
+			metricCache:  map[string]*cachedMetrics{},
+			memBudget:    4096,
+		}
+		serverWithScrapeMemory(s.memory())(other)
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.db = db
+		// budget used up by another database of the same scrape
+		errs := other.queryMetrics(make(chan prometheus.Metric, 100), map[string]*QueryInstance{"pg_small": newQuery("pg_small", 1)})
+		if assert.Contains(t, errs, "pg_small") {
+			assert.Contains(t, errs["pg_small"].Error(), "skipped")
+		}
+		// next scrape starts over
+		s.memory().reset()
+		mock.ExpectQuery("FROM pg_small").WillReturnRows(sqlmock.NewRows([]string{"query", "count"}).AddRow("select 1", int64(1)))
+		errs = other.queryMetrics(make(chan prometheus.Metric, 100), map[string]*QueryInstance{"pg_small": newQuery("pg_small", 1)})
+		assert.Len(t, errs, 0)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestNewServer_dialer(t *testing.T) {
+	var (
+		mtx   sync.Mutex
+		dials []string
+	)
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		dials = append(dials, network+" "+addr)
+		return nil, errors.New("tunnel down")
+	}
+	s, err := NewServer("host=10.9.9.9 port=15432 user=omm password=xxx dbname=postgres", ServerWithDialer(dialer))
+	assert.Error(t, err)
+	if assert.NotNil(t, s) {
+		assert.False(t, s.UP)
+		_ = s.Close()
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if assert.NotEmpty(t, dials) {
+		assert.Equal(t, "tcp 10.9.9.9:15432", dials[0])
+	}
+}
+
+func TestServer_reconnectOnError(t *testing.T) {
+	q := &QueryInstance{
+		Name:    "pg_lock",
+		Queries: []*Query{{SQL: `SELECT count FROM pg_locks`}},
+		Metrics: []*Column{{Name: "count", Usage: GAUGE}},
+	}
+	assert.NoError(t, q.Check())
+	t.Run("admin shutdown", func(t *testing.T) {
+		s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}, UP: true}
+		ServerWithReconnectSQLStates(defaultReconnectSQLStates)(s)
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT count").WillReturnError(&pq.Error{Code: "57P01",
+			Message: "terminating connection due to administrator command"})
+		_, _, err := s.doCollectMetric(q, conn)
+		assert.Error(t, err)
+		// closed only after workers drained
+		assert.True(t, s.UP)
+		assert.True(t, s.reconnectPending)
+		s.closeOnReconnect()
+		assert.False(t, s.UP)
+		assert.False(t, s.reconnectPending)
+		assert.Error(t, s.CheckConn())
+	})
+	t.Run("other error", func(t *testing.T) {
+		s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}, UP: true}
+		ServerWithReconnectSQLStates(defaultReconnectSQLStates)(s)
+		conn, mock := genMockDB(t, s)
+		mock.ExpectQuery("SELECT count").WillReturnError(&pq.Error{Code: "42P01",
+			Message: `relation "pg_locks" does not exist`})
+		_, _, err := s.doCollectMetric(q, conn)
+		assert.Error(t, err)
+		s.closeOnReconnect()
+		assert.True(t, s.UP)
+	})
+}
+
+func TestServer_procRows_timestampColumn(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	q := &QueryInstance{
+		Name:            "pg_snapshot",
+		TimestampColumn: "snap_time",
+		Queries: []*Query{
+			{SQL: `SELECT node, snap_time, size FROM snapshot`},
+		},
+		Metrics: []*Column{
+			{Name: "node", Usage: LABEL},
+			{Name: "snap_time", Usage: DISCARD},
+			{Name: "size", Usage: GAUGE},
+		},
+	}
+	assert.NoError(t, q.Check())
+	columnNames := []string{"node", "snap_time", "size"}
+	columnIdx := map[string]int{"node": 0, "snap_time": 1, "size": 2}
+	snapTime := time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	metrics, errs := s.procRows(q, columnNames, columnIdx, []interface{}{"dn_6001", snapTime, int64(10)})
+	assert.Len(t, errs, 0)
+	if assert.Len(t, metrics, 1) {
+		var m dto.Metric
+		assert.NoError(t, metrics[0].Write(&m))
+		assert.Equal(t, snapTime.UnixNano()/int64(time.Millisecond), m.GetTimestampMs())
+		assert.Equal(t, float64(10), m.GetGauge().GetValue())
+	}
+	t.Run("not time", func(t *testing.T) {
+		metrics, errs := s.procRows(q, columnNames, columnIdx, []interface{}{"dn_6001", "yesterday", int64(10)})
+		assert.Len(t, errs, 1)
+		if assert.Len(t, metrics, 1) {
+			var m dto.Metric
+			assert.NoError(t, metrics[0].Write(&m))
+			assert.Nil(t, m.TimestampMs)
+		}
+	})
+	t.Run("check", func(t *testing.T) {
+		q.TimestampColumn = "size"
+		assert.Error(t, q.Check())
+		q.TimestampColumn = "missing"
+		assert.Error(t, q.Check())
+	})
+}
+
+func TestServer_queryMetric_errorLogInterval(t *testing.T) {
+	hook := newLogHook(t)
+	q := &QueryInstance{
+		Name:    "pg_missing_view",
+		Queries: []*Query{{SQL: `SELECT count FROM pg_missing_view`}},
+		Metrics: []*Column{{Name: "count", Usage: GAUGE}},
+	}
+	assert.NoError(t, q.Check())
+	countLogs := func() int {
+		var n int
+		for _, entry := range hook.AllEntries() {
+			if strings.Contains(entry.Message, "[pg_missing_view]") && strings.Contains(entry.Message, "nonFatalErrors") {
+				n++
+			}
+		}
+		return n
+	}
+	s := &Server{
+		labels:           prometheus.Labels{serverLabelName: "localhost:5432"},
+		disableCache:     true,
+		errorLogInterval: time.Minute,
+		metricCache:      map[string]*cachedMetrics{},
+	}
+	conn, mock := genMockDB(t, s)
+	countErrorLogs := func() int {
+		var n int
+		for _, entry := range hook.AllEntries() {
+			if entry.Level <= logrus.ErrorLevel && strings.Contains(entry.Message, "[pg_missing_view]") {
+				n++
+			}
+		}
+		return n
+	}
+	ch := make(chan prometheus.Metric, 10)
+	var first int
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("SELECT count").WillReturnError(fmt.Errorf(`relation "pg_missing_view" does not exist`))
+		assert.Error(t, s.queryMetric(ch, q, conn))
+		if i == 0 {
+			first = countErrorLogs()
+		}
+	}
+	assert.Equal(t, 1, countLogs())
+	// no error log of failed query escapes throttle
+	assert.Equal(t, first, countErrorLogs())
+	assert.Equal(t, 2, s.errorLogThrottle[q.Name].suppressed)
+	// window passed, log again with summary of suppressed errors
+	s.errorLogThrottle[q.Name].last = time.Now().Add(-time.Hour)
+	mock.ExpectQuery("SELECT count").WillReturnError(fmt.Errorf(`relation "pg_missing_view" does not exist`))
+	assert.Error(t, s.queryMetric(ch, q, conn))
+	assert.Equal(t, 2, countLogs())
+	assert.Equal(t, 0, s.errorLogThrottle[q.Name].suppressed)
+}
+
+func TestServer_checkPrivilege(t *testing.T) {
+	// security views are default queries, gated by privilege of monitoring role
+	for _, name := range []string{"pg_long_running_query", "pg_session_memory"} {
+		if assert.Contains(t, defaultMonList, name) {
+			assert.NotEmpty(t, defaultMonList[name].Requires)
+		}
+	}
+	q := pgSessionMemory
+	assert.NoError(t, q.Check())
+	s := &Server{
+		namespace:      "pg",
+		labels:         prometheus.Labels{serverLabelName: "localhost:5432"},
+		lastMapVersion: semver.MustParse("2.0.0"),
+		primary:        true,
+		disableCache:   true,
+		metricCache:    map[string]*cachedMetrics{},
+	}
+	conn, mock := genMockDB(t, s)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT has_table_privilege($1, 'SELECT')")).
+		WithArgs("gs_session_memory_detail").
+		WillReturnRows(sqlmock.NewRows([]string{"has_table_privilege"}).AddRow(false))
+	ch := make(chan prometheus.Metric, 10)
+	// probed once, disabled query is neither queried nor reported as error
+	assert.NoError(t, s.queryMetric(ch, q, conn))
+	assert.NoError(t, s.queryMetric(ch, q, conn))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Len(t, ch, 0)
+
+	s.collectQueryInternalMetrics(ch)
+	close(ch)
+	var disabled []string
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), `"pg_exporter_query_disabled"`) {
+			continue
+		}
+		var pb dto.Metric
+		assert.NoError(t, m.Write(&pb))
+		assert.Equal(t, float64(1), pb.GetGauge().GetValue())
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "query" {
+				disabled = append(disabled, l.GetValue())
+			}
+		}
+	}
+	assert.Equal(t, []string{"pg_session_memory"}, disabled)
+
+	// probe again after reconnect
+	s.resetPrivilegeCheck()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT has_table_privilege($1, 'SELECT')")).
+		WithArgs("gs_session_memory_detail").
+		WillReturnRows(sqlmock.NewRows([]string{"has_table_privilege"}).AddRow(true))
+	mock.ExpectQuery("SELECT contextname").WillReturnRows(
+		sqlmock.NewRows([]string{"contextname", "total_bytes", "used_bytes"}).AddRow("SessionCacheMemoryContext", 1024, 512))
+	ch = make(chan prometheus.Metric, 10)
+	assert.NoError(t, s.queryMetric(ch, q, conn))
+	assert.Len(t, ch, 2)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_statStatements(t *testing.T) {
+	q := newPgStatStatements(2)
+	assert.NoError(t, q.Check())
+	assert.Contains(t, q.Queries[0].SQL, "LIMIT 2")
+	s := &Server{
+		namespace:    "pg",
+		labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+		disableCache: true,
+		metricCache:  map[string]*cachedMetrics{},
+	}
+	extensionQuery := regexp.QuoteMeta("SELECT count(*) > 0 FROM pg_extension WHERE extname = $1")
+	t.Run("top_n", func(t *testing.T) {
+		conn, mock := genMockDB(t, s)
+		s.resetPrivilegeCheck()
+		mock.ExpectQuery(extensionQuery).WithArgs("pg_stat_statements").
+			WillReturnRows(sqlmock.NewRows([]string{"installed"}).AddRow(true))
+		mock.ExpectQuery("FROM pg_stat_statements").WillReturnRows(
+			sqlmock.NewRows([]string{"datname", "queryid", "calls", "total_time", "rows"}).
+				AddRow("postgres", "1001", 10, 500.5, 100).
+				AddRow("postgres", "1002", 5, 200.0, 10).
+				AddRow("postgres", "1003", 1, 1.0, 1))
+		ch := make(chan prometheus.Metric, 20)
+		_ = s.queryMetric(ch, q, conn)
+		close(ch)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		queryIDs := map[string]bool{}
+		for m := range ch {
+			if !strings.Contains(m.Desc().String(), `"pg_stat_statements_calls"`) {
+				continue
+			}
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			for _, l := range pb.GetLabel() {
+				if l.GetName() == "queryid" {
+					queryIDs[l.GetValue()] = true
+				}
+			}
+		}
+		assert.Equal(t, map[string]bool{"1001": true, "1002": true}, queryIDs)
+	})
+	t.Run("extension_absent", func(t *testing.T) {
+		conn, mock := genMockDB(t, s)
+		s.resetPrivilegeCheck()
+		mock.ExpectQuery(extensionQuery).WithArgs("pg_stat_statements").
+			WillReturnRows(sqlmock.NewRows([]string{"installed"}).AddRow(false))
+		ch := make(chan prometheus.Metric, 20)
+		assert.NoError(t, s.queryMetric(ch, q, conn))
+		assert.NoError(t, s.queryMetric(ch, q, conn))
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Len(t, ch, 0)
+		assert.Contains(t, s.disabledQueries["pg_stat_statements"], "extension pg_stat_statements is not installed")
+	})
+}
+
+func TestServer_procRows_databaseSizePretty(t *testing.T) {
+	s := &Server{labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	assert.NoError(t, pgDatabasePretty.Check())
+	metrics, errs := s.procRows(pgDatabasePretty, []string{"datname", "size_bytes", "size_info"},
+		map[string]int{"datname": 0, "size_bytes": 1, "size_info": 2},
+		[]interface{}{"postgres", int64(1288490189), "1229 MB"})
+	assert.Len(t, errs, 0)
+	values := map[string]float64{}
+	pretty := ""
+	for _, m := range metrics {
+		var pb dto.Metric
+		assert.NoError(t, m.Write(&pb))
+		for _, name := range []string{"pg_database_size_bytes", "pg_database_size_info"} {
+			if strings.Contains(m.Desc().String(), `"`+name+`"`) {
+				values[name] = pb.GetGauge().GetValue()
+			}
+		}
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "pretty" {
+				pretty = l.GetValue()
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"pg_database_size_bytes": 1288490189, "pg_database_size_info": 1}, values)
+	assert.Equal(t, "1229 MB", pretty)
+}
+
+func TestServer_certExpiry(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second).UTC()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	// handshake like the driver does with tls config of the host it connects to
+	handshake := func(config *tls.Config) error {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			server, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer server.Close()
+			_ = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+		}()
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		return tls.Client(client, config).Handshake()
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		s := &Server{namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+		config := &pq.Config{
+			TLSConfig: &tls.Config{InsecureSkipVerify: true}, // nolint: gosec
+			Fallbacks: []*pq.FallbackConfig{
+				{Host: "standby", TLSConfig: &tls.Config{InsecureSkipVerify: true}}, // nolint: gosec
+				{Host: "standby"},
+			},
+		}
+		s.watchCertExpiry(config)
+		// sslmode prefer falls back to a host without tls config
+		assert.Nil(t, config.Fallbacks[1].TLSConfig)
+		assert.Nil(t, s.certExpiryMetric())
+		// certificate of the host actually connected to is recorded
+		assert.NoError(t, handshake(config.Fallbacks[0].TLSConfig))
+		m := s.certExpiryMetric()
+		if assert.NotNil(t, m) {
+			var pb dto.Metric
+			assert.NoError(t, m.Write(&pb))
+			assert.Equal(t, float64(notAfter.Unix()), pb.GetGauge().GetValue())
+			assert.Contains(t, m.Desc().String(), "pg_exporter_tls_cert_expiry_timestamp_seconds")
+		}
+	})
+	t.Run("verify failed", func(t *testing.T) {
+		s := &Server{namespace: "pg"}
+		config := &pq.Config{TLSConfig: &tls.Config{ServerName: "localhost"}}
+		s.watchCertExpiry(config)
+		// self signed certificate is rejected by driver verification, nothing is recorded
+		assert.Error(t, handshake(config.TLSConfig))
+		assert.Nil(t, s.certExpiryMetric())
+	})
+	t.Run("reconnect", func(t *testing.T) {
+		s := &Server{
+			dsn:           "host=localhost port=5432 sslmode=require",
+			tlsCertExpiry: true,
+			certExpiry:    notAfter,
+			dialer: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, fmt.Errorf("dial error")
+			},
+		}
+		assert.Error(t, s.ConnectDatabase())
+		assert.Nil(t, s.certExpiryMetric())
+	})
+}
+
+func TestServer_queryMetrics_priority(t *testing.T) {
+	newQuery := func(name string, priority int) *QueryInstance {
+		q := &QueryInstance{
+			Name:     name,
+			Priority: priority,
+			Queries:  []*Query{{SQL: "SELECT count FROM " + name}},
+			Metrics:  []*Column{{Name: "count", Usage: GAUGE}},
+		}
+		assert.NoError(t, q.Check())
+		return q
+	}
+	queryMetric := map[string]*QueryInstance{
+		"pg_slow":    newQuery("pg_slow", 0),
+		"pg_cheap":   newQuery("pg_cheap", 1),
+		"pg_user":    newQuery("pg_user", 101),
+		"pg_another": newQuery("pg_another", 101),
+	}
+	var names []string
+	for _, q := range sortByPriority(queryMetric) {
+		names = append(names, q.Name)
+	}
+	assert.Equal(t, []string{"pg_cheap", "pg_another", "pg_user", "pg_slow"}, names)
+
+	s := &Server{
+		labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+		parallel:     1,
+		disableCache: true,
+		metricCache:  map[string]*cachedMetrics{},
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db = db
+	// single worker dispatches in priority order, expectations are matched in order
+	for _, name := range names {
+		mock.ExpectQuery("SELECT count FROM " + name).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	}
+	ch := make(chan prometheus.Metric, 10)
+	assert.Len(t, s.queryMetrics(ch, queryMetric), 0)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_upQuery(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		db:     db,
+		UP:     true,
+		labels: prometheus.Labels{serverLabelName: "localhost:5432"},
+	}
+	ServerWithUpQuery("INSERT INTO monitor.heartbeat VALUES (now())")(s)
+	mock.ExpectPing()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO monitor.heartbeat")).
+		WillReturnError(fmt.Errorf("cannot execute INSERT in a read-only transaction"))
+	assert.Error(t, s.ConnectDatabase())
+	assert.False(t, s.UP)
+	assert.NoError(t, s.setupServerInternalMetrics())
+	ch := make(chan prometheus.Metric, 100)
+	s.collectorServerInternalMetrics(ch)
+	close(ch)
+	var pb dto.Metric
+	assert.NoError(t, s.up.Write(&pb))
+	assert.Equal(t, float64(0), pb.GetGauge().GetValue())
+
+	mock.ExpectPing()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO monitor.heartbeat")).WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, s.ConnectDatabase())
+	assert.True(t, s.UP)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_queryMetrics_queueWait(t *testing.T) {
+	newQuery := func(name string, priority int) *QueryInstance {
+		q := &QueryInstance{
+			Name:     name,
+			Priority: priority,
+			// well above delay of slow query, default 100ms timeout would race with it
+			Timeout: 5,
+			Queries: []*Query{{SQL: "SELECT count FROM " + name}},
+			Metrics: []*Column{{Name: "count", Usage: GAUGE}},
+		}
+		assert.NoError(t, q.Check())
+		return q
+	}
+	s := &Server{
+		namespace:    "pg",
+		labels:       prometheus.Labels{serverLabelName: "localhost:5432"},
+		parallel:     1,
+		disableCache: true,
+		metricCache:  map[string]*cachedMetrics{},
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db = db
+	// single slow worker, the second instance waits for the first one
+	mock.ExpectQuery("SELECT count FROM pg_slow").WillDelayFor(100 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT count FROM pg_fast").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	ch := make(chan prometheus.Metric, 100)
+	assert.Len(t, s.queryMetrics(ch, map[string]*QueryInstance{
+		"pg_slow": newQuery("pg_slow", 1),
+		"pg_fast": newQuery("pg_fast", 2),
+	}), 0)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var pb dto.Metric
+	if assert.NotNil(t, s.queueWait) {
+		assert.NoError(t, s.queueWait.Write(&pb))
+		assert.Equal(t, uint64(2), pb.GetHistogram().GetSampleCount())
+		assert.GreaterOrEqual(t, pb.GetHistogram().GetSampleSum(), 0.1)
+	}
+	ch = make(chan prometheus.Metric, 100)
+	s.collectQueryInternalMetrics(ch)
+	close(ch)
+	var depth float64
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), `"pg_exporter_scrape_queue_depth"`) {
+			assert.NoError(t, m.Write(&pb))
+			depth = pb.GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, float64(2), depth)
+}
@@ -0,0 +1,60 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"crypto/tls"
+	pq "gitee.com/opengauss/openGauss-connector-go-pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// watchCertExpiry record certificate expiry of every TLS handshake the driver makes with config.
+// Only hosts sslmode negotiates TLS with have a tls config, so a non TLS connection records nothing.
+// Verification itself is left to the driver config as is
+func (s *Server) watchCertExpiry(config *pq.Config) {
+	config.TLSConfig = s.certExpiryTLSConfig(config.TLSConfig)
+	for _, fallback := range config.Fallbacks {
+		fallback.TLSConfig = s.certExpiryTLSConfig(fallback.TLSConfig)
+	}
+}
+
+// certExpiryTLSConfig copy of tlsConfig recording peer certificate expiry, nil stays nil
+func (s *Server) certExpiryTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	if tlsConfig == nil {
+		return nil
+	}
+	tlsConfig = tlsConfig.Clone()
+	verify := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		if len(state.PeerCertificates) > 0 {
+			s.setCertExpiry(state.PeerCertificates[0].NotAfter)
+		}
+		return nil
+	}
+	return tlsConfig
+}
+
+func (s *Server) setCertExpiry(expiry time.Time) {
+	s.certMtx.Lock()
+	defer s.certMtx.Unlock()
+	s.certExpiry = expiry
+}
+
+// certExpiryMetric expiry timestamp of server certificate, nil for non TLS connection
+func (s *Server) certExpiryMetric() prometheus.Metric {
+	s.certMtx.Lock()
+	expiry := s.certExpiry
+	s.certMtx.Unlock()
+	if expiry.IsZero() {
+		return nil
+	}
+	desc := prometheus.NewDesc(s.fqName("exporter", "tls_cert_expiry_timestamp_seconds"),
+		"expiry timestamp of the certificate the target presented on TLS connection", nil, s.labels)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(expiry.Unix()))
+}
@@ -3,9 +3,13 @@
 package exporter
 
 import (
+	"context"
+	"fmt"
 	pq "gitee.com/opengauss/openGauss-connector-go-pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
@@ -18,30 +22,95 @@ type Servers struct {
 	opts       []ServerOpt
 	dsnSetting map[string]string
 	collStatus map[string]bool
+	// scrapeJitter max random delay before scrape, spread load of many exporters
+	scrapeJitter time.Duration
+	// fingerprintJoin join all hosts of multi-host dsn as fingerprint, empty means first host only
+	fingerprintJoin string
+	// socketFingerprint keep unix socket directory in fingerprint
+	socketFingerprint bool
+	// replica standby of this dsn, runs PreferReplica queries instead of primary
+	replica *Servers
+	// dbListErrors times listing databases failed
+	dbListErrors float64
+	// lastDBInfoMap databases of last successful catalog query, used when the query fails
+	lastDBInfoMap map[string]*DBInfo
+	// globalOwner the only dsn of its instance running clusterGlobal queries in this scrape, elected by exporter
+	globalOwner bool
+	// breakerThreshold consecutive failed connects opening circuit breaker, 0 disables it
+	breakerThreshold int
+	// breakerCooldown connection attempts are skipped for it once circuit is open
+	breakerCooldown time.Duration
+	// breakerFailures consecutive failed connects
+	breakerFailures int
+	// breakerOpenUntil circuit is open until then
+	breakerOpenUntil time.Time
+	// breakerServer server of last failed connect, reports up while circuit is open
+	breakerServer *Server
+	// mem memory accounting shared by servers of all databases, reset every scrape
+	mem *scrapeMemory
+	// cacheOptAt 1-based position of disableCache opt added by setCacheDisabled, 0 means not added yet
+	cacheOptAt int
 
 	autoDiscoverOption
 	metricMap
 }
 
+// ServersOpt configures a collection of servers.
+type ServersOpt func(*Servers)
+
+// ServersWithScrapeJitter delay each scrape with a random duration up to maxDelay, 0 disables it
+func ServersWithScrapeJitter(maxDelay time.Duration) ServersOpt {
+	return func(s *Servers) {
+		s.scrapeJitter = maxDelay
+	}
+}
+
+// ServersWithCircuitBreaker skip connecting for cooldown after threshold consecutive failures, 0 threshold disables it
+func ServersWithCircuitBreaker(threshold int, cooldown time.Duration) ServersOpt {
+	return func(s *Servers) {
+		s.breakerThreshold, s.breakerCooldown = threshold, cooldown
+	}
+}
+
+// ServersWithFingerprintJoin join all hosts of multi-host dsn with sep as fingerprint, empty keeps the first host only
+func ServersWithFingerprintJoin(sep string) ServersOpt {
+	return func(s *Servers) {
+		s.fingerprintJoin = sep
+	}
+}
+
+// ServersWithSocketFingerprint keep unix socket directory in fingerprint
+func ServersWithSocketFingerprint(b bool) ServersOpt {
+	return func(s *Servers) {
+		s.socketFingerprint = b
+	}
+}
+
 // NewServers creates a collection of servers to OpenGauss.
 func NewServers(dsn string,
 	discOption autoDiscoverOption,
 	metricMap2 metricMap,
+	serversOpts []ServersOpt,
 	opts ...ServerOpt) (*Servers, error) {
 	dsnSetting, err := pq.ParseURLToMap(dsn)
 	if err != nil {
 		log.Errorf("Unable to parse DSN (%s): %v", ShadowDSN(dsn), err)
 		return nil, err
 	}
+	mem := &scrapeMemory{}
 	servers := &Servers{
 		dsn:                dsn,
 		servers:            make(map[string]*Server),
-		opts:               opts,
+		opts:               append(opts[:len(opts):len(opts)], serverWithScrapeMemory(mem)),
+		mem:                mem,
 		dsnSetting:         dsnSetting,
 		collStatus:         map[string]bool{},
 		autoDiscoverOption: discOption,
 		metricMap:          metricMap2,
 	}
+	for _, opt := range serversOpts {
+		opt(servers)
+	}
 	return servers, nil
 }
 
@@ -55,38 +124,200 @@ func NewServers(dsn string,
 //	+. Clean up old servers
 //
 // -. Traverse the server collection
-func (s *Servers) ScrapeDSN(ch chan<- prometheus.Metric) {
+func (s *Servers) ScrapeDSN(ctx context.Context, ch chan<- prometheus.Metric) {
+	scrapeJitterDelay(ctx, s.scrapeJitter)
+	if s.breakerOpen() {
+		log.Warnf("circuit open for (%s), skip connecting until %s", ShadowDSN(s.dsn), s.breakerOpenUntil.Format(time.RFC3339))
+		if s.breakerServer != nil {
+			s.breakerServer.collectorServerInternalMetrics(ch)
+			s.collectBreaker(ch, s.breakerServer)
+		}
+		return
+	}
+	s.mem.reset()
 	server, err := s.GetServer(s.dsn)
+	s.breakerRecord(server, err)
+	s.collectBreaker(ch, server)
 	if err != nil {
 		server.collectorServerInternalMetrics(ch)
 		log.Errorf("discoverDatabaseDSNs error opening connection to database (%s): %v", ShadowDSN(s.dsn), err)
 		return
 	}
-	dbMaps, err := server.QueryDatabases()
-	if err != nil {
-		log.Errorf("QueryDatabases error (%s): %v", ShadowDSN(s.dsn), err)
+	var dbMaps map[string]*DBInfo
+	if len(s.databases) > 0 {
+		// 指定数据库列表,不查询pg_database
+		dbMaps = s.fixedDBInfoMap()
+	} else {
+		begin := time.Now()
+		dbMaps, err = server.QueryDatabases()
+		s.collectDatabaseList(ch, server, time.Since(begin), err)
+		if err != nil {
+			// keep charset info and discovered databases of last scrape, primary dsn is scraped anyway
+			log.Errorf("QueryDatabases error (%s): %v, use databases of last scrape", ShadowDSN(s.dsn), err)
+			dbMaps = s.lastDBInfoMap
+		} else {
+			s.lastDBInfoMap = dbMaps
+		}
 	}
 	// 设置db信息. 根据查询进行关键字段转码
 	server.SetDBInfoMap(dbMaps)
-	if s.autoDiscovery && len(dbMaps) > 0 {
+	if (s.autoDiscovery || len(s.databases) > 0) && len(dbMaps) > 0 {
 		s.discoveryServer(dbMaps, server.dbName)
 	}
 	s.collStatus = map[string]bool{}
+	perDatabaseMetricMap := s.perDatabaseMetricMap()
 	for i := range s.servers {
 		server = s.servers[i]
+		s.discoverSchemas(server)
 		_, ok := s.collStatus[server.fingerprint]
 		// 如果同一个ip+端口采集过一次,说明公共指标已采集,不需要在采集了
 		if ok {
 			server.notCollInternalMetrics = true
-			_ = server.ScrapeWithMetric(ch, s.priMetricMap)
+			_ = server.ScrapeWithMetric(ch, perDatabaseMetricMap)
 		} else {
 			server.notCollInternalMetrics = false
-			_ = server.ScrapeWithMetric(ch, s.allMetricMap)
+			queryMetric := s.allMetricMap
+			if !s.globalOwner {
+				queryMetric = withoutClusterGlobal(queryMetric)
+			}
+			_ = server.ScrapeWithMetric(ch, s.scrapeReplica(ch, queryMetric))
 			s.collStatus[server.fingerprint] = true
 		}
 	}
 }
 
+// upState whether server of dsn was up and primary when last connected or checked
+func (s *Servers) upState() (bool, bool) {
+	s.m.Lock()
+	server, ok := s.servers[s.dsn]
+	s.m.Unlock()
+	if !ok {
+		return false, false
+	}
+	if server.CheckConn() != nil {
+		return false, false
+	}
+	return true, server.isPrimary()
+}
+
+// breakerOpen circuit breaker skips connecting to failing target until cooldown passed
+func (s *Servers) breakerOpen() bool {
+	return s.breakerThreshold > 0 && time.Now().Before(s.breakerOpenUntil)
+}
+
+// breakerRecord count consecutive failed connects, circuit opens once threshold reached.
+// After cooldown one attempt is made, failure opens circuit again and success closes it
+func (s *Servers) breakerRecord(server *Server, err error) {
+	if s.breakerThreshold <= 0 {
+		return
+	}
+	if err == nil {
+		s.breakerFailures, s.breakerOpenUntil, s.breakerServer = 0, time.Time{}, nil
+		return
+	}
+	s.breakerFailures++
+	s.breakerServer = server
+	if s.breakerFailures >= s.breakerThreshold {
+		s.breakerOpenUntil = time.Now().Add(s.breakerCooldown)
+		log.Warnf("circuit open for (%s) after %d failures, cooldown %s", ShadowDSN(s.dsn), s.breakerFailures, s.breakerCooldown)
+	}
+}
+
+// collectBreaker emit exporter_circuit_open of target if circuit breaker enabled
+func (s *Servers) collectBreaker(ch chan<- prometheus.Metric, server *Server) {
+	if s.breakerThreshold <= 0 || server == nil {
+		return
+	}
+	var open float64
+	if s.breakerOpen() {
+		open = 1
+	}
+	desc := prometheus.NewDesc(server.fqName("exporter", "circuit_open"),
+		"whether connecting to target is skipped after repeated failures", nil, server.labels)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, open)
+}
+
+// collectDatabaseList emit duration and errors of catalog query listing databases
+func (s *Servers) collectDatabaseList(ch chan<- prometheus.Metric, server *Server, duration time.Duration, err error) {
+	if err != nil {
+		s.dbListErrors++
+	}
+	ch <- prometheus.MustNewConstMetric(prometheus.NewDesc(server.fqName("exporter", "database_list_duration_seconds"),
+		"seconds spent listing databases from pg_database in last scrape", nil, server.labels), prometheus.GaugeValue, duration.Seconds())
+	ch <- prometheus.MustNewConstMetric(prometheus.NewDesc(server.fqName("exporter", "database_list_errors_total"),
+		"times listing databases from pg_database failed", nil, server.labels), prometheus.CounterValue, s.dbListErrors)
+}
+
+// scrapeReplica run PreferReplica queries on standby replica, return queries left for primary.
+// All queries are left for primary if replica is not configured, unreachable or not a standby,
+// queries failed on replica are left for primary as well
+func (s *Servers) scrapeReplica(ch chan<- prometheus.Metric, queryMetric map[string]*QueryInstance) map[string]*QueryInstance {
+	if s.replica == nil {
+		return queryMetric
+	}
+	preferred, rest := map[string]*QueryInstance{}, map[string]*QueryInstance{}
+	for name, q := range queryMetric {
+		if q.PreferReplica {
+			preferred[name] = q
+		} else {
+			rest[name] = q
+		}
+	}
+	if len(preferred) == 0 {
+		return queryMetric
+	}
+	replica, err := s.replica.GetServer(s.replica.dsn)
+	if err != nil {
+		log.Warnf("replica of (%s) unavailable, query on primary: %s", ShadowDSN(s.dsn), err)
+		return queryMetric
+	}
+	if replica.isPrimary() {
+		log.Warnf("replica (%s) is not a standby, query on primary", ShadowDSN(s.replica.dsn))
+		return queryMetric
+	}
+	// replica internal metrics are left out, it is not a scrape target
+	replica.notCollInternalMetrics = true
+	s.replica.mem.reset()
+	errMap, err := replica.scrapeWithMetric(ch, preferred)
+	if err != nil && len(errMap) == 0 {
+		log.Warnf("scrape replica (%s) err %s, query on primary", ShadowDSN(s.replica.dsn), err)
+		return queryMetric
+	}
+	for name := range errMap {
+		if q, ok := preferred[name]; ok {
+			log.Warnf("query %s on replica (%s) err %s, query on primary", name, ShadowDSN(s.replica.dsn), errMap[name])
+			rest[name] = q
+		}
+	}
+	return rest
+}
+
+// perDatabaseMetricMap private metrics and public metrics marked perDatabase,
+// collected on every database of a scraped instance
+func (s *Servers) perDatabaseMetricMap() map[string]*QueryInstance {
+	queryMetric := make(map[string]*QueryInstance, len(s.priMetricMap))
+	for name, q := range s.priMetricMap {
+		queryMetric[name] = q
+	}
+	for name, q := range s.allMetricMap {
+		if q.PerDatabase {
+			queryMetric[name] = q
+		}
+	}
+	return queryMetric
+}
+
+// withoutClusterGlobal queries except clusterGlobal ones, which are run by another dsn of the cluster
+func withoutClusterGlobal(queryMetric map[string]*QueryInstance) map[string]*QueryInstance {
+	rest := make(map[string]*QueryInstance, len(queryMetric))
+	for name, q := range queryMetric {
+		if !q.ClusterGlobal {
+			rest[name] = q
+		}
+	}
+	return rest
+}
+
 func (s *Servers) discoveryServer(dbMaps map[string]*DBInfo, currentDBName string) {
 	dsnSetting := make(map[string]string)
 	for k, v := range s.dsnSetting {
@@ -118,24 +349,82 @@ func (s *Servers) discoveryServer(dbMaps map[string]*DBInfo, currentDBName strin
 	}
 }
 
+// fixedDBInfoMap db info of configured databases, charset is unknown without catalog query, default UTF8
+func (s *Servers) fixedDBInfoMap() map[string]*DBInfo {
+	dbMaps := make(map[string]*DBInfo, len(s.databases))
+	for _, dbName := range s.databases {
+		dbMaps[dbName] = &DBInfo{
+			DBName:  dbName,
+			Charset: UTF8,
+		}
+	}
+	return dbMaps
+}
+
 func (s *Servers) genDiscoveryDBNames(dbMaps map[string]*DBInfo) []string {
-	var newDBNames []string
+	dbNames := make([]string, 0, len(dbMaps))
 	for dbName := range dbMaps {
-		if len(s.includeDatabases) > 0 {
-			if Contains(s.includeDatabases, dbName) {
-				newDBNames = append(newDBNames, dbName)
-				continue
-			}
-		} else if len(s.excludedDatabases) > 0 {
-			if Contains(s.excludedDatabases, dbName) {
-				continue
+		dbNames = append(dbNames, dbName)
+	}
+	return filterNames(dbNames, s.includeDatabases, s.excludedDatabases)
+}
+
+// genDiscoverySchemas schemas bound into perSchema queries, filtered like databases
+func (s *Servers) genDiscoverySchemas(schemas []string) []string {
+	return filterNames(schemas, s.includeSchemas, s.excludedSchemas)
+}
+
+// filterNames keep names in include if given, otherwise drop names in exclude. result is sorted
+func filterNames(names, include, exclude []string) []string {
+	var result []string
+	for _, name := range names {
+		if len(include) > 0 {
+			if Contains(include, name) {
+				result = append(result, name)
 			}
-			newDBNames = append(newDBNames, dbName)
-		} else {
-			newDBNames = append(newDBNames, dbName)
+		} else if !Contains(exclude, name) {
+			result = append(result, name)
 		}
 	}
-	return newDBNames
+	sort.Strings(result)
+	return result
+}
+
+// perSchemaTimeout largest timeout of queries needing discovered schemas, schemas are discovered in it.
+// 0 if any of them has no timeout, false if no query needs them
+func (s *Servers) perSchemaTimeout() (time.Duration, bool) {
+	var (
+		timeout time.Duration
+		found   bool
+	)
+	for _, q := range s.allMetricMap {
+		if !q.PerSchema {
+			continue
+		}
+		d := q.TimeoutDuration()
+		if d == 0 {
+			return 0, true
+		}
+		if d > timeout {
+			timeout = d
+		}
+		found = true
+	}
+	return timeout, found
+}
+
+// discoverSchemas refresh schemas of server, schemas of last scrape are kept on error
+func (s *Servers) discoverSchemas(server *Server) {
+	timeout, ok := s.perSchemaTimeout()
+	if !s.autoDiscoverSchemas || !ok {
+		return
+	}
+	schemas, err := server.QuerySchemas(timeout)
+	if err != nil {
+		log.Errorf("QuerySchemas error (%s): %v, use schemas of last scrape", ShadowDSN(server.dsn), err)
+		return
+	}
+	server.schemas = s.genDiscoverySchemas(schemas)
 }
 
 // GetServer returns established connection from a collection.
@@ -161,7 +450,7 @@ func (s *Servers) GetServer(dsn string) (*Server, error) {
 			}
 			s.servers[dsn] = server
 		}
-		if !server.UP {
+		if server.CheckConn() != nil {
 			if err = server.ConnectDatabase(); err != nil {
 				log.Errorf("GetServer ConnectDatabase %s err %s", server.fingerprint, err)
 				time.Sleep(1 * time.Second)
@@ -184,6 +473,132 @@ func (s *Servers) GetServer(dsn string) (*Server, error) {
 	return server, nil
 }
 
+// updateCredentials set new password of dsn and all servers, servers are re-keyed by new dsn
+func (s *Servers) updateCredentials(password string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.dsnSetting[DSNPassword] = password
+	s.dsn = genDSNString(s.dsnSetting)
+	servers := make(map[string]*Server, len(s.servers))
+	for _, server := range s.servers {
+		if err := server.UpdateCredentials(password); err != nil {
+			return err
+		}
+		servers[server.dsn] = server
+	}
+	s.servers = servers
+	return nil
+}
+
+// connect create server of dsn and connect it once, used by fail fast at start-up
+func (s *Servers) connect() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	server, err := NewServer(s.dsn, s.opts...)
+	if err != nil {
+		if server != nil {
+			_ = server.Close()
+			return fmt.Errorf("connect to %s err %s", server.fingerprint, err)
+		}
+		return err
+	}
+	s.servers[s.dsn] = server
+	return nil
+}
+
+// check connect to primary dsn once and read base info without retry, metrics are not scraped
+func (s *Servers) check() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	server, ok := s.servers[s.dsn]
+	if !ok {
+		var err error
+		if server, err = NewServer(s.dsn, s.opts...); err != nil {
+			if server != nil {
+				_ = server.Close()
+			}
+			return err
+		}
+		s.servers[s.dsn] = server
+	} else if err := server.ConnectDatabase(); err != nil {
+		return err
+	}
+	return server.getBaseInfo()
+}
+
+// flushCache drop cached metrics of all servers
+func (s *Servers) flushCache() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, server := range s.servers {
+		server.FlushCache()
+	}
+}
+
+// setCacheDisabled update disableCache of all servers, servers created later are set by opts.
+// Repeated toggles replace the opt added by the first one, opts don't grow
+func (s *Servers) setCacheDisabled(b bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.cacheOptAt > 0 {
+		s.opts[s.cacheOptAt-1] = ServerWithDisableCache(b)
+	} else {
+		s.opts = append(s.opts, ServerWithDisableCache(b))
+		s.cacheOptAt = len(s.opts)
+	}
+	for _, server := range s.servers {
+		ServerWithDisableCache(b)(server)
+	}
+}
+
+// cacheSnapshot returns cache snapshot of every server, keyed by fingerprint/database
+func (s *Servers) cacheSnapshot() map[string]map[string]CacheEntryInfo {
+	s.m.Lock()
+	defer s.m.Unlock()
+	snapshot := make(map[string]map[string]CacheEntryInfo, len(s.servers))
+	for _, server := range s.servers {
+		snapshot[fmt.Sprintf("%s/%s", server.fingerprint, server.dbName)] = server.CacheSnapshot()
+	}
+	return snapshot
+}
+
+// targets returns fingerprint and database name of the configured dsn and all discovered databases
+func (s *Servers) targets() [][2]string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.servers) == 0 {
+		fingerprint, err := parseFingerprintJoin(s.dsn, s.fingerprintJoin, s.socketFingerprint)
+		if err != nil {
+			return nil
+		}
+		return [][2]string{{fingerprint, s.dsnSetting[DSNDatabase]}}
+	}
+	var targets [][2]string
+	for _, server := range s.servers {
+		dbName := server.dbName
+		if dbName == "" && server.dsn == s.dsn {
+			dbName = s.dsnSetting[DSNDatabase]
+		}
+		targets = append(targets, [2]string{server.fingerprint, dbName})
+	}
+	return targets
+}
+
+// upCount number of up servers and all servers, dsn not connected yet counts as one down server
+func (s *Servers) upCount() (up, total int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.servers) == 0 {
+		return 0, 1
+	}
+	for _, server := range s.servers {
+		if server.UP {
+			up++
+		}
+	}
+	return up, len(s.servers)
+}
+
 // Close disconnects from all known servers.
 func (s *Servers) Close() {
 	s.m.Lock()
@@ -193,4 +608,38 @@ func (s *Servers) Close() {
 			log.Errorf("failed to close connection to %q: %v", server, err)
 		}
 	}
+	if s.replica != nil {
+		s.replica.Close()
+	}
+}
+
+var (
+	// jitterRand seeded per process, so exporters started together get different delays
+	jitterRand    = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterRandMtx sync.Mutex
+)
+
+// scrapeJitterDelay wait a random delay in [0, maxDelay) before scrape.
+// Skip the delay if ctx deadline is nearer than maxDelay, return the waited time
+func scrapeJitterDelay(ctx context.Context, maxDelay time.Duration) time.Duration {
+	if maxDelay <= 0 {
+		return 0
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < maxDelay {
+		return 0
+	}
+	var (
+		delay time.Duration
+		begin = time.Now()
+	)
+	jitterRandMtx.Lock()
+	delay = time.Duration(jitterRand.Int63n(int64(maxDelay)))
+	jitterRandMtx.Unlock()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return time.Since(begin)
 }
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"hash/crc32"
 	"math"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -19,7 +22,7 @@ func (s *Server) querySettings(ch chan<- prometheus.Metric) error {
 	//
 	// NOTE: If you add more vartypes here, you must update the supported
 	// types in normaliseUnit() below
-	query := "SELECT name, setting, COALESCE(unit, ''), short_desc, vartype FROM pg_settings WHERE vartype IN ('bool', 'integer', 'real','string');"
+	query := "SELECT name, setting, COALESCE(unit, ''), short_desc, vartype FROM pg_settings WHERE vartype IN ('bool', 'integer', 'real','string','enum');"
 
 	rows, err := s.db.Query(query)
 	if err != nil {
@@ -27,6 +30,7 @@ func (s *Server) querySettings(ch chan<- prometheus.Metric) error {
 	}
 	defer rows.Close() // nolint: errcheck
 
+	var checksumPairs []string
 	for rows.Next() {
 		pgSetting := &pgSetting{}
 		var unit *string
@@ -37,24 +41,45 @@ func (s *Server) querySettings(ch chan<- prometheus.Metric) error {
 		if unit != nil {
 			pgSetting.unit = *unit
 		}
+		if Contains(s.checksumSettings, pgSetting.name) {
+			checksumPairs = append(checksumPairs, pgSetting.name+"="+pgSetting.setting)
+		}
 
-		if metric := pgSetting.metric(s.namespace, s.labels); metric != nil {
+		if pgSetting.varType == "string" && !pgSetting.hasUnitValue() {
+			// textual settings can't be a gauge value, skip or emit it as info metric
+			if s.textSettingsAsInfo {
+				ch <- pgSetting.infoMetric(s.namespace, s.labels, s.renamer)
+			}
+			continue
+		}
+		if metric := pgSetting.metric(s.namespace, s.labels, s.renamer); metric != nil {
 			ch <- metric
 		}
 	}
 	if err = rows.Err(); err != nil {
 		return err
 	}
+	if len(s.checksumSettings) > 0 {
+		ch <- configChecksumMetric(s.namespace, s.labels, checksumPairs, s.renamer)
+	}
 	return nil
 }
 
+// configChecksumMetric crc32 of sorted name=value pairs of checksum settings, changes when any of them changes
+func configChecksumMetric(namespace string, labels prometheus.Labels, pairs []string, renamer func(string) string) prometheus.Metric {
+	sort.Strings(pairs)
+	checksum := crc32.ChecksumIEEE([]byte(strings.Join(pairs, "\n")))
+	desc := newDesc(renamer, namespace, "config", "checksum", "checksum of monitored settings, changes when their values drift", labels)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(checksum))
+}
+
 // pgSetting is represents a OpenGauss runtime variable as returned by the
 // pg_settings view.
 type pgSetting struct {
 	name, setting, unit, shortDesc, varType string
 }
 
-func (s *pgSetting) metric(namespace string, labels prometheus.Labels) prometheus.Metric {
+func (s *pgSetting) metric(namespace string, labels prometheus.Labels, renamer func(string) string) prometheus.Metric {
 	var (
 		err       error
 		name      = strings.Replace(s.name, ".", "_", -1)
@@ -69,53 +94,109 @@ func (s *pgSetting) metric(namespace string, labels prometheus.Labels) prometheu
 		if s.setting == "on" {
 			val = 1
 		}
-	case "integer", "real":
+	case "integer", "real", "string":
+		if s.varType == "string" && !s.hasUnitValue() {
+			return nil
+		}
 		if val, unit, err = s.normaliseUnit(); err != nil {
-			// Panic, since we should recognise all units
-			// and don't want to silently exlude metrics
-			panic(err)
+			// one odd setting must not fail the whole scrape
+			log.Warnf("setting %s skipped: %s", s.name, err)
+			return nil
 		}
 
 		if len(unit) > 0 {
 			name = fmt.Sprintf("%s_%s", name, unit)
 			shortDesc = fmt.Sprintf("%s [Units converted to %s.]", shortDesc, unit)
 		}
-	case "string":
-
 	default:
 		// Panic because we got a type we didn't ask for
 		// panic(fmt.Sprintf("Unsupported vartype %q", s.varType))
 		return nil
 	}
 
-	desc := newDesc(namespace, subsystem, name, shortDesc, labels)
+	desc := newDesc(renamer, namespace, subsystem, name, shortDesc, labels)
 	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val)
 }
 
-func newDesc(namespace, subsystem, name, help string, labels prometheus.Labels) *prometheus.Desc {
+// infoMetric textual setting as info metric, value in setting label
+func (s *pgSetting) infoMetric(namespace string, labels prometheus.Labels, renamer func(string) string) prometheus.Metric {
+	var (
+		name        = strings.Replace(s.name, ".", "_", -1) + "_info"
+		constLabels = prometheus.Labels{"setting": s.setting}
+	)
+	for k, v := range labels {
+		constLabels[k] = v
+	}
+	desc := newDesc(renamer, namespace, "settings", name, s.shortDesc, constLabels)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)
+}
+
+// newDesc desc of setting metric, name rewritten by renamer of --metric-rename
+func newDesc(renamer func(string) string, namespace, subsystem, name, help string, labels prometheus.Labels) *prometheus.Desc {
 	return prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, subsystem, name),
+		renameMetric(renamer, prometheus.BuildFQName(namespace, subsystem, name)),
 		help, nil, labels,
 	)
 }
 
+// settingUnitRegex setting value with unit, e.g. 8GB 128MB 100ms
+var settingUnitRegex = regexp.MustCompile(`^\s*(-?[0-9]+(?:\.[0-9]+)?)\s*([a-zA-Z]+)\s*$`)
+
+// splitSettingUnit split setting value like 8GB into number and unit
+func splitSettingUnit(setting string) (float64, string, bool) {
+	m := settingUnitRegex.FindStringSubmatch(setting)
+	if m == nil {
+		return 0, "", false
+	}
+	val, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return val, m[2], true
+}
+
+// hasUnitValue setting value carries its own unit normaliseUnit knows, e.g. 8GB. 10us is textual
+func (s *pgSetting) hasUnitValue() bool {
+	_, unit, ok := splitSettingUnit(s.setting)
+	if !ok {
+		return false
+	}
+	_, known := settingBaseUnit(unit)
+	return known
+}
+
+// settingBaseUnit unit setting of unit is converted to, false for unknown unit
+func settingBaseUnit(unit string) (string, bool) {
+	switch unit {
+	case "":
+		return "", true
+	case "ms", "s", "min", "h", "d":
+		return "seconds", true
+	case "B", "kB", "MB", "GB", "TB", "8kB", "16kB", "32kB", "16MB", "32MB", "64MB":
+		return "bytes", true
+	}
+	return "", false
+}
+
 // nolint: nakedret
 func (s *pgSetting) normaliseUnit() (val float64, unit string, err error) {
+	settingUnit := s.unit
 	val, err = strconv.ParseFloat(s.setting, 64)
 	if err != nil {
-		return val, unit, fmt.Errorf("Error converting setting %q value %q to float: %s ", s.name, s.setting, err)
+		var ok bool
+		if val, settingUnit, ok = splitSettingUnit(s.setting); !ok {
+			return val, unit, fmt.Errorf("Error converting setting %q value %q to float: %s ", s.name, s.setting, err)
+		}
+		err = nil
 	}
 
 	// Units defined in: https://www.postgresql.org/docs/current/static/config-setting.html
-	switch s.unit {
-	case "":
+	var known bool
+	if unit, known = settingBaseUnit(settingUnit); !known {
+		err = fmt.Errorf("Unknown unit for runtime variable: %q ", settingUnit)
 		return
-	case "ms", "s", "min", "h", "d":
-		unit = "seconds"
-	case "B", "kB", "MB", "GB", "TB", "8kB", "16kB", "32kB", "16MB", "32MB", "64MB":
-		unit = "bytes"
-	default:
-		err = fmt.Errorf("Unknown unit for runtime variable: %q ", s.unit)
+	}
+	if unit == "" {
 		return
 	}
 
@@ -124,7 +205,7 @@ func (s *pgSetting) normaliseUnit() (val float64, unit string, err error) {
 		return
 	}
 
-	switch s.unit {
+	switch settingUnit {
 	case "ms":
 		val /= 1000
 	case "min":
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -70,7 +72,7 @@ func TestServer_querySettings(t *testing.T) {
 		pgSetting := &pgSetting{
 			varType: "a1",
 		}
-		metric := pgSetting.metric("a1", nil)
+		metric := pgSetting.metric("a1", nil, nil)
 		assert.Nil(t, metric)
 	})
 	t.Run("normaliseUnit", func(t *testing.T) {
@@ -107,3 +109,191 @@ func TestServer_querySettings(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func Test_pgSetting_normaliseUnit_value(t *testing.T) {
+	tests := []struct {
+		name     string
+		setting  string
+		unit     string
+		wantVal  float64
+		wantUnit string
+		wantErr  bool
+	}{
+		{name: "8GB", setting: "8GB", wantVal: 8 * 1024 * 1024 * 1024, wantUnit: "bytes"},
+		{name: "128MB", setting: "128MB", wantVal: 128 * 1024 * 1024, wantUnit: "bytes"},
+		{name: "16kB", setting: "16kB", wantVal: 16 * 1024, wantUnit: "bytes"},
+		{name: "100ms", setting: "100ms", wantVal: 0.1, wantUnit: "seconds"},
+		{name: "5min", setting: "5min", wantVal: 300, wantUnit: "seconds"},
+		{name: "1h", setting: "1h", wantVal: 3600, wantUnit: "seconds"},
+		{name: "unit_column", setting: "8", unit: "kB", wantVal: 8192, wantUnit: "bytes"},
+		{name: "unknown_unit", setting: "8XB", wantVal: 8, wantErr: true},
+		{name: "text", setting: "public", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &pgSetting{name: tt.name, setting: tt.setting, unit: tt.unit, varType: "integer"}
+			val, unit, err := s.normaliseUnit()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.InDelta(t, tt.wantVal, val, 1e-9)
+			assert.Equal(t, tt.wantUnit, unit)
+		})
+	}
+	t.Run("string_setting_with_unit", func(t *testing.T) {
+		s := &pgSetting{name: "cstore_buffers", setting: "8GB", shortDesc: "Used to.", varType: "string"}
+		metric := s.metric("pg", nil, nil)
+		if !assert.NotNil(t, metric) {
+			return
+		}
+		pb := &dto.Metric{}
+		assert.NoError(t, metric.Write(pb))
+		assert.Contains(t, metric.Desc().String(), "pg_settings_cstore_buffers_bytes")
+		assert.Equal(t, float64(8*1024*1024*1024), pb.GetGauge().GetValue())
+	})
+}
+
+func TestServer_querySettings_configChecksum(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{db: db, namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"},
+		checksumSettings: []string{"wal_level", "shared_buffers"}}
+	checksum := func(walLevel, workMem string) float64 {
+		mock.ExpectQuery("SELECT").WillReturnRows(
+			sqlmock.NewRows([]string{"name", "setting", "coalesce", "short_desc", "vartype"}).AddRow(
+				"shared_buffers", "16384", "8kB", "Used to.", "integer").AddRow(
+				"wal_level", walLevel, "", "Used to.", "enum").AddRow(
+				"work_mem", workMem, "kB", "Used to.", "integer"))
+		ch := make(chan prometheus.Metric, 100)
+		assert.NoError(t, s.querySettings(ch))
+		close(ch)
+		var values []float64
+		for m := range ch {
+			if strings.Contains(m.Desc().String(), `"pg_config_checksum"`) {
+				pb := &dto.Metric{}
+				assert.NoError(t, m.Write(pb))
+				values = append(values, pb.GetGauge().GetValue())
+			}
+		}
+		if !assert.Len(t, values, 1) {
+			return 0
+		}
+		return values[0]
+	}
+	first := checksum("hot_standby", "4096")
+	assert.NotZero(t, first)
+	assert.Equal(t, first, checksum("hot_standby", "4096"))
+	// setting not monitored
+	assert.Equal(t, first, checksum("hot_standby", "8192"))
+	assert.NotEqual(t, first, checksum("logical", "4096"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_querySettings_renamer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{db: db, namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"},
+		checksumSettings: []string{"wal_level"}, textSettingsAsInfo: true,
+		renamer: func(name string) string { return strings.Replace(name, "pg_", "og_", 1) }}
+	mock.ExpectQuery("SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"name", "setting", "coalesce", "short_desc", "vartype"}).AddRow(
+			"shared_buffers", "16384", "8kB", "Used to.", "integer").AddRow(
+			"wal_level", "hot_standby", "", "Used to.", "string"))
+	ch := make(chan prometheus.Metric, 100)
+	assert.NoError(t, s.querySettings(ch))
+	close(ch)
+	var names []string
+	for m := range ch {
+		desc := m.Desc().String()
+		names = append(names, desc[strings.Index(desc, `"`)+1:strings.Index(desc, `", help`)])
+	}
+	assert.Equal(t, []string{"og_settings_shared_buffers_bytes", "og_settings_wal_level_info", "og_config_checksum"}, names)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServer_querySettings_unknownUnit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{db: db, namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"}, textSettingsAsInfo: true}
+	mock.ExpectQuery("SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"name", "setting", "coalesce", "short_desc", "vartype"}).AddRow(
+			"string_us", "10us", "", "Used to.", "string").AddRow(
+			"string_KB", "100KB", "", "Used to.", "string").AddRow(
+			"integer_us", "10", "us", "Used to.", "integer").AddRow(
+			"string_MB", "8MB", "", "Used to.", "string"))
+	ch := make(chan prometheus.Metric, 100)
+	assert.NotPanics(t, func() { assert.NoError(t, s.querySettings(ch)) })
+	close(ch)
+	var descs []string
+	for m := range ch {
+		descs = append(descs, m.Desc().String())
+	}
+	if assert.Len(t, descs, 3) {
+		assert.Contains(t, descs[0], "pg_settings_string_us_info")
+		assert.Contains(t, descs[1], "pg_settings_string_KB_info")
+		assert.Contains(t, descs[2], "pg_settings_string_MB_bytes")
+	}
+}
+
+func TestServer_querySettings_text(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s := &Server{db: db, namespace: "pg", labels: prometheus.Labels{serverLabelName: "localhost:5432"}}
+	settingsRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"name", "setting", "coalesce", "short_desc", "vartype"}).AddRow(
+			"bool_on", "on", "", "Used to.", "bool").AddRow(
+			"archive_command", "cp %p /archive/%f", "", "Used to.", "string").AddRow(
+			"search_path", `"$user",public`, "", "Used to.", "string").AddRow(
+			"integer_kB", "16", "kB", "Used to.", "integer")
+	}
+	collect := func() map[string]*dto.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		assert.NoError(t, s.querySettings(ch))
+		close(ch)
+		metrics := map[string]*dto.Metric{}
+		for m := range ch {
+			pb := &dto.Metric{}
+			assert.NoError(t, m.Write(pb))
+			metrics[m.Desc().String()] = pb
+		}
+		return metrics
+	}
+	t.Run("skip", func(t *testing.T) {
+		mock.ExpectQuery("SELECT").WillReturnRows(settingsRows())
+		metrics := collect()
+		assert.Len(t, metrics, 2)
+		for desc := range metrics {
+			assert.NotContains(t, desc, "archive_command")
+			assert.NotContains(t, desc, "search_path")
+		}
+	})
+	t.Run("info", func(t *testing.T) {
+		s.textSettingsAsInfo = true
+		defer func() { s.textSettingsAsInfo = false }()
+		mock.ExpectQuery("SELECT").WillReturnRows(settingsRows())
+		metrics := collect()
+		assert.Len(t, metrics, 4)
+		var found bool
+		for desc, pb := range metrics {
+			if !strings.Contains(desc, "pg_settings_archive_command_info") {
+				continue
+			}
+			found = true
+			assert.Equal(t, float64(1), pb.GetGauge().GetValue())
+			assert.Contains(t, desc, `setting="cp %p /archive/%f"`)
+			assert.Contains(t, desc, `server="localhost:5432"`)
+		}
+		assert.True(t, found)
+	})
+}
@@ -13,11 +13,14 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/blang/semver"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 )
 
 func Contains(a []string, x string) bool {
@@ -29,6 +32,21 @@ func Contains(a []string, x string) bool {
 	return false
 }
 
+// parsePairs parse "target fingerprint=value" pairs split at first =, e.g. 10.0.0.1:5432=orders or
+// 10.0.0.1:5432=postgresql://10.0.0.2:5432/postgres. Malformed pair is logged with format and skipped
+func parsePairs(pairs []string, format string) map[string]string {
+	values := map[string]string{}
+	for _, p := range pairs {
+		keyValue := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(keyValue) != 2 || strings.TrimSpace(keyValue[0]) == "" || strings.TrimSpace(keyValue[1]) == "" {
+			log.Errorf(`malformed format %q, should be %q`, ShadowDSN(p), format)
+			continue
+		}
+		values[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	return values
+}
+
 // parseConstLabels turn param string into prometheus.Labels
 func parseConstLabels(s string) prometheus.Labels {
 	labels := make(prometheus.Labels)
@@ -139,12 +157,44 @@ func parseGaussDBVersion(subMatches []string) string {
 	return fmt.Sprintf("%v.%v.%v", r1, r2, r3)
 }
 
+// parseFloatArray parse text of float array, like {0.1,1,Infinity}
+func parseFloatArray(v interface{}) ([]float64, error) {
+	var text string
+	switch v := v.(type) {
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	default:
+		return nil, fmt.Errorf("%v of type %T is not an array", v, v)
+	}
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") || !strings.HasSuffix(text, "}") {
+		return nil, fmt.Errorf("%q is not an array", text)
+	}
+	if text = text[1 : len(text)-1]; text == "" {
+		return []float64{}, nil
+	}
+	parts := strings.Split(text, ",")
+	values := make([]float64, len(parts))
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(part), `"`), 64)
+		if err != nil {
+			return nil, fmt.Errorf("array element %d %q is not a number", i, part)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
 // Convert database.sql types to float64s for Prometheus consumption. Null types are mapped to NaN. string and []byte
 // types are mapped as NaN and !ok
 func dbToFloat64(t interface{}) (float64, bool) {
 	switch v := t.(type) {
 	case int64:
 		return float64(v), true
+	case uint64:
+		return float64(v), true
 	case float64:
 		return v, true
 	case time.Time:
@@ -154,6 +204,9 @@ func dbToFloat64(t interface{}) (float64, bool) {
 		strV := string(v)
 		result, err := strconv.ParseFloat(strV, 64)
 		if err != nil {
+			if b, ok := textBoolToFloat64(strV); ok {
+				return b, true
+			}
 			log.Infoln("Could not parse []byte:", err)
 			return math.NaN(), false
 		}
@@ -161,6 +214,9 @@ func dbToFloat64(t interface{}) (float64, bool) {
 	case string:
 		result, err := strconv.ParseFloat(v, 64)
 		if err != nil {
+			if b, ok := textBoolToFloat64(v); ok {
+				return b, true
+			}
 			log.Infoln("Could not parse string:", err)
 			return math.NaN(), false
 		}
@@ -177,6 +233,87 @@ func dbToFloat64(t interface{}) (float64, bool) {
 	}
 }
 
+// maxExactFloat64Int integers beyond 2^53 can't be represented by float64 exactly
+const maxExactFloat64Int = 1 << 53
+
+// exceedsFloat64Precision check integer value lose precision when converted to float64
+func exceedsFloat64Precision(t interface{}) bool {
+	var strV string
+	switch v := t.(type) {
+	case int64:
+		return v > maxExactFloat64Int || v < -maxExactFloat64Int
+	case uint64:
+		return v > maxExactFloat64Int
+	case []byte:
+		strV = string(v)
+	case string:
+		strV = v
+	default:
+		return false
+	}
+	if i, err := strconv.ParseInt(strV, 10, 64); err == nil {
+		return i > maxExactFloat64Int || i < -maxExactFloat64Int
+	}
+	if u, err := strconv.ParseUint(strV, 10, 64); err == nil {
+		return u > maxExactFloat64Int
+	}
+	// integer beyond uint64, e.g. numeric
+	if len(strV) > 0 && strings.Trim(strings.TrimPrefix(strV, "-"), "0123456789") == "" {
+		return true
+	}
+	return false
+}
+
+// textBoolToFloat64 Convert textual boolean like t/f on/off yes/no enabled/disabled to 1/0
+func textBoolToFloat64(s string) (float64, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "t", "true", "on", "yes", "enabled":
+		return 1.0, true
+	case "f", "false", "off", "no", "disabled":
+		return 0.0, true
+	default:
+		return 0, false
+	}
+}
+
+// lsnToFloat64 Convert LSN / xlog position to byte offset. Both segment/offset format (0/331980B8)
+// and plain hex (331980B8, 0x331980B8) are supported. Other types fall back to dbToFloat64
+func lsnToFloat64(t interface{}) (float64, bool) {
+	var strV string
+	switch v := t.(type) {
+	case []byte:
+		strV = string(v)
+	case string:
+		strV = v
+	default:
+		return dbToFloat64(t)
+	}
+	strV = strings.TrimSpace(strV)
+	if strV == "" {
+		return math.NaN(), true
+	}
+	if parts := strings.Split(strV, "/"); len(parts) == 2 {
+		hi, err := strconv.ParseUint(parts[0], 16, 32)
+		if err != nil {
+			log.Infoln("Could not parse lsn:", err)
+			return math.NaN(), false
+		}
+		lo, err := strconv.ParseUint(parts[1], 16, 32)
+		if err != nil {
+			log.Infoln("Could not parse lsn:", err)
+			return math.NaN(), false
+		}
+		return float64(hi<<32 | lo), true
+	}
+	strV = strings.TrimPrefix(strings.TrimPrefix(strV, "0x"), "0X")
+	result, err := strconv.ParseUint(strV, 16, 64)
+	if err != nil {
+		log.Infoln("Could not parse hex:", err)
+		return math.NaN(), false
+	}
+	return float64(result), true
+}
+
 // Convert database.sql to string for Prometheus labels. Null types are mapped to empty strings.
 func dbToString(t interface{}, time2string bool) (string, bool) {
 	switch v := t.(type) {
@@ -206,6 +343,15 @@ func dbToString(t interface{}, time2string bool) (string, bool) {
 	}
 }
 
+// truncateLabelValue cut label value to n characters with a … suffix. return false if not truncated
+func truncateLabelValue(v string, n int) (string, bool) {
+	if n <= 0 || utf8.RuneCountInString(v) <= n {
+		return v, false
+	}
+	runes := []rune(v)
+	return string(runes[:n-1]) + "…", true
+}
+
 func RecoverErr(err *error) {
 	e := recover()
 	switch v := e.(type) {
@@ -256,3 +402,22 @@ func DecodeByte(b []byte, charset string) ([]byte, error) {
 	}
 	return tmp, err
 }
+
+// invalidRenameLogged renamed metric names already warned as invalid
+var invalidRenameLogged sync.Map
+
+// renameMetric apply renamer to metric name. Renamed name which is not a valid
+// prometheus metric name is ignored, warned once per name
+func renameMetric(renamer func(string) string, name string) string {
+	if renamer == nil {
+		return name
+	}
+	renamed := renamer(name)
+	if model.IsValidMetricName(model.LabelValue(renamed)) {
+		return renamed
+	}
+	if _, logged := invalidRenameLogged.LoadOrStore(renamed, true); !logged {
+		log.Warnf("metric %s renamed to invalid name %q, keep original name", name, renamed)
+	}
+	return name
+}
@@ -4,6 +4,7 @@ package exporter
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
 
@@ -62,6 +63,132 @@ func Test_parseConstLabels(t *testing.T) {
 	}
 }
 
+func Test_lsnToFloat64(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  interface{}
+		want  float64
+		want1 bool
+	}{
+		{
+			name:  "lsn",
+			args:  "0/331980B8",
+			want:  float64(0x331980B8),
+			want1: true,
+		},
+		{
+			name:  "lsn_segment",
+			args:  []byte("1/331980B8"),
+			want:  float64(1<<32 + 0x331980B8),
+			want1: true,
+		},
+		{
+			name:  "hex",
+			args:  "331980B8",
+			want:  float64(0x331980B8),
+			want1: true,
+		},
+		{
+			name:  "hex_prefix",
+			args:  "0xff",
+			want:  255,
+			want1: true,
+		},
+		{
+			name:  "int64",
+			args:  int64(16),
+			want:  16,
+			want1: true,
+		},
+		{
+			name:  "err",
+			args:  "0/xyz",
+			want1: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1 := lsnToFloat64(tt.args)
+			assert.Equal(t, tt.want1, got1)
+			if tt.want1 {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_exceedsFloat64Precision(t *testing.T) {
+	for v, want := range map[interface{}]bool{
+		int64(1 << 53):                   false,
+		int64(1<<53 + 1):                 true,
+		int64(-1<<53 - 1):                true,
+		uint64(1<<63 + 1):                true,
+		"9007199254740993":               true,
+		"9007199254740992":               false,
+		"123456789012345678901234567890": true,
+		"1234.5":                         false,
+		"abc":                            false,
+		float64(1 << 60):                 false,
+		nil:                              false,
+	} {
+		assert.Equal(t, want, exceedsFloat64Precision(v), "%v", v)
+	}
+	assert.True(t, exceedsFloat64Precision([]byte("9007199254740993")))
+}
+
+func Test_truncateLabelValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		v     string
+		n     int
+		want  string
+		want1 bool
+	}{
+		{name: "unlimited", v: "select * from dual", n: 0, want: "select * from dual", want1: false},
+		{name: "short", v: "select", n: 10, want: "select", want1: false},
+		{name: "equal", v: "select", n: 6, want: "select", want1: false},
+		{name: "long", v: "select * from dual", n: 10, want: "select * …", want1: true},
+		{name: "utf8", v: "查询语句太长了", n: 4, want: "查询语…", want1: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1 := truncateLabelValue(tt.v, tt.n)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.want1, got1)
+			if tt.n > 0 {
+				assert.LessOrEqual(t, len([]rune(got)), tt.n)
+			}
+		})
+	}
+}
+
+func Test_parseFloatArray(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		want    []float64
+		wantErr bool
+	}{
+		{name: "bytes", v: []byte("{0.1,0.5,1}"), want: []float64{0.1, 0.5, 1}},
+		{name: "infinity", v: `{1, "Infinity"}`, want: []float64{1, math.Inf(1)}},
+		{name: "empty", v: "{}", want: []float64{}},
+		{name: "null", v: "{1,NULL}", wantErr: true},
+		{name: "scalar", v: int64(1), wantErr: true},
+		{name: "no_brace", v: "1,2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFloatArray(tt.v)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
 func TestShadowDSN(t *testing.T) {
 	type args struct {
 		dsn string
@@ -97,7 +224,21 @@ func TestShadowDSN(t *testing.T) {
 			args: args{
 				dsn: "user=xxx password=xxx host=127.0.0.1 port=5432 dbname=postgres sslmode=disable",
 			},
-			want: "user=xxx%20password=xxx%20host=127.0.0.1%20port=5432%20dbname=postgres%20sslmode=disable",
+			want: "user=xxx password=****** host=127.0.0.1 port=5432 dbname=postgres sslmode=disable",
+		},
+		{
+			name: "password with @",
+			args: args{
+				dsn: "user=gaussdb password=Test@123 host=127.0.0.1  port=5432 dbname=postgres",
+			},
+			want: "user=gaussdb password=****** host=127.0.0.1  port=5432 dbname=postgres",
+		},
+		{
+			name: "quoted password",
+			args: args{
+				dsn: "host=127.0.0.1 password = 'Te st@\\'123' user=gaussdb",
+			},
+			want: "host=127.0.0.1 password = ****** user=gaussdb",
 		},
 		{
 			name: "localhost:1234",
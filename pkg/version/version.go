@@ -42,6 +42,11 @@ func GetVersion() string {
 	return version + "+" + metadata
 }
 
+// GetGitCommit returns the git commit hash the program is compiled from
+func GetGitCommit() string {
+	return gitCommit
+}
+
 // Get returns build info
 // func Get() BuildInfo {
 // 	v := BuildInfo{